@@ -1,11 +1,10 @@
 package moshpit
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"regexp"
 	"strconv"
 	"time"
@@ -18,78 +17,139 @@ type FrameType uint
 
 const (
 	Unknown FrameType = iota
+	// IFrame is an intra-coded frame holding a whole picture.
 	IFrame
+	// PFrame is a frame predicted from the preceding frame.
 	PFrame
+	// BFrame is a frame predicted from the preceding and following frames.
+	BFrame
+	// SFrame is a sprite frame, which is predicted from the
+	// preceding frame using global motion compensation.
+	SFrame
+	// NotCodedFrame is a frame whose header marks it as
+	// not coded, repeating the preceding frame.
+	NotCodedFrame
+	// DroppedFrame is an empty frame written in place
+	// of a frame that was dropped by the encoder.
+	DroppedFrame
 )
 
-// we assume that an AVI frame is never larger than 1MB
-const maxAviFrameBytes = 1024 * 1024
-
-// the AVI frame delimiter
-var frameDelim = []byte{48, 48, 100, 99} // ASCII 00dc
-
-var iframePrefix = []byte{0, 1, 176} // hex 0x0001B0
-var pframePrefix = []byte{0, 1, 182} // hex 0x0001B6
-
-func frameDelimSplitFunc(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF && len(data) == 0 {
-		return 0, nil, nil
+// String returns the abbreviation of the frame type,
+// e.g. "I" for I-Frames.
+func (t FrameType) String() string {
+	switch t {
+	case IFrame:
+		return "I"
+	case PFrame:
+		return "P"
+	case BFrame:
+		return "B"
+	case SFrame:
+		return "S"
+	case NotCodedFrame:
+		return "N"
+	case DroppedFrame:
+		return "D"
+	default:
+		return "?"
 	}
-
-	if i := bytes.Index(data, frameDelim); i >= 0 {
-		// we found the frame delimiter
-		end := i + len(frameDelim)
-		return end, data[:end], nil
-	}
-
-	return 0, nil, nil
 }
 
-// AviScanner returns a Scanner that reads an AVI file frame-by-frame.
-func AviScanner(reader io.Reader) *bufio.Scanner {
-	r := bufio.NewScanner(reader)
-	r.Split(frameDelimSplitFunc)
-
-	// increase the maximum buffer size of the scanner
-	// to avoid "token too long" errors
-	buf := make([]byte, 0, 1024)
-	r.Buffer(buf, maxAviFrameBytes)
-
-	return r
+// FrameInfo describes a single video frame of an AVI file.
+type FrameInfo struct {
+	// Index is the index of the frame within its stream.
+	Index uint64
+	Type  FrameType
+	// Size is the size of the frame's data in bytes.
+	Size uint32
+	// Offset is the position of the frame's chunk in the file.
+	Offset int64
+	// Stream is the index of the stream the frame belongs to.
+	Stream int
+	// Timestamp is the presentation timestamp of the frame,
+	// derived from the frame rate in the stream header.
+	Timestamp time.Duration
 }
 
-// AnalyzeFrames analyzes the frames in the given file,
-// writing results to the channel provided.
+// AnalyzeFrames analyzes the video frames in the given file,
+// sending an EventResult with the FrameInfo of each frame
+// to the events channel.
 // The file is assumed to have AVI format.
-// Any errors encountered are sent to the error channel.
-// The error channel is closed when processing is finished.
-func AnalyzeFrames(ctx context.Context, inputFile io.Reader,
-	framesChan chan<- FrameType, errorChan chan<- error) {
+// Progress is reported relative to the number of frames
+// stated in the AVI header.
+// If analyzing fails, an EventError is sent as the last event.
+// The events channel is closed when processing is finished.
+func AnalyzeFrames(ctx context.Context, inputFile io.Reader, events chan<- Event) {
+	sendEvents(ctx, events, func(r reporter) error {
+		return analyzeFrames(ctx, inputFile, r)
+	})
+}
+
+// AnalyzeFramesSync is like AnalyzeFrames, but blocks until all frames
+// have been analyzed, notifying the observer of the events
+// if it is not nil, and returns the information of all frames.
+func AnalyzeFramesSync(ctx context.Context, inputFile io.Reader, observer Observer) ([]FrameInfo, error) {
+	var frames []FrameInfo
+	err := analyzeFrames(ctx, inputFile, newReporter(observer, func(result interface{}) {
+		frames = append(frames, result.(FrameInfo))
+	}))
+	return frames, err
+}
 
-	defer close(errorChan)
+func analyzeFrames(ctx context.Context, inputFile io.Reader, r reporter) error {
+	r.stage("Analyzing frames")
 
-	r := AviScanner(inputFile)
-loop:
+	reader := NewAviReader(inputFile)
+	header := &aviHeader{}
+	parsers := make(map[int]*vopParser)
+	// the number of frames read per stream
+	frames := make(map[int]uint64)
+	var total uint64
 	for {
 		select {
 		case <-ctx.Done():
-			break loop
+			return ctx.Err()
 		default:
-			if r.Scan() {
-				frame := r.Bytes()
-				frameType := Unknown
-				if bytes.Compare(frame[5:8], pframePrefix) == 0 {
-					frameType = PFrame
-				} else if bytes.Compare(frame[5:8], iframePrefix) == 0 {
-					frameType = IFrame
+			chunk, err := reader.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if chunk.ID == fccLIST && chunk.ListType == fccHdrl {
+				header, err = parseHeaderList(chunk.Data)
+				if err != nil {
+					return err
+				}
+				parsers = header.vopParsers()
+			}
+
+			if chunk.IsVideoFrame() {
+				stream, _ := chunk.Stream()
+				p, ok := parsers[stream]
+				if !ok {
+					p = &vopParser{}
+					parsers[stream] = p
 				}
 
-				framesChan <- frameType
-			} else {
-				if err := r.Err(); err != nil {
-					errorChan <- err
+				index := frames[stream]
+				frames[stream]++
+
+				r.result(FrameInfo{
+					Index:     index,
+					Type:      p.FrameType(chunk.Data),
+					Size:      chunk.Size,
+					Offset:    chunk.Offset,
+					Stream:    stream,
+					Timestamp: header.timestamp(stream, index),
+				})
+
+				total++
+				if frameCount := header.frameCount(); frameCount > 0 {
+					r.progress(math.Min(1, float64(total)/float64(frameCount)))
 				}
-				return
 			}
 		}
 	}
@@ -108,89 +168,118 @@ func (v *VideoTime) Timecode() string {
 	return v.timecode
 }
 
-// regex extracting the fps value of the first stream
-var ffmpegFPSRegex = regexp.MustCompile(`Stream #0:0[\s\S]* ([0-9.]*) fps`)
-
 // regex extracting the pts_time value from a showinfo line
 var ffmpegShowinfoTimestampRegex = regexp.MustCompile(`[Parsed_showinfo_1[\s\S]* pts_time:([0-9.]*)`)
 
 // FindScenes uses ffmpeg to find scene changes in the input file,
 // using the given similarity threshold between 0 and 1.
-// The detection progress is frequently written to the
-// progress channel as a value between 0.0 and 1.0.
-// Any errors encountered are sent to the error channel.
-// The error channel is closed when processing is finished.
-func FindScenes(ctx context.Context, ffmpegPath string,
-	ffmpegLogPath string, inputFile string, threshold float64,
-	sceneTimeChan chan<- VideoTime, progressChan chan<- float64,
-	errorChan chan<- error) {
-
-	defer close(errorChan)
+// Scene changes are detected in the video stream with the given
+// index among the video streams of the input file, which is
+// probed using ffprobe to determine its frame rate and duration.
+// Only the given segment of the input file is processed,
+// with the times and frame indices of the scene changes
+// still being relative to the start of the input file.
+// The frame indices count the frames at the frame rate of the
+// given format, so they match the frames of the AVI file
+// written by ConvertToAvi using the same format.
+// An EventResult with the VideoTime of each scene change
+// is sent to the events channel, along with the detection progress
+// and the lines of ffmpeg output.
+// If detection fails, an EventError is sent as the last event.
+// The events channel is closed when processing is finished.
+func FindScenes(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, inputFile string, videoStream int, segment Segment, format AviFormat, threshold float64,
+	events chan<- Event) {
+	sendEvents(ctx, events, func(r reporter) error {
+		return findScenes(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, inputFile, videoStream, segment, format, threshold, r)
+	})
+}
+
+// FindScenesSync is like FindScenes, but blocks until detection has finished,
+// notifying the observer of the events if it is not nil,
+// and returns the scene changes that were found.
+func FindScenesSync(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, inputFile string, videoStream int, segment Segment, format AviFormat, threshold float64,
+	observer Observer) ([]VideoTime, error) {
+	var sceneTimes []VideoTime
+	err := findScenes(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, inputFile, videoStream, segment, format, threshold,
+		newReporter(observer, func(result interface{}) {
+			sceneTimes = append(sceneTimes, result.(VideoTime))
+		}))
+	return sceneTimes, err
+}
+
+func findScenes(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, inputFile string, videoStream int, segment Segment, format AviFormat, threshold float64,
+	r reporter) error {
 	if threshold < 0 || threshold > 1 {
-		errorChan <- errors.New("scene detection threshold must be a value between 0 and 1")
-		return
+		return errors.New("scene detection threshold must be a value between 0 and 1")
+	}
+	if err := segment.validate(); err != nil {
+		return err
+	}
+	if err := format.validate(); err != nil {
+		return err
 	}
 
-	args := []string{
+	r.stage("Probing input file")
+	video, duration, err := probeVideo(ctx, ffprobePath, inputFile, videoStream)
+	if err != nil {
+		return err
+	}
+	fps := format.VideoFrameRate(video)
+	if fps == 0 {
+		return errors.New("could not find frame rate of input file")
+	}
+	rate := timecode.NewFloatRate(float32(fps))
+
+	// apply the showinfo filter on all frames that are a scene change,
+	// printing information about the frames to stderr.
+	// The frame rate is converted first to find the same frames
+	// as in the AVI file, while the resolution doesn't matter.
+	filter := fmt.Sprintf("select='gte(scene,%f)',showinfo", threshold)
+	fpsFilter, err := format.frameRateFilter(video)
+	if err != nil {
+		return err
+	}
+	if fpsFilter != "" {
+		filter = fpsFilter + "," + filter
+	}
+
+	// only read the segment of the input file
+	args := append(segment.inputArgs(),
 		"-i", inputFile,
-		// apply the showinfo filter on all frames that are a scene change,
-		// printing information about the frames to stderr
-		"-filter:v", fmt.Sprintf("select='gte(scene,%f)',showinfo", threshold),
+		// only process the selected video stream
+		"-map", fmt.Sprintf("0:v:%d", videoStream),
+		"-filter:v", filter,
 		// specify no output file, we're only interested
 		// in the command line output
 		"-f", "null", "-",
-	}
-
-	lineChan := make(chan string)
-	errProxyChan := make(chan error)
-	go runFFmpeg(ctx, ffmpegPath, args, ffmpegLogPath, progressChan, lineChan, errProxyChan)
+	)
 
-	var fps float64
-	var rate timecode.Rate
-	for {
-		select {
-		case err, ok := <-errProxyChan:
-			if ok {
-				errorChan <- err
-			}
-			return
-		case line := <-lineChan:
-			if m := ffmpegFPSRegex.FindStringSubmatch(line); m != nil {
-				// we found the fps value of the video stream
-				var err error
-				fps, err = strconv.ParseFloat(m[1], 64)
-				if err != nil {
-					errorChan <- fmt.Errorf("error parsing fps value: %s", err.Error())
-					return
-				}
-				rate = timecode.NewFloatRate(float32(fps))
-			}
-
-			if m := ffmpegShowinfoTimestampRegex.FindStringSubmatch(line); m != nil {
-				// we found the timestamp of a scene change
-				if fps == 0 {
-					// we haven't found the fps value, which should always
-					// occur before the showinfo output
-					errorChan <- errors.New("could not find fps value of input file")
-					return
-				}
+	r.stage("Detecting scene changes")
+	return runFFmpeg(ctx, ffmpegPath, args, ffmpegLogPath, segment.duration(duration), r, func(line string) error {
+		m := ffmpegShowinfoTimestampRegex.FindStringSubmatch(line)
+		if m == nil {
+			return nil
+		}
 
-				timestamp, err := strconv.ParseFloat(m[1], 64)
-				if err != nil {
-					errorChan <- fmt.Errorf("error parsing timestamp value: %s", err.Error())
-					return
-				}
-				t := time.Duration(timestamp * float64(time.Second))
-
-				// calculate the frame index of the scene change
-				tc := timecode.New(t, rate)
-				sceneTimeChan <- VideoTime{
-					Time:     t,
-					Frame:    uint64(tc.Frame()),
-					Fps:      fps,
-					timecode: tc.String(),
-				}
-			}
+		// we found the timestamp of a scene change
+		timestamp, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			return fmt.Errorf("error parsing timestamp value: %s", err.Error())
 		}
-	}
+		// the timestamps of the segment start at 0
+		t := segment.Start + time.Duration(timestamp*float64(time.Second))
+
+		// calculate the frame index of the scene change
+		tc := timecode.New(t, rate)
+		r.result(VideoTime{
+			Time:     t,
+			Frame:    uint64(tc.Frame()),
+			Fps:      fps,
+			timecode: tc.String(),
+		})
+		return nil
+	})
 }
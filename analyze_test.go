@@ -0,0 +1,135 @@
+package moshpit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestAnalyzeFrames(t *testing.T) {
+	iVOP, pVOP, bVOP := testVOP(vopCodingTypeI, 10), testVOP(vopCodingTypeP, 7), testVOP(vopCodingTypeB, 8)
+	vol := volHeader{resolution: 25}.bytes()
+	tests := []struct {
+		name   string
+		movi   [][]byte
+		frames []FrameInfo
+	}{
+		{
+			name: "frame types",
+			movi: frameChunks(iVOP, pVOP, bVOP, []byte{}, testVOP(vopCodingTypeS, 9)),
+			frames: []FrameInfo{
+				{Index: 0, Type: IFrame, Size: 10},
+				{Index: 1, Type: PFrame, Size: 7, Timestamp: 40 * time.Millisecond},
+				{Index: 2, Type: BFrame, Size: 8, Timestamp: 80 * time.Millisecond},
+				{Index: 3, Type: DroppedFrame, Size: 0, Timestamp: 120 * time.Millisecond},
+				{Index: 4, Type: SFrame, Size: 9, Timestamp: 160 * time.Millisecond},
+			},
+		},
+		{
+			name: "not coded frames",
+			movi: frameChunks(
+				append(vol, vopHeader(vopCodingTypeI, 0, 5, true)...),
+				vopHeader(vopCodingTypeP, 1, 5, false),
+				vopHeader(vopCodingTypeP, 0, 5, true),
+			),
+			frames: []FrameInfo{
+				{Index: 0, Type: IFrame, Size: uint32(len(vol) + len(vopHeader(vopCodingTypeI, 0, 5, true)))},
+				{Index: 1, Type: NotCodedFrame, Size: uint32(len(vopHeader(vopCodingTypeP, 1, 5, false))), Timestamp: 40 * time.Millisecond},
+				{Index: 2, Type: PFrame, Size: uint32(len(vopHeader(vopCodingTypeP, 0, 5, true))), Timestamp: 80 * time.Millisecond},
+			},
+		},
+		{
+			name: "multiple streams",
+			movi: [][]byte{
+				riffChunk("00dc", iVOP),
+				riffChunk("01wb", []byte{1, 2}),
+				riffChunk("01dc", pVOP),
+				riffList("LIST", "rec ", riffChunk("00dc", pVOP), riffChunk("01dc", bVOP)),
+			},
+			frames: []FrameInfo{
+				{Index: 0, Type: IFrame, Size: 10},
+				// the header only describes stream 0,
+				// so the frames of stream 1 have no timestamp
+				{Index: 0, Type: PFrame, Size: 7, Stream: 1},
+				{Index: 1, Type: PFrame, Size: 7, Timestamp: 40 * time.Millisecond},
+				{Index: 1, Type: BFrame, Size: 8, Stream: 1},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := testAviFile(test.movi, 0)
+			frames, err := AnalyzeFramesSync(context.Background(), bytes.NewReader(input), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(frames) != len(test.frames) {
+				t.Fatalf("got %d frames, want %d", len(frames), len(test.frames))
+			}
+			for i, frame := range frames {
+				// the offset must point to the frame's chunk
+				header := input[frame.Offset:]
+				if string(header[2:4]) != "dc" || binary.LittleEndian.Uint32(header[4:]) != frame.Size {
+					t.Fatalf("frame %d: offset %d doesn't point to a frame chunk", i, frame.Offset)
+				}
+				expected := test.frames[i]
+				expected.Offset = frame.Offset
+				if frame != expected {
+					t.Fatalf("frame %d: got %+v, want %+v", i, frame, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestAnalyzeFramesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		err   string
+	}{
+		{
+			name:  "not an AVI file",
+			input: riffList("RIFF", "WAVE"),
+			err:   "input is not an AVI file",
+		},
+		{
+			name:  "invalid header",
+			input: riffList("RIFF", "AVI ", riffList("LIST", "hdrl", riffChunk("avih", make([]byte, 4)))),
+			err:   "AVI main header is too short",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := AnalyzeFramesSync(context.Background(), bytes.NewReader(test.input), nil); err == nil || err.Error() != test.err {
+				t.Fatalf("got error %v, want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestFrameTypeString(t *testing.T) {
+	tests := []struct {
+		frameType FrameType
+		want      string
+	}{
+		{Unknown, "?"},
+		{IFrame, "I"},
+		{PFrame, "P"},
+		{BFrame, "B"},
+		{SFrame, "S"},
+		{NotCodedFrame, "N"},
+		{DroppedFrame, "D"},
+	}
+
+	for _, test := range tests {
+		if got := test.frameType.String(); got != test.want {
+			t.Errorf("got %s for frame type %d, want %s", got, test.frameType, test.want)
+		}
+	}
+}
@@ -0,0 +1,506 @@
+package moshpit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// FourCC is a four-character code identifying a RIFF chunk.
+type FourCC [4]byte
+
+func fourCC(s string) FourCC {
+	var f FourCC
+	copy(f[:], s)
+	return f
+}
+
+func (f FourCC) String() string {
+	return string(f[:])
+}
+
+var (
+	fccRIFF = fourCC("RIFF")
+	fccLIST = fourCC("LIST")
+	fccAVI  = fourCC("AVI ")
+	fccAVIX = fourCC("AVIX")
+	fccJUNK = fourCC("JUNK")
+	fccHdrl = fourCC("hdrl")
+	fccAvih = fourCC("avih")
+	fccStrl = fourCC("strl")
+	fccStrh = fourCC("strh")
+	fccStrf = fourCC("strf")
+	fccOdml = fourCC("odml")
+	fccDmlh = fourCC("dmlh")
+	fccVids = fourCC("vids")
+	fccMovi = fourCC("movi")
+	fccRec  = fourCC("rec ")
+	fccIdx1 = fourCC("idx1")
+	fccIndx = fourCC("indx")
+)
+
+// Chunk is a single chunk read from a RIFF file.
+type Chunk struct {
+	// ID is the FourCC identifying the chunk, e.g. "00dc" or "LIST".
+	ID FourCC
+	// ListType is the type of a RIFF or LIST chunk, e.g. "AVI " or "movi".
+	// It is empty for all other chunks.
+	ListType FourCC
+	// Size is the size of the chunk's payload as stored in its header.
+	// For RIFF and LIST chunks, it includes the four bytes of the list type.
+	Size uint32
+	// Offset is the position of the chunk's header in the file.
+	Offset int64
+	// Parent is the list type of the RIFF or LIST chunk containing the chunk.
+	Parent FourCC
+	// Data is the payload of the chunk.
+	// For LIST chunks, it is the payload following the list type.
+	// It is nil for RIFF and LIST chunks whose children
+	// are read as separate chunks.
+	Data []byte
+}
+
+// IsList returns whether the chunk is a RIFF or LIST chunk.
+func (c *Chunk) IsList() bool {
+	return c.ID == fccRIFF || c.ID == fccLIST
+}
+
+// IsVideoFrame returns whether the chunk holds a frame of a video stream.
+func (c *Chunk) IsVideoFrame() bool {
+	if c.Parent != fccMovi && c.Parent != fccRec {
+		return false
+	}
+	if _, ok := c.Stream(); !ok {
+		return false
+	}
+	// compressed (dc) or uncompressed (db) video data
+	return c.ID[2] == 'd' && (c.ID[3] == 'c' || c.ID[3] == 'b')
+}
+
+// Stream returns the index of the stream the chunk belongs to,
+// which is encoded in the first two characters of data chunk IDs.
+func (c *Chunk) Stream() (int, bool) {
+	return streamIndex(c.ID)
+}
+
+func streamIndex(id FourCC) (int, bool) {
+	if id[0] < '0' || id[0] > '9' || id[1] < '0' || id[1] > '9' {
+		return 0, false
+	}
+	return int(id[0]-'0')*10 + int(id[1]-'0'), true
+}
+
+// a RIFF or LIST chunk the AviReader is currently reading the children of
+type openList struct {
+	listType FourCC
+	end      int64
+}
+
+// MaxChunkSize is the default maximum payload size in bytes
+// of chunks read by an AviReader, protecting against
+// corrupted chunk headers exhausting the available memory.
+// It is large enough for uncompressed 8K frames.
+var MaxChunkSize uint32 = 256 * 1024 * 1024
+
+// ChunkTooLargeError is returned by AviReader if the size
+// of a chunk exceeds the reader's maximum chunk size.
+type ChunkTooLargeError struct {
+	ID     FourCC
+	Offset int64
+	Size   uint32
+	Max    uint32
+}
+
+func (e *ChunkTooLargeError) Error() string {
+	return fmt.Sprintf("size of %s chunk at offset %d exceeds the maximum chunk size (%d > %d bytes)",
+		e.ID, e.Offset, e.Size, e.Max)
+}
+
+// AviReader reads the chunks of an AVI file in the order they appear in.
+// RIFF chunks as well as the movi and rec lists are descended into,
+// so each frame is returned as a separate chunk.
+// OpenDML files are read as a sequence of RIFF chunks,
+// with the AVIX extension chunks following the first AVI chunk.
+// All other lists, like the hdrl header list, are returned as a whole.
+type AviReader struct {
+	// MaxChunkSize is the maximum payload size of a chunk in bytes.
+	// If a chunk is larger, Next returns a *ChunkTooLargeError.
+	// A value of 0 disables the limit.
+	MaxChunkSize uint32
+
+	r      io.Reader
+	offset int64
+	lists  []openList
+	buf    []byte
+}
+
+// NewAviReader returns an AviReader reading from the given reader,
+// limiting the size of chunks to MaxChunkSize.
+func NewAviReader(reader io.Reader) *AviReader {
+	return &AviReader{
+		MaxChunkSize: MaxChunkSize,
+		r:            reader,
+	}
+}
+
+// Next returns the next chunk of the AVI file.
+// The chunk's payload is read into a buffer that is reused
+// by the following call to Next, so it must be copied
+// if it is needed for longer.
+// At the end of the file, Next returns io.EOF.
+func (r *AviReader) Next() (*Chunk, error) {
+	// leave all lists whose end has been reached
+	for len(r.lists) > 0 && r.offset >= r.lists[len(r.lists)-1].end {
+		r.lists = r.lists[:len(r.lists)-1]
+	}
+
+	c := &Chunk{Offset: r.offset}
+	if len(r.lists) > 0 {
+		c.Parent = r.lists[len(r.lists)-1].listType
+	}
+
+	var header [8]byte
+	if err := r.read(header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("unexpected end of file in chunk header")
+		}
+		return nil, err
+	}
+	copy(c.ID[:], header[:4])
+	c.Size = binary.LittleEndian.Uint32(header[4:])
+
+	if c.Offset == 0 && c.ID != fccRIFF {
+		return nil, errors.New("input is not a RIFF file")
+	}
+
+	if c.IsList() {
+		if err := r.read(c.ListType[:]); err != nil {
+			return nil, r.unexpectedEOF(c, err)
+		}
+
+		if c.ID == fccRIFF && c.Offset == 0 && c.ListType != fccAVI {
+			return nil, errors.New("input is not an AVI file")
+		}
+
+		if c.ID == fccRIFF || c.ListType == fccMovi || c.ListType == fccRec {
+			// descend into the list, reading its children as separate chunks
+			end := c.Offset + 8 + int64(c.Size)
+			if c.Size == 0 {
+				// writers that can't seek leave the size empty,
+				// assume the list extends to the end of the file
+				end = math.MaxInt64
+			}
+			r.lists = append(r.lists, openList{listType: c.ListType, end: end})
+			return c, nil
+		}
+
+		if c.Size < 4 {
+			return nil, fmt.Errorf("invalid size of %s chunk at offset %d", c.ID, c.Offset)
+		}
+	}
+
+	if r.MaxChunkSize > 0 && c.Size > r.MaxChunkSize {
+		return nil, &ChunkTooLargeError{
+			ID:     c.ID,
+			Offset: c.Offset,
+			Size:   c.Size,
+			Max:    r.MaxChunkSize,
+		}
+	}
+
+	size := int(c.Size)
+	if c.IsList() {
+		// the list type has already been read
+		size -= 4
+	}
+	if cap(r.buf) < size {
+		r.buf = make([]byte, size)
+	}
+	c.Data = r.buf[:size]
+
+	if err := r.read(c.Data); err != nil {
+		return nil, r.unexpectedEOF(c, err)
+	}
+
+	// chunks are aligned to word boundaries
+	if c.Size%2 != 0 {
+		var pad [1]byte
+		if err := r.read(pad[:]); err != nil && err != io.EOF {
+			return nil, r.unexpectedEOF(c, err)
+		}
+	}
+
+	return c, nil
+}
+
+func (r *AviReader) read(buf []byte) error {
+	n, err := io.ReadFull(r.r, buf)
+	r.offset += int64(n)
+	return err
+}
+
+func (r *AviReader) unexpectedEOF(c *Chunk, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("unexpected end of file in %s chunk at offset %d", c.ID, c.Offset)
+	}
+	return err
+}
+
+// writeChunk writes the chunk to the writer.
+// For RIFF and LIST chunks without data, only the
+// chunk header and list type are written.
+func writeChunk(w io.Writer, c *Chunk) error {
+	var header [12]byte
+	copy(header[:4], c.ID[:])
+	binary.LittleEndian.PutUint32(header[4:8], c.Size)
+
+	if c.IsList() {
+		copy(header[8:], c.ListType[:])
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+	} else if _, err := w.Write(header[:8]); err != nil {
+		return err
+	}
+
+	if c.Data == nil {
+		return nil
+	}
+	if _, err := w.Write(c.Data); err != nil {
+		return err
+	}
+	if len(c.Data)%2 != 0 {
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a chunk contained in the payload of a LIST chunk
+type subChunk struct {
+	ID       FourCC
+	ListType FourCC
+	// offset of the payload within the parsed data
+	offset int
+	Data   []byte
+}
+
+// parseSubChunks parses the chunks contained in the given LIST payload.
+// For LIST chunks, the data starts after the list type.
+func parseSubChunks(data []byte) ([]subChunk, error) {
+	var chunks []subChunk
+	for pos := 0; pos+8 <= len(data); {
+		var c subChunk
+		copy(c.ID[:], data[pos:pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		c.offset = pos + 8
+		if c.offset+size > len(data) {
+			return nil, fmt.Errorf("size of %s chunk exceeds its parent list", c.ID)
+		}
+		c.Data = data[c.offset : c.offset+size]
+
+		if c.ID == fccLIST {
+			if size < 4 {
+				return nil, errors.New("invalid size of LIST chunk")
+			}
+			copy(c.ListType[:], c.Data[:4])
+			c.Data = c.Data[4:]
+			c.offset += 4
+		}
+		chunks = append(chunks, c)
+
+		// chunks are aligned to word boundaries
+		pos += 8 + size + size%2
+	}
+	return chunks, nil
+}
+
+// aviHeader holds the values read from the hdrl list of an AVI file.
+type aviHeader struct {
+	// number of frames in the first RIFF chunk
+	totalFrames uint32
+	width       uint32
+	height      uint32
+	streams     []*aviStream
+
+	// number of frames in the whole file
+	// as stored in the OpenDML extended header
+	odmlTotalFrames uint32
+	hasOdml         bool
+
+	// offsets of the frame count values within the hdrl payload
+	totalFramesOffset     int
+	odmlTotalFramesOffset int
+}
+
+// aviStream holds the values read from
+// the strl list of a stream in an AVI file.
+type aviStream struct {
+	fccType    FourCC
+	fccHandler FourCC
+	scale      uint32
+	rate       uint32
+	start      uint32
+	length     uint32
+	format     []byte
+
+	// offset of the length value within the hdrl payload
+	lengthOffset int
+
+	// offset and payload size of the chunk reserved for the
+	// OpenDML super index within the hdrl payload,
+	// and the number of entries it can hold.
+	// The chunk is either an indx chunk or a JUNK chunk
+	// reserving space for it.
+	indexOffset   int
+	indexSize     int
+	indexCapacity int
+}
+
+// parseHeaderList parses the payload of an AVI file's hdrl list.
+func parseHeaderList(data []byte) (*aviHeader, error) {
+	chunks, err := parseSubChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &aviHeader{}
+	for _, c := range chunks {
+		switch {
+		case c.ID == fccAvih:
+			if len(c.Data) < 40 {
+				return nil, errors.New("AVI main header is too short")
+			}
+			h.totalFrames = binary.LittleEndian.Uint32(c.Data[16:])
+			h.totalFramesOffset = c.offset + 16
+			h.width = binary.LittleEndian.Uint32(c.Data[32:])
+			h.height = binary.LittleEndian.Uint32(c.Data[36:])
+
+		case c.ID == fccLIST && c.ListType == fccStrl:
+			s, err := parseStreamList(c.Data, c.offset)
+			if err != nil {
+				return nil, err
+			}
+			h.streams = append(h.streams, s)
+
+		case c.ID == fccLIST && c.ListType == fccOdml:
+			odml, err := parseSubChunks(c.Data)
+			if err != nil {
+				return nil, err
+			}
+			for _, oc := range odml {
+				if oc.ID == fccDmlh && len(oc.Data) >= 4 {
+					h.hasOdml = true
+					h.odmlTotalFrames = binary.LittleEndian.Uint32(oc.Data)
+					h.odmlTotalFramesOffset = c.offset + oc.offset
+				}
+			}
+		}
+	}
+
+	if h.totalFramesOffset == 0 {
+		return nil, errors.New("AVI main header is missing")
+	}
+	return h, nil
+}
+
+// frameCount returns the number of frames in the whole file,
+// or 0 if the header doesn't state it.
+func (h *aviHeader) frameCount() uint64 {
+	if h.hasOdml && h.odmlTotalFrames > 0 {
+		return uint64(h.odmlTotalFrames)
+	}
+	return uint64(h.totalFrames)
+}
+
+// parseStreamList parses the payload of a strl list
+// located at the given offset within the hdrl payload.
+func parseStreamList(data []byte, offset int) (*aviStream, error) {
+	chunks, err := parseSubChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &aviStream{}
+	for _, c := range chunks {
+		switch c.ID {
+		case fccStrh:
+			if len(c.Data) < 48 {
+				return nil, errors.New("AVI stream header is too short")
+			}
+			copy(s.fccType[:], c.Data[0:4])
+			copy(s.fccHandler[:], c.Data[4:8])
+			s.scale = binary.LittleEndian.Uint32(c.Data[20:])
+			s.rate = binary.LittleEndian.Uint32(c.Data[24:])
+			s.start = binary.LittleEndian.Uint32(c.Data[28:])
+			s.length = binary.LittleEndian.Uint32(c.Data[32:])
+			s.lengthOffset = offset + c.offset + 32
+		case fccStrf:
+			s.format = append([]byte(nil), c.Data...)
+		case fccIndx, fccJUNK:
+			if s.indexCapacity == 0 && len(c.Data) >= 24+16 {
+				s.indexOffset = offset + c.offset - 8
+				s.indexSize = len(c.Data)
+				s.indexCapacity = (len(c.Data) - 24) / 16
+			}
+		}
+	}
+
+	if s.lengthOffset == 0 {
+		return nil, errors.New("AVI stream header is missing")
+	}
+	return s, nil
+}
+
+// size of the BITMAPINFOHEADER structure
+// at the start of video stream formats
+const bitmapInfoHeaderSize = 40
+
+// videoStream returns the first video stream,
+// or nil if the file has no video stream.
+func (h *aviHeader) videoStream() *aviStream {
+	for _, s := range h.streams {
+		if s.fccType == fccVids {
+			return s
+		}
+	}
+	return nil
+}
+
+// vopParsers returns a vopParser for each video stream,
+// initialized with the codec headers from the stream format.
+func (h *aviHeader) vopParsers() map[int]*vopParser {
+	parsers := make(map[int]*vopParser)
+	for i, s := range h.streams {
+		if s.fccType != fccVids {
+			continue
+		}
+		p := &vopParser{}
+		if len(s.format) > bitmapInfoHeaderSize {
+			p.ParseHeaders(s.format[bitmapInfoHeaderSize:])
+		}
+		parsers[i] = p
+	}
+	return parsers
+}
+
+// timestamp returns the presentation timestamp of the frame
+// with the given index in the stream, derived from the
+// stream's rate and scale.
+func (h *aviHeader) timestamp(stream int, index uint64) time.Duration {
+	if stream >= len(h.streams) {
+		return 0
+	}
+	s := h.streams[stream]
+	if s.rate == 0 {
+		return 0
+	}
+	// the rate divided by the scale is the
+	// number of frames per second
+	frames := float64(uint64(s.start) + index)
+	return time.Duration(frames * float64(s.scale) / float64(s.rate) * float64(time.Second))
+}
@@ -0,0 +1,261 @@
+package moshpit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// riffChunk returns the bytes of a chunk with the given payload,
+// padded to a word boundary.
+func riffChunk(id string, data []byte) []byte {
+	b := make([]byte, 8, 8+len(data)+1)
+	copy(b, id)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// riffList returns the bytes of a RIFF or LIST chunk
+// containing the given chunks.
+func riffList(id string, listType string, chunks ...[]byte) []byte {
+	data := []byte(listType)
+	for _, c := range chunks {
+		data = append(data, c...)
+	}
+	return riffChunk(id, data)
+}
+
+// expectedChunk is a chunk expected to be returned by an AviReader.
+type expectedChunk struct {
+	id       string
+	listType string
+	parent   string
+}
+
+func TestAviReader(t *testing.T) {
+	hdrl := riffList("LIST", "hdrl", riffChunk("avih", make([]byte, 56)))
+	tests := []struct {
+		name   string
+		input  []byte
+		chunks []expectedChunk
+	}{
+		{
+			name: "frames",
+			input: riffList("RIFF", "AVI ",
+				hdrl,
+				riffList("LIST", "movi",
+					riffChunk("00dc", []byte{1, 2, 3}),
+					riffChunk("00dc", nil),
+					riffChunk("01wb", []byte{4, 5, 6, 7}),
+				),
+				riffChunk("idx1", make([]byte, 48)),
+			),
+			chunks: []expectedChunk{
+				{"RIFF", "AVI ", ""},
+				{"LIST", "hdrl", "AVI "},
+				{"LIST", "movi", "AVI "},
+				{"00dc", "", "movi"},
+				{"00dc", "", "movi"},
+				{"01wb", "", "movi"},
+				{"idx1", "", "AVI "},
+			},
+		},
+		{
+			name: "rec lists",
+			input: riffList("RIFF", "AVI ",
+				hdrl,
+				riffList("LIST", "movi",
+					riffList("LIST", "rec ",
+						riffChunk("00dc", []byte{1}),
+						riffChunk("01wb", []byte{2}),
+					),
+					riffChunk("00dc", []byte{3}),
+				),
+			),
+			chunks: []expectedChunk{
+				{"RIFF", "AVI ", ""},
+				{"LIST", "hdrl", "AVI "},
+				{"LIST", "movi", "AVI "},
+				{"LIST", "rec ", "movi"},
+				{"00dc", "", "rec "},
+				{"01wb", "", "rec "},
+				{"00dc", "", "movi"},
+			},
+		},
+		{
+			name: "OpenDML extension chunks",
+			input: append(
+				riffList("RIFF", "AVI ",
+					hdrl,
+					riffList("LIST", "movi", riffChunk("00dc", []byte{1})),
+				),
+				riffList("RIFF", "AVIX",
+					riffList("LIST", "movi",
+						riffChunk("00dc", []byte{2}),
+						riffChunk("ix00", make([]byte, 32)),
+					),
+				)...,
+			),
+			chunks: []expectedChunk{
+				{"RIFF", "AVI ", ""},
+				{"LIST", "hdrl", "AVI "},
+				{"LIST", "movi", "AVI "},
+				{"00dc", "", "movi"},
+				{"RIFF", "AVIX", ""},
+				{"LIST", "movi", "AVIX"},
+				{"00dc", "", "movi"},
+				{"ix00", "", "movi"},
+			},
+		},
+		{
+			name: "unknown RIFF size",
+			input: func() []byte {
+				b := riffList("RIFF", "AVI ", hdrl, riffList("LIST", "movi", riffChunk("00dc", []byte{1})))
+				binary.LittleEndian.PutUint32(b[4:], 0)
+				return b
+			}(),
+			chunks: []expectedChunk{
+				{"RIFF", "AVI ", ""},
+				{"LIST", "hdrl", "AVI "},
+				{"LIST", "movi", "AVI "},
+				{"00dc", "", "movi"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewAviReader(bytes.NewReader(test.input))
+			for i, expected := range test.chunks {
+				c, err := r.Next()
+				if err != nil {
+					t.Fatalf("chunk %d: %v", i, err)
+				}
+				if c.ID != fourCC(expected.id) || c.Parent != fourCC(expected.parent) ||
+					(expected.listType != "" && c.ListType != fourCC(expected.listType)) {
+					t.Fatalf("chunk %d: got %s %s in %s, want %s %s in %s", i,
+						c.ID, c.ListType, c.Parent, expected.id, expected.listType, expected.parent)
+				}
+
+				// the offset and size must match the chunk's position in the input
+				header := test.input[c.Offset:]
+				if !bytes.Equal(header[:4], c.ID[:]) || binary.LittleEndian.Uint32(header[4:]) != c.Size {
+					t.Fatalf("chunk %d: offset %d doesn't point to the chunk header", i, c.Offset)
+				}
+				if c.Data != nil {
+					start := 8
+					if c.IsList() {
+						start += 4
+					}
+					if !bytes.Equal(c.Data, header[start:start+len(c.Data)]) {
+						t.Fatalf("chunk %d: data doesn't match the input", i)
+					}
+				}
+			}
+			if c, err := r.Next(); err != io.EOF {
+				t.Fatalf("got chunk %v and error %v after the last chunk, want io.EOF", c, err)
+			}
+		})
+	}
+}
+
+func TestAviReaderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		err   string
+	}{
+		{
+			name:  "not a RIFF file",
+			input: riffChunk("JUNK", make([]byte, 4)),
+			err:   "input is not a RIFF file",
+		},
+		{
+			name:  "not an AVI file",
+			input: riffList("RIFF", "WAVE", riffChunk("fmt ", make([]byte, 16))),
+			err:   "input is not an AVI file",
+		},
+		{
+			name:  "truncated chunk header",
+			input: append(riffList("RIFF", "AVI "), "00d"...),
+			err:   "unexpected end of file in chunk header",
+		},
+		{
+			name:  "truncated chunk",
+			input: riffList("RIFF", "AVI ", riffChunk("00dc", make([]byte, 16))[:20]),
+			err:   "unexpected end of file in 00dc chunk at offset 12",
+		},
+		{
+			name:  "truncated list type",
+			input: riffList("RIFF", "AVI ", []byte("LIST\x04\x00\x00\x00hd")),
+			err:   "unexpected end of file in LIST chunk at offset 12",
+		},
+		{
+			name:  "invalid list size",
+			input: riffList("RIFF", "AVI ", []byte("LIST\x02\x00\x00\x00hdrl")),
+			err:   "invalid size of LIST chunk at offset 12",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := readAllChunks(NewAviReader(bytes.NewReader(test.input)))
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("got error %v, want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestAviReaderMaxChunkSize(t *testing.T) {
+	input := riffList("RIFF", "AVI ",
+		riffChunk("00dc", make([]byte, 16)),
+		riffChunk("00dc", make([]byte, 17)),
+	)
+	tests := []struct {
+		name string
+		max  uint32
+		err  *ChunkTooLargeError
+	}{
+		{name: "no limit", max: 0},
+		{name: "chunks within limit", max: 17},
+		{name: "chunk exceeding limit", max: 16, err: &ChunkTooLargeError{ID: fourCC("00dc"), Offset: 36, Size: 17, Max: 16}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewAviReader(bytes.NewReader(input))
+			r.MaxChunkSize = test.max
+			err := readAllChunks(r)
+
+			var tooLarge *ChunkTooLargeError
+			switch {
+			case test.err == nil && err != nil:
+				t.Fatalf("got error %v, want none", err)
+			case test.err != nil && !errors.As(err, &tooLarge):
+				t.Fatalf("got error %v, want a *ChunkTooLargeError", err)
+			case test.err != nil && *tooLarge != *test.err:
+				t.Fatalf("got %+v, want %+v", *tooLarge, *test.err)
+			}
+		})
+	}
+}
+
+// readAllChunks reads all chunks from the reader,
+// returning nil once the end of the file is reached.
+func readAllChunks(r *AviReader) error {
+	for {
+		if _, err := r.Next(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
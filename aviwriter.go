@@ -0,0 +1,446 @@
+package moshpit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// AVI index flag marking keyframes
+const aviIndexKeyframe = 0x10
+
+// flag of OpenDML standard index entries marking non-keyframes
+const odmlIndexDeltaFrame = 0x80000000
+
+// the size after which a new RIFF chunk is started in OpenDML files.
+// Many players expect RIFF chunks to be smaller than 1GB,
+// so this is the same limit ffmpeg uses.
+var maxOdmlRiffSize int64 = 1024 * 1024 * 1024
+
+// an entry of the idx1 and OpenDML standard indices
+type aviIndexEntry struct {
+	id    FourCC
+	flags uint32
+	// offset of the chunk header relative to the movi list type
+	offset uint32
+	size   uint32
+}
+
+// an entry of the OpenDML super index of a stream
+type odmlSuperIndexEntry struct {
+	// absolute offset and size of the standard index chunk
+	offset int64
+	size   uint32
+	// the number of chunks indexed by the standard index
+	duration uint32
+}
+
+// aviWriter writes the chunks read by an AviReader to a file,
+// rebuilding the idx1 index and updating the chunk sizes
+// and frame counts in the file header to match the written data.
+//
+// If the header reserves space for OpenDML super indices,
+// the data is split into multiple RIFF chunks once it grows
+// larger than 1GB, writing an OpenDML standard index for
+// each of them.
+type aviWriter struct {
+	w      io.WriteSeeker
+	offset int64
+
+	// offsets of the currently open RIFF and movi lists,
+	// or -1 if there is none
+	riffOffset int64
+	moviOffset int64
+	// whether a movi list has been written
+	moviStarted bool
+
+	// the header of the file and the offset of the hdrl payload
+	header       *aviHeader
+	headerOffset int64
+	// parsers determining the frame types of the video streams
+	parsers map[int]*vopParser
+
+	// the number of RIFF chunks written
+	riffs int
+	// the index entries of the current movi list
+	index []aviIndexEntry
+	// the OpenDML super index entries per stream
+	superIndex map[int][]odmlSuperIndexEntry
+
+	// the number of data chunks written per stream,
+	// in total and in the first RIFF chunk
+	chunks          map[int]uint32
+	firstRiffChunks map[int]uint32
+}
+
+func newAviWriter(w io.WriteSeeker) *aviWriter {
+	return &aviWriter{
+		w:          w,
+		riffOffset: -1,
+		moviOffset: -1,
+		superIndex: make(map[int][]odmlSuperIndexEntry),
+		chunks:     make(map[int]uint32),
+	}
+}
+
+// WriteChunk writes a chunk read by an AviReader.
+// The data chunks of all movi lists in the input are written
+// to the output's movi lists, which are split into RIFF chunks
+// independently of the input.
+// Existing indices are discarded, as they are rebuilt
+// from the data chunks written.
+func (w *aviWriter) WriteChunk(c *Chunk) error {
+	switch {
+	case c.Parent == fccMovi || c.Parent == fccRec:
+		if _, ok := c.Stream(); !ok {
+			// rec lists are flattened, and JUNK
+			// and index chunks are discarded
+			return nil
+		}
+		return w.writeData(c)
+
+	case w.moviStarted:
+		// all chunks outside of the movi lists following the
+		// first one are indices, padding or the headers of
+		// OpenDML extension chunks, which are rebuilt
+		return nil
+
+	case c.ID == fccRIFF:
+		w.riffOffset = w.offset
+		w.riffs++
+		return w.write(c)
+
+	case c.ID == fccLIST && c.ListType == fccHdrl:
+		header, err := parseHeaderList(c.Data)
+		if err != nil {
+			return err
+		}
+		w.header = header
+		w.headerOffset = w.offset + 12
+		w.parsers = header.vopParsers()
+		return w.write(c)
+
+	case c.ID == fccLIST && c.ListType == fccMovi:
+		w.moviOffset = w.offset
+		w.moviStarted = true
+		return w.write(c)
+
+	default:
+		return w.write(c)
+	}
+}
+
+// writeData writes a data chunk to the movi list, adding it to the index.
+func (w *aviWriter) writeData(c *Chunk) error {
+	if w.moviOffset < 0 {
+		return errors.New("AVI data chunk outside of movi list")
+	}
+
+	if w.isOdml() && w.offset-w.riffOffset > maxOdmlRiffSize {
+		if err := w.startExtensionRiff(); err != nil {
+			return err
+		}
+	}
+
+	stream, _ := c.Stream()
+
+	var flags uint32
+	if w.isVideo(stream) {
+		if w.parsers[stream].FrameType(c.Data) == IFrame {
+			flags = aviIndexKeyframe
+		}
+	} else if len(c.Data) > 0 {
+		flags = aviIndexKeyframe
+	}
+
+	w.index = append(w.index, aviIndexEntry{
+		id:     c.ID,
+		flags:  flags,
+		offset: uint32(w.offset - w.moviOffset - 8),
+		size:   uint32(len(c.Data)),
+	})
+	w.chunks[stream]++
+
+	return w.write(c)
+}
+
+// startExtensionRiff closes the open RIFF chunk
+// and starts an OpenDML AVIX chunk with a movi list.
+func (w *aviWriter) startExtensionRiff() error {
+	if err := w.endRiff(); err != nil {
+		return err
+	}
+
+	w.riffOffset = w.offset
+	w.riffs++
+	if err := w.write(&Chunk{ID: fccRIFF, ListType: fccAVIX}); err != nil {
+		return err
+	}
+
+	w.moviOffset = w.offset
+	return w.write(&Chunk{ID: fccLIST, ListType: fccMovi})
+}
+
+// Close finishes writing the file, updating the
+// frame counts and indices in the header to the written values.
+func (w *aviWriter) Close() error {
+	if err := w.endRiff(); err != nil {
+		return err
+	}
+	if w.header == nil {
+		return errors.New("AVI header is missing")
+	}
+
+	// the main header only counts the frames in the first
+	// RIFF chunk, while the OpenDML header counts all frames
+	var frames, firstRiffFrames uint32
+	for i, s := range w.header.streams {
+		if s.fccType != fccVids {
+			continue
+		}
+		if w.chunks[i] > frames {
+			frames = w.chunks[i]
+		}
+		if w.firstRiffChunks[i] > firstRiffFrames {
+			firstRiffFrames = w.firstRiffChunks[i]
+		}
+		if err := w.patch(w.headerOffset+int64(s.lengthOffset), w.chunks[i]); err != nil {
+			return err
+		}
+	}
+
+	if err := w.patch(w.headerOffset+int64(w.header.totalFramesOffset), firstRiffFrames); err != nil {
+		return err
+	}
+	if w.header.hasOdml {
+		if err := w.patch(w.headerOffset+int64(w.header.odmlTotalFramesOffset), frames); err != nil {
+			return err
+		}
+	}
+
+	return w.writeSuperIndices()
+}
+
+// writeSuperIndices writes the OpenDML super index of each stream
+// into the space reserved for it in the header.
+func (w *aviWriter) writeSuperIndices() error {
+	for i, s := range w.header.streams {
+		if s.indexCapacity == 0 {
+			continue
+		}
+		offset := w.headerOffset + int64(s.indexOffset)
+
+		if w.riffs < 2 {
+			// files with a single RIFF chunk are indexed by idx1 only,
+			// so the reserved space is marked as unused
+			if _, err := w.w.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := w.w.Write(fccJUNK[:]); err != nil {
+				return err
+			}
+			continue
+		}
+
+		entries := w.superIndex[i]
+		id := w.streamChunkID(i)
+		data := make([]byte, s.indexSize)
+		// the super index consists of entries of 4 32-bit values,
+		// indexing chunks of type AVI_INDEX_OF_INDEXES
+		binary.LittleEndian.PutUint16(data[0:], 4)
+		binary.LittleEndian.PutUint32(data[4:], uint32(len(entries)))
+		copy(data[8:12], id[:])
+		for j, e := range entries {
+			entry := data[24+16*j:]
+			binary.LittleEndian.PutUint64(entry[0:], uint64(e.offset))
+			binary.LittleEndian.PutUint32(entry[8:], e.size)
+			binary.LittleEndian.PutUint32(entry[12:], e.duration)
+		}
+
+		if _, err := w.w.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if err := writeChunk(w.w, &Chunk{ID: fccIndx, Size: uint32(len(data)), Data: data}); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.w.Seek(w.offset, io.SeekStart)
+	return err
+}
+
+// endMovi closes the open movi list.
+// If the file is split into multiple RIFF chunks, a standard index
+// is written for each stream at the end of the movi list.
+// The idx1 index is written after the movi list of the first RIFF chunk.
+func (w *aviWriter) endMovi() error {
+	if w.moviOffset < 0 {
+		return nil
+	}
+
+	if w.isOdml() && (w.riffs > 1 || w.offset-w.riffOffset > maxOdmlRiffSize) {
+		for i := range w.header.streams {
+			if err := w.writeStandardIndex(i); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := w.endList(w.moviOffset); err != nil {
+		return err
+	}
+	w.moviOffset = -1
+
+	if w.riffs > 1 {
+		w.index = nil
+		return nil
+	}
+
+	data := make([]byte, 16*len(w.index))
+	for i, e := range w.index {
+		entry := data[16*i:]
+		copy(entry[0:4], e.id[:])
+		binary.LittleEndian.PutUint32(entry[4:], e.flags)
+		binary.LittleEndian.PutUint32(entry[8:], e.offset)
+		binary.LittleEndian.PutUint32(entry[12:], e.size)
+	}
+	w.index = nil
+
+	return w.write(&Chunk{ID: fccIdx1, Size: uint32(len(data)), Data: data})
+}
+
+// writeStandardIndex writes an OpenDML standard index
+// of the stream's chunks in the current movi list,
+// adding it to the stream's super index.
+func (w *aviWriter) writeStandardIndex(stream int) error {
+	id := w.streamChunkID(stream)
+
+	var entries []aviIndexEntry
+	for _, e := range w.index {
+		if s, _ := streamIndex(e.id); s == stream {
+			entries = append(entries, e)
+		}
+	}
+
+	if len(w.superIndex[stream]) >= w.header.streams[stream].indexCapacity {
+		return errors.New("AVI file exceeds the number of RIFF chunks the OpenDML index can hold")
+	}
+
+	data := make([]byte, 24+8*len(entries))
+	// the standard index consists of entries of 2 32-bit values,
+	// indexing chunks of type AVI_INDEX_OF_CHUNKS
+	binary.LittleEndian.PutUint16(data[0:], 2)
+	data[3] = 1
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(entries)))
+	copy(data[8:12], id[:])
+	// the offsets are relative to the movi list type
+	binary.LittleEndian.PutUint64(data[12:], uint64(w.moviOffset+8))
+	for i, e := range entries {
+		entry := data[24+8*i:]
+		// the offset points to the chunk's payload
+		binary.LittleEndian.PutUint32(entry[0:], e.offset+8)
+		size := e.size
+		if e.flags&aviIndexKeyframe == 0 {
+			size |= odmlIndexDeltaFrame
+		}
+		binary.LittleEndian.PutUint32(entry[4:], size)
+	}
+
+	w.superIndex[stream] = append(w.superIndex[stream], odmlSuperIndexEntry{
+		offset:   w.offset,
+		size:     uint32(8 + len(data)),
+		duration: uint32(len(entries)),
+	})
+
+	ix := &Chunk{ID: FourCC{'i', 'x', id[0], id[1]}, Size: uint32(len(data)), Data: data}
+	return w.write(ix)
+}
+
+// endRiff closes the open RIFF chunk.
+func (w *aviWriter) endRiff() error {
+	if err := w.endMovi(); err != nil {
+		return err
+	}
+	if w.riffOffset < 0 {
+		return nil
+	}
+	if err := w.endList(w.riffOffset); err != nil {
+		return err
+	}
+	w.riffOffset = -1
+
+	if w.riffs == 1 {
+		w.firstRiffChunks = make(map[int]uint32)
+		for stream, count := range w.chunks {
+			w.firstRiffChunks[stream] = count
+		}
+	}
+	return nil
+}
+
+// endList updates the size of the list at the given
+// offset to include all data written after it.
+func (w *aviWriter) endList(offset int64) error {
+	size := w.offset - offset - 8
+	if size > math.MaxUint32 {
+		return errors.New("AVI file exceeds the maximum RIFF chunk size")
+	}
+	return w.patch(offset+4, uint32(size))
+}
+
+// isOdml returns whether the header reserves space for
+// the OpenDML super indices of all streams,
+// allowing the file to be split into multiple RIFF chunks.
+func (w *aviWriter) isOdml() bool {
+	if w.header == nil || len(w.header.streams) == 0 {
+		return false
+	}
+	for _, s := range w.header.streams {
+		if s.indexCapacity == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *aviWriter) isVideo(stream int) bool {
+	return w.header != nil && stream < len(w.header.streams) &&
+		w.header.streams[stream].fccType == fccVids
+}
+
+// streamChunkID returns the ID of the data chunks of the stream.
+func (w *aviWriter) streamChunkID(stream int) FourCC {
+	suffix := "wb"
+	if w.isVideo(stream) {
+		suffix = "dc"
+	}
+	return fourCC(fmt.Sprintf("%02d%s", stream, suffix))
+}
+
+func (w *aviWriter) write(c *Chunk) error {
+	size := 8 + len(c.Data) + len(c.Data)%2
+	if c.IsList() {
+		size += 4
+	}
+	if err := writeChunk(w.w, c); err != nil {
+		return err
+	}
+	w.offset += int64(size)
+	return nil
+}
+
+// patch overwrites the 32-bit value at the given offset.
+func (w *aviWriter) patch(offset int64, value uint32) error {
+	if _, err := w.w.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], value)
+	if _, err := w.w.Write(buf[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Seek(w.offset, io.SeekStart)
+	return err
+}
@@ -0,0 +1,457 @@
+package moshpit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// seekBuffer is an in-memory io.WriteSeeker.
+type seekBuffer struct {
+	data []byte
+	pos  int
+}
+
+func (b *seekBuffer) Write(p []byte) (int, error) {
+	if end := b.pos + len(p); end > len(b.data) {
+		b.data = append(b.data, make([]byte, end-len(b.data))...)
+	}
+	b.pos += copy(b.data[b.pos:], p)
+	return len(p), nil
+}
+
+func (b *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += int64(b.pos)
+	case io.SeekEnd:
+		offset += int64(len(b.data))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	b.pos = int(offset)
+	return offset, nil
+}
+
+// testVOP returns an MPEG-4 frame of the given size
+// consisting of a VOP header of the given coding type.
+func testVOP(codingType byte, size int) []byte {
+	frame := bytes.Repeat([]byte{0xff}, size)
+	copy(frame, []byte{0, 0, 1, mpeg4VOPStartCode, codingType << 6})
+	return frame
+}
+
+// testAviFile returns an AVI file with a single video stream
+// and the given chunks in its movi list, whose header reserves space for
+// an OpenDML super index with the given number of entries.
+// The frame counts in the header and the idx1 index are invalid,
+// as they are expected to be rebuilt by the aviWriter.
+func testAviFile(movi [][]byte, indexCapacity int) []byte {
+	avih := make([]byte, 56)
+	binary.LittleEndian.PutUint32(avih[16:], 99)
+
+	strh := make([]byte, 56)
+	copy(strh, "vidsFMP4")
+	binary.LittleEndian.PutUint32(strh[20:], 1)
+	binary.LittleEndian.PutUint32(strh[24:], 25)
+	binary.LittleEndian.PutUint32(strh[32:], 99)
+
+	strf := make([]byte, bitmapInfoHeaderSize)
+	binary.LittleEndian.PutUint32(strf, bitmapInfoHeaderSize)
+	copy(strf[16:], "FMP4")
+
+	strl := [][]byte{riffChunk("strh", strh), riffChunk("strf", strf)}
+	hdrl := [][]byte{riffChunk("avih", avih)}
+	if indexCapacity > 0 {
+		strl = append(strl, riffChunk("JUNK", make([]byte, 24+16*indexCapacity)))
+		dmlh := make([]byte, 248)
+		binary.LittleEndian.PutUint32(dmlh, 99)
+		hdrl = append(hdrl, riffList("LIST", "strl", strl...), riffList("LIST", "odml", riffChunk("dmlh", dmlh)))
+	} else {
+		hdrl = append(hdrl, riffList("LIST", "strl", strl...))
+	}
+
+	return riffList("RIFF", "AVI ",
+		riffList("LIST", "hdrl", hdrl...),
+		riffChunk("JUNK", make([]byte, 5)),
+		riffList("LIST", "movi", movi...),
+		riffChunk("idx1", make([]byte, 16)),
+	)
+}
+
+// frameChunks returns the chunks of the frames of the video stream.
+func frameChunks(frames ...[]byte) [][]byte {
+	chunks := make([][]byte, len(frames))
+	for i, frame := range frames {
+		chunks[i] = riffChunk("00dc", frame)
+	}
+	return chunks
+}
+
+// rewriteAvi writes all chunks of the AVI file using an aviWriter.
+func rewriteAvi(input []byte) ([]byte, error) {
+	r := NewAviReader(bytes.NewReader(input))
+	out := &seekBuffer{}
+	w := newAviWriter(out)
+	for {
+		c, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := w.WriteChunk(c); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.data, nil
+}
+
+// writtenAvi holds the chunks of an AVI file written by an aviWriter.
+type writtenAvi struct {
+	header *aviHeader
+	// the offset of the hdrl payload
+	headerOffset int64
+	// the offsets of the RIFF chunks and movi lists
+	riffs []int64
+	movis []int64
+	// the frame chunks in the order they are written,
+	// and the index of the movi list containing each of them
+	frames     []*Chunk
+	frameMovis []int
+	idx1       []byte
+	// the OpenDML standard indices of the video stream
+	standardIndices []*Chunk
+}
+
+// readWrittenAvi reads the AVI file, verifying that
+// the sizes of the RIFF and movi lists match their contents.
+func readWrittenAvi(t *testing.T, data []byte) *writtenAvi {
+	t.Helper()
+	a := &writtenAvi{}
+	r := NewAviReader(bytes.NewReader(data))
+
+	// the end of the open RIFF and movi lists
+	var riffEnd, moviEnd int64 = -1, -1
+	checkEnd := func(end *int64, offset int64) {
+		if *end >= 0 && *end != offset {
+			t.Fatalf("list ends at offset %d, but its contents end at %d", *end, offset)
+		}
+		*end = -1
+	}
+
+	for {
+		c, err := r.Next()
+		if err == io.EOF {
+			checkEnd(&moviEnd, int64(len(data)))
+			checkEnd(&riffEnd, int64(len(data)))
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading written file: %v", err)
+		}
+		if c.Parent != fccMovi {
+			checkEnd(&moviEnd, c.Offset)
+		}
+		if c.ID == fccRIFF {
+			checkEnd(&riffEnd, c.Offset)
+		}
+		data := append([]byte(nil), c.Data...)
+
+		switch {
+		case c.ID == fccRIFF:
+			a.riffs = append(a.riffs, c.Offset)
+			riffEnd = c.Offset + 8 + int64(c.Size)
+		case c.ID == fccLIST && c.ListType == fccHdrl:
+			if a.header, err = parseHeaderList(data); err != nil {
+				t.Fatalf("parsing written header: %v", err)
+			}
+			a.headerOffset = c.Offset + 12
+		case c.ID == fccLIST && c.ListType == fccMovi:
+			a.movis = append(a.movis, c.Offset)
+			moviEnd = c.Offset + 8 + int64(c.Size)
+		case c.IsVideoFrame():
+			frame := *c
+			frame.Data = data
+			a.frames = append(a.frames, &frame)
+			a.frameMovis = append(a.frameMovis, len(a.movis)-1)
+		case c.ID == fccIdx1:
+			a.idx1 = data
+		case c.ID == fourCC("ix00"):
+			index := *c
+			index.Data = data
+			a.standardIndices = append(a.standardIndices, &index)
+		}
+	}
+
+	if a.header == nil {
+		t.Fatal("written file has no header")
+	}
+	return a
+}
+
+func TestAviWriter(t *testing.T) {
+	iVOP, pVOP, bVOP := testVOP(vopCodingTypeI, 10), testVOP(vopCodingTypeP, 7), testVOP(vopCodingTypeB, 8)
+	tests := []struct {
+		name   string
+		movi   [][]byte
+		frames [][]byte
+	}{
+		{
+			name:   "frames",
+			movi:   frameChunks(iVOP, pVOP, pVOP),
+			frames: [][]byte{iVOP, pVOP, pVOP},
+		},
+		{
+			name:   "dropped frames",
+			movi:   frameChunks(iVOP, []byte{}, bVOP, iVOP),
+			frames: [][]byte{iVOP, {}, bVOP, iVOP},
+		},
+		{
+			name:   "no frames",
+			movi:   nil,
+			frames: nil,
+		},
+		{
+			name: "rec lists and index chunks",
+			movi: [][]byte{
+				riffList("LIST", "rec ", riffChunk("00dc", iVOP), riffChunk("00dc", pVOP)),
+				riffChunk("JUNK", make([]byte, 3)),
+				riffChunk("ix00", make([]byte, 32)),
+				riffChunk("00dc", bVOP),
+			},
+			frames: [][]byte{iVOP, pVOP, bVOP},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output, err := rewriteAvi(testAviFile(test.movi, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := readWrittenAvi(t, output)
+
+			if len(a.riffs) != 1 {
+				t.Fatalf("got %d RIFF chunks, want 1", len(a.riffs))
+			}
+			if len(a.frames) != len(test.frames) {
+				t.Fatalf("got %d frames, want %d", len(a.frames), len(test.frames))
+			}
+			if a.header.totalFrames != uint32(len(test.frames)) || a.header.streams[0].length != uint32(len(test.frames)) {
+				t.Fatalf("got %d frames in main header and %d in stream header, want %d",
+					a.header.totalFrames, a.header.streams[0].length, len(test.frames))
+			}
+
+			// the idx1 index must point to the written frames
+			if len(a.idx1) != 16*len(test.frames) {
+				t.Fatalf("got %d idx1 entries, want %d", len(a.idx1)/16, len(test.frames))
+			}
+			for i, frame := range a.frames {
+				entry := a.idx1[16*i:]
+				offset := a.movis[0] + 8 + int64(binary.LittleEndian.Uint32(entry[8:]))
+				flags := binary.LittleEndian.Uint32(entry[4:])
+				size := binary.LittleEndian.Uint32(entry[12:])
+				if !bytes.Equal(entry[:4], frame.ID[:]) || offset != frame.Offset || size != frame.Size {
+					t.Fatalf("idx1 entry %d points to %s chunk of size %d at offset %d, want offset %d and size %d",
+						i, entry[:4], size, offset, frame.Offset, frame.Size)
+				}
+				keyframe := len(frame.Data) > 4 && frame.Data[4]>>6 == vopCodingTypeI
+				if (flags&aviIndexKeyframe != 0) != keyframe {
+					t.Fatalf("idx1 entry %d has flags %#x, keyframe is %v", i, flags, keyframe)
+				}
+				if !bytes.Equal(frame.Data, test.frames[i]) {
+					t.Fatalf("frame %d doesn't match the written frame", i)
+				}
+			}
+		})
+	}
+}
+
+func TestAviWriterOpenDML(t *testing.T) {
+	tests := []struct {
+		name          string
+		frames        int
+		indexCapacity int
+		maxRiffSize   int64
+		riffs         int
+		err           string
+	}{
+		{
+			name:          "single RIFF chunk",
+			frames:        10,
+			indexCapacity: 4,
+			maxRiffSize:   maxOdmlRiffSize,
+			riffs:         1,
+		},
+		{
+			name:          "AVIX chunks",
+			frames:        20,
+			indexCapacity: 4,
+			maxRiffSize:   1000,
+			riffs:         3,
+		},
+		{
+			name:          "full super index",
+			frames:        20,
+			indexCapacity: 3,
+			maxRiffSize:   1000,
+			riffs:         3,
+		},
+		{
+			name:          "no OpenDML header",
+			frames:        20,
+			indexCapacity: 0,
+			maxRiffSize:   1000,
+			riffs:         1,
+		},
+		{
+			name:          "super index too small",
+			frames:        20,
+			indexCapacity: 2,
+			maxRiffSize:   1000,
+			err:           "AVI file exceeds the number of RIFF chunks the OpenDML index can hold",
+		},
+	}
+
+	defer func(max int64) { maxOdmlRiffSize = max }(maxOdmlRiffSize)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			maxOdmlRiffSize = test.maxRiffSize
+
+			var frames [][]byte
+			for i := 0; i < test.frames; i++ {
+				codingType := byte(vopCodingTypeP)
+				if i%3 == 0 {
+					codingType = vopCodingTypeI
+				}
+				frames = append(frames, testVOP(codingType, 100+i))
+			}
+
+			output, err := rewriteAvi(testAviFile(frameChunks(frames...), test.indexCapacity))
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := readWrittenAvi(t, output)
+
+			if len(a.riffs) != test.riffs || len(a.movis) != test.riffs {
+				t.Fatalf("got %d RIFF chunks and %d movi lists, want %d", len(a.riffs), len(a.movis), test.riffs)
+			}
+			for i, offset := range a.riffs {
+				listType := fccAVIX
+				if i == 0 {
+					listType = fccAVI
+				}
+				if !bytes.Equal(output[offset+8:offset+12], listType[:]) {
+					t.Fatalf("RIFF chunk %d has type %s, want %s", i, output[offset+8:offset+12], listType)
+				}
+			}
+			if len(a.frames) != test.frames {
+				t.Fatalf("got %d frames, want %d", len(a.frames), test.frames)
+			}
+
+			// the main header and idx1 only include the frames of the first RIFF chunk
+			var firstRiffFrames int
+			for _, movi := range a.frameMovis {
+				if movi == 0 {
+					firstRiffFrames++
+				}
+			}
+			if a.header.totalFrames != uint32(firstRiffFrames) || len(a.idx1) != 16*firstRiffFrames {
+				t.Fatalf("got %d frames in main header and %d idx1 entries, want %d",
+					a.header.totalFrames, len(a.idx1)/16, firstRiffFrames)
+			}
+			if a.header.streams[0].length != uint32(test.frames) {
+				t.Fatalf("got %d frames in stream header, want %d", a.header.streams[0].length, test.frames)
+			}
+			if test.indexCapacity > 0 && a.header.odmlTotalFrames != uint32(test.frames) {
+				t.Fatalf("got %d frames in OpenDML header, want %d", a.header.odmlTotalFrames, test.frames)
+			}
+
+			if test.riffs == 1 {
+				// the space reserved for the super index is unused
+				if len(a.standardIndices) > 0 {
+					t.Fatalf("got %d standard indices, want none", len(a.standardIndices))
+				}
+				if s := a.header.streams[0]; s.indexCapacity > 0 {
+					offset := a.headerOffset + int64(s.indexOffset)
+					if !bytes.Equal(output[offset:offset+4], fccJUNK[:]) {
+						t.Fatalf("reserved super index space is marked as %s", output[offset:offset+4])
+					}
+				}
+				return
+			}
+
+			if len(a.standardIndices) != test.riffs {
+				t.Fatalf("got %d standard indices, want %d", len(a.standardIndices), test.riffs)
+			}
+			superIndex := output[a.headerOffset+int64(a.header.streams[0].indexOffset):]
+			if !bytes.Equal(superIndex[:4], fccIndx[:]) || !bytes.Equal(superIndex[16:20], []byte("00dc")) {
+				t.Fatalf("super index is missing")
+			}
+			if n := binary.LittleEndian.Uint32(superIndex[12:]); n != uint32(test.riffs) {
+				t.Fatalf("got %d super index entries, want %d", n, test.riffs)
+			}
+
+			var frame int
+			for i, ix := range a.standardIndices {
+				// the super index entry must point to the standard index
+				entry := superIndex[8+24+16*i:]
+				offset := int64(binary.LittleEndian.Uint64(entry))
+				size := binary.LittleEndian.Uint32(entry[8:])
+				duration := binary.LittleEndian.Uint32(entry[12:])
+				if offset != ix.Offset || size != 8+ix.Size {
+					t.Fatalf("super index entry %d points to offset %d with size %d, want offset %d with size %d",
+						i, offset, size, ix.Offset, 8+ix.Size)
+				}
+
+				// the standard index must point to the frames of its movi list
+				base := int64(binary.LittleEndian.Uint64(ix.Data[12:]))
+				if base != a.movis[i]+8 {
+					t.Fatalf("standard index %d has base offset %d, want %d", i, base, a.movis[i]+8)
+				}
+				entries := binary.LittleEndian.Uint32(ix.Data[4:])
+				if entries == 0 {
+					t.Fatalf("movi list %d contains no frames", i)
+				}
+				if entries != duration {
+					t.Fatalf("standard index %d has %d entries, but its super index entry has a duration of %d",
+						i, entries, duration)
+				}
+				for j := 0; j < int(entries); j++ {
+					if frame >= len(a.frames) || a.frameMovis[frame] != i {
+						t.Fatalf("standard index %d has more entries than frames in its movi list", i)
+					}
+					c := a.frames[frame]
+					entry := ix.Data[24+8*j:]
+					offset := base + int64(binary.LittleEndian.Uint32(entry))
+					size := binary.LittleEndian.Uint32(entry[4:])
+					keyframe := c.Data[4]>>6 == vopCodingTypeI
+					if offset != c.Offset+8 || size&^odmlIndexDeltaFrame != c.Size ||
+						(size&odmlIndexDeltaFrame == 0) != keyframe {
+						t.Fatalf("entry %d of standard index %d points to offset %d with size %#x, "+
+							"want offset %d with size %d and keyframe %v", j, i, offset, size, c.Offset+8, c.Size, keyframe)
+					}
+					frame++
+				}
+			}
+			if frame != len(a.frames) {
+				t.Fatalf("standard indices include %d of %d frames", frame, len(a.frames))
+			}
+		})
+	}
+}
@@ -0,0 +1,426 @@
+package moshpit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// AviCache stores the moshable AVI files written by ConvertToAvi,
+// so they can be reused when moshing the same input file again.
+// Entries are keyed by the contents of the input file and the
+// conversion parameters, and are pruned by size and age.
+type AviCache struct {
+	// Dir is the directory the cached files are stored in.
+	Dir string
+	// MaxSize is the maximum total size of the cached files in bytes,
+	// or 0 for no limit. The least recently used entries are removed first.
+	MaxSize int64
+	// MaxAge is the maximum duration since an entry was last used,
+	// or 0 for no limit.
+	MaxAge time.Duration
+}
+
+// CacheEntry describes a moshable AVI file stored in an AviCache.
+type CacheEntry struct {
+	Key string `json:"-"`
+	// File is the path of the cached AVI file.
+	File string `json:"-"`
+	// Size is the size of the cached AVI file in bytes.
+	Size int64 `json:"-"`
+	// LastUsed is the time the entry was last stored or loaded.
+	LastUsed time.Time `json:"-"`
+
+	// InputFile is the path of the file that was converted.
+	InputFile   string           `json:"inputFile"`
+	VideoStream int              `json:"videoStream"`
+	Segment     Segment          `json:"segment"`
+	Format      AviFormat        `json:"format"`
+	Encoding    AviEncodeOptions `json:"encoding"`
+	// IFrames is the number of I-Frame indices that were specified,
+	// or -1 if the I-Frames were placed automatically.
+	IFrames int `json:"iFrames"`
+}
+
+// matches the names of cached AVI files
+var cacheFileRegex = regexp.MustCompile(`^([0-9a-f]{64})\.avi$`)
+
+// DefaultCacheDir returns the directory AVI files are cached in by default,
+// which is the moshpit directory in the user's cache directory.
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "moshpit"), nil
+}
+
+// NewAviCache returns an AviCache storing files in the given directory,
+// without limiting their size or age.
+func NewAviCache(dir string) *AviCache {
+	return &AviCache{Dir: dir}
+}
+
+// inputHash is the hash of an input file's contents,
+// stored in the cache directory along with the size and modification
+// time of the file to tell whether it is still valid.
+type inputHash struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Hash    string    `json:"hash"`
+}
+
+// Key returns the key of the AVI file converted from the input file
+// with the given parameters of ConvertToAvi.
+// The contents of the input file are hashed, unless its hash has been
+// stored in the cache directory and the file's size and modification
+// time haven't changed since.
+func (c *AviCache) Key(inputFile string, videoStream int, segment Segment, format AviFormat,
+	options AviEncodeOptions, iFrameIndices []uint64) (string, error) {
+	sum, err := c.hashInput(inputFile)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(sum)
+
+	// distinguish automatically placed I-Frames
+	// from an empty list of I-Frame indices
+	iFrames := "auto"
+	if iFrameIndices != nil {
+		indices := make([]string, len(iFrameIndices))
+		for i, index := range iFrameIndices {
+			indices[i] = strconv.FormatUint(index, 10)
+		}
+		iFrames = "[" + strings.Join(indices, ",") + "]"
+	}
+	fmt.Fprintf(h, "stream=%d segment=%s format=%+v encoding=%+v iframes=%s",
+		videoStream, segment, format.normalized(), options, iFrames)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashInput returns the hash of the input file's contents,
+// reusing the stored hash if the file hasn't changed.
+func (c *AviCache) hashInput(inputFile string) ([]byte, error) {
+	f, err := os.Open(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	hashFile, err := c.hashFile(inputFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored inputHash
+	if data, err := ioutil.ReadFile(hashFile); err == nil && json.Unmarshal(data, &stored) == nil &&
+		stored.Size == info.Size() && stored.ModTime.Equal(info.ModTime()) {
+		if sum, err := hex.DecodeString(stored.Hash); err == nil && len(sum) == sha256.Size {
+			// mark the hash as used, so it isn't pruned
+			now := time.Now()
+			os.Chtimes(hashFile, now, now)
+			return sum, nil
+		}
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("error hashing input file: %s", err.Error())
+	}
+	sum := h.Sum(nil)
+
+	// the hash is computed again if it can't be stored
+	if err := os.MkdirAll(filepath.Dir(hashFile), 0755); err == nil {
+		data, _ := json.Marshal(inputHash{Size: info.Size(), ModTime: info.ModTime(), Hash: hex.EncodeToString(sum)})
+		ioutil.WriteFile(hashFile, data, 0644)
+	}
+	return sum, nil
+}
+
+// Get returns the path of the cached AVI file with the given key,
+// marking it as used, or false if there is no such file.
+func (c *AviCache) Get(key string) (string, bool) {
+	fileName := c.aviFile(key)
+	info, err := os.Stat(fileName)
+	if err != nil || info.Size() == 0 {
+		return "", false
+	}
+	now := time.Now()
+	os.Chtimes(fileName, now, now)
+	return fileName, true
+}
+
+// Put moves the AVI file into the cache under the given key,
+// along with the entry describing how it was converted,
+// and returns the path of the cached file.
+// The cache is pruned afterwards, never removing the stored file.
+// If only pruning fails, the path of the cached file
+// is returned along with the error.
+func (c *AviCache) Put(key string, aviFile string, entry CacheEntry) (string, error) {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return "", fmt.Errorf("error creating cache directory: %s", err.Error())
+	}
+
+	metadata, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(c.metadataFile(key), metadata, 0644); err != nil {
+		return "", fmt.Errorf("error writing cache entry: %s", err.Error())
+	}
+
+	fileName := c.aviFile(key)
+	if err := moveFile(aviFile, fileName); err != nil {
+		os.Remove(c.metadataFile(key))
+		return "", fmt.Errorf("error writing cache entry: %s", err.Error())
+	}
+	now := time.Now()
+	os.Chtimes(fileName, now, now)
+
+	if _, err := c.prune(key); err != nil {
+		return fileName, err
+	}
+	return fileName, nil
+}
+
+// ConvertToAvi is like ConvertToAviSync, but takes the AVI file from the cache
+// if the input file has been converted with the same parameters before.
+// Otherwise, the input file is converted into a temp file in the given
+// directory named after the project, which is then stored in the cache.
+// It returns the path of the cached AVI file.
+func (c *AviCache) ConvertToAvi(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, inputFile string, videoStream int, segment Segment, format AviFormat, tempDir string, project string,
+	options AviEncodeOptions, iFrameIndices []uint64, observer Observer) (string, error) {
+	return c.convertToAvi(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, inputFile, videoStream, nil, 0,
+		segment, format, tempDir, project, options, iFrameIndices, observer)
+}
+
+// convertToAvi is like ConvertToAvi, using the given video stream
+// and duration if the input file has already been probed.
+func (c *AviCache) convertToAvi(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, inputFile string, videoStream int, video *StreamInfo, duration time.Duration,
+	segment Segment, format AviFormat, tempDir string, project string,
+	options AviEncodeOptions, iFrameIndices []uint64, observer Observer) (string, error) {
+	key, err := c.Key(inputFile, videoStream, segment, format, options, iFrameIndices)
+	if err != nil {
+		return "", err
+	}
+	if fileName, ok := c.Get(key); ok {
+		if observer != nil {
+			observer.Observe(Event{Type: EventStage, Stage: CachedAviStage})
+			observer.Observe(Event{Type: EventProgress, Progress: 1})
+		}
+		return fileName, nil
+	}
+
+	aviFile, err := tempAviFile(tempDir, project, "converted")
+	if err != nil {
+		return "", err
+	}
+	err = convertToAvi(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, inputFile, videoStream, video, duration,
+		segment, format, aviFile, options, iFrameIndices, newReporter(observer, nil))
+	if err != nil {
+		os.Remove(aviFile)
+		return "", err
+	}
+
+	iFrames := -1
+	if iFrameIndices != nil {
+		iFrames = len(iFrameIndices)
+	}
+	fileName, err := c.Put(key, aviFile, CacheEntry{
+		InputFile:   inputFile,
+		VideoStream: videoStream,
+		Segment:     segment,
+		Format:      format,
+		Encoding:    options,
+		IFrames:     iFrames,
+	})
+	if fileName == "" {
+		os.Remove(aviFile)
+		return "", fmt.Errorf("error caching AVI file: %s", err.Error())
+	}
+	if err != nil {
+		// the AVI file has been cached, but removing
+		// other entries failed, which doesn't affect it
+		newReporter(observer, nil).log(fmt.Sprintf("warning: error pruning AVI cache: %s", err.Error()))
+	}
+	return fileName, nil
+}
+
+// Contains returns whether the file is stored in the cache directory.
+func (c *AviCache) Contains(fileName string) bool {
+	dir, err := filepath.Abs(filepath.Dir(fileName))
+	if err != nil {
+		return false
+	}
+	cacheDir, err := filepath.Abs(c.Dir)
+	return err == nil && dir == cacheDir && cacheFileRegex.MatchString(filepath.Base(fileName))
+}
+
+// Entries returns the entries of the cache,
+// with the most recently used entries first.
+func (c *AviCache) Entries() ([]CacheEntry, error) {
+	files, err := ioutil.ReadDir(c.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []CacheEntry
+	for _, f := range files {
+		m := cacheFileRegex.FindStringSubmatch(f.Name())
+		if m == nil || f.IsDir() {
+			continue
+		}
+
+		// entries are listed even if their metadata is missing
+		entry := CacheEntry{IFrames: -1}
+		if metadata, err := ioutil.ReadFile(c.metadataFile(m[1])); err == nil {
+			json.Unmarshal(metadata, &entry)
+		}
+		entry.Key = m[1]
+		entry.File = filepath.Join(c.Dir, f.Name())
+		entry.Size = f.Size()
+		entry.LastUsed = f.ModTime()
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+// Prune removes the entries that were not used within MaxAge,
+// and the least recently used entries exceeding MaxSize,
+// returning the removed entries.
+// The stored hashes of input files not used within MaxAge are removed as well.
+func (c *AviCache) Prune() ([]CacheEntry, error) {
+	return c.prune("")
+}
+
+// prune is like Prune, but never removes the entry with the given key.
+func (c *AviCache) prune(keep string) ([]CacheEntry, error) {
+	c.pruneHashes()
+	entries, err := c.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []CacheEntry
+	var size int64
+	for _, entry := range entries {
+		size += entry.Size
+		if entry.Key == keep {
+			continue
+		}
+		if (c.MaxAge > 0 && time.Since(entry.LastUsed) > c.MaxAge) ||
+			(c.MaxSize > 0 && size > c.MaxSize) {
+			if err := c.remove(entry); err != nil {
+				return removed, err
+			}
+			removed = append(removed, entry)
+			size -= entry.Size
+		}
+	}
+	return removed, nil
+}
+
+// Clear removes all entries of the cache and the stored hashes
+// of input files, returning the removed entries.
+func (c *AviCache) Clear() ([]CacheEntry, error) {
+	entries, err := c.Entries()
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if err := c.remove(entry); err != nil {
+			return entries[:i], err
+		}
+	}
+	os.RemoveAll(c.hashDir())
+	return entries, nil
+}
+
+func (c *AviCache) remove(entry CacheEntry) error {
+	if err := os.Remove(entry.File); err != nil {
+		return fmt.Errorf("error removing cache entry: %s", err.Error())
+	}
+	os.Remove(c.metadataFile(entry.Key))
+	return nil
+}
+
+func (c *AviCache) aviFile(key string) string {
+	return filepath.Join(c.Dir, key+".avi")
+}
+
+func (c *AviCache) metadataFile(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
+
+// hashDir returns the directory the hashes of input files are stored in.
+func (c *AviCache) hashDir() string {
+	return filepath.Join(c.Dir, "hashes")
+}
+
+// hashFile returns the file the hash of the input file is stored in,
+// which is named after the hash of its absolute path.
+func (c *AviCache) hashFile(inputFile string) (string, error) {
+	path, err := filepath.Abs(inputFile)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(c.hashDir(), hex.EncodeToString(sum[:])+".json"), nil
+}
+
+// pruneHashes removes the hashes of input files that were not used within MaxAge.
+// The hashes are small and computed again if they are missing,
+// so they are not pruned by size and errors are ignored.
+func (c *AviCache) pruneHashes() {
+	if c.MaxAge <= 0 {
+		return
+	}
+	files, err := ioutil.ReadDir(c.hashDir())
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if time.Since(f.ModTime()) > c.MaxAge {
+			os.Remove(filepath.Join(c.hashDir(), f.Name()))
+		}
+	}
+}
+
+// moveFile moves the source file to the destination,
+// copying it if it is located on another device.
+func moveFile(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,427 @@
+package moshpit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// newTestCache returns an AviCache in a temporary directory
+// and a function removing it.
+func newTestCache(t *testing.T) (*AviCache, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "moshpit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAviCache(filepath.Join(dir, "cache")), func() { os.RemoveAll(dir) }
+}
+
+// putTestEntry stores an AVI file of the given size under the key,
+// last used at the given time.
+func putTestEntry(t *testing.T, c *AviCache, key string, size int, lastUsed time.Time) string {
+	t.Helper()
+	aviFile := filepath.Join(filepath.Dir(c.Dir), key+".tmp")
+	if err := ioutil.WriteFile(aviFile, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileName, err := c.Put(key, aviFile, CacheEntry{InputFile: key + ".mp4", IFrames: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(fileName, lastUsed, lastUsed); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+// testKey returns a valid cache key consisting of the given digit.
+func testKey(digit byte) string {
+	key := make([]byte, 64)
+	for i := range key {
+		key[i] = digit
+	}
+	return string(key)
+}
+
+func entryKeys(entries []CacheEntry) []string {
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+	return keys
+}
+
+func equalKeys(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAviCacheKey(t *testing.T) {
+	c, remove := newTestCache(t)
+	defer remove()
+	dir := filepath.Dir(c.Dir)
+	inputFile := filepath.Join(dir, "input.mp4")
+	copiedFile := filepath.Join(dir, "copied.mp4")
+	otherFile := filepath.Join(dir, "other.mp4")
+	for fileName, content := range map[string]string{inputFile: "input", copiedFile: "input", otherFile: "other"} {
+		if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	options := AviEncodeOptions{Quality: 0.5}
+	key, err := c.Key(inputFile, 0, Segment{}, AviFormat{}, options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cacheFileRegex.MatchString(key + ".avi") {
+		t.Fatalf("got invalid key %s", key)
+	}
+
+	tests := []struct {
+		name          string
+		inputFile     string
+		videoStream   int
+		segment       Segment
+		format        AviFormat
+		options       AviEncodeOptions
+		iFrameIndices []uint64
+		same          bool
+	}{
+		{name: "same parameters", inputFile: inputFile, options: options, same: true},
+		{name: "same contents", inputFile: copiedFile, options: options, same: true},
+		{name: "other contents", inputFile: otherFile, options: options},
+		{name: "other video stream", inputFile: inputFile, videoStream: 1, options: options},
+		{name: "other segment", inputFile: inputFile, segment: Segment{Start: time.Second}, options: options},
+		{name: "equivalent format", inputFile: inputFile, format: AviFormat{Encoder: EncoderMpeg4}, options: options, same: true},
+		{name: "other format", inputFile: inputFile, format: AviFormat{Width: 640}, options: options},
+		{name: "other encoder settings", inputFile: inputFile, options: AviEncodeOptions{Quality: 0.6}},
+		{name: "no I-Frame indices", inputFile: inputFile, options: options, iFrameIndices: []uint64{}},
+		{name: "I-Frame indices", inputFile: inputFile, options: options, iFrameIndices: []uint64{0, 10}},
+	}
+
+	for _, test := range tests {
+		other, err := c.Key(test.inputFile, test.videoStream, test.segment, test.format, test.options, test.iFrameIndices)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if (other == key) != test.same {
+			t.Errorf("%s: got key %s for key %s, want same %v", test.name, other, key, test.same)
+		}
+	}
+
+	if _, err := c.Key(filepath.Join(dir, "missing.mp4"), 0, Segment{}, AviFormat{}, options, nil); err == nil {
+		t.Fatal("got key for a missing input file, want an error")
+	}
+}
+
+func TestAviCacheInputHash(t *testing.T) {
+	c, remove := newTestCache(t)
+	defer remove()
+	inputFile := filepath.Join(filepath.Dir(c.Dir), "input.mp4")
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeInput := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := ioutil.WriteFile(inputFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(inputFile, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := func() string {
+		t.Helper()
+		key, err := c.Key(inputFile, 0, Segment{}, AviFormat{}, AviEncodeOptions{Quality: 0.5}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	writeInput("input", modTime)
+	original := key()
+	hashFile, err := c.hashFile(inputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(hashFile); err != nil {
+		t.Fatalf("the hash of the input file was not stored: %v", err)
+	}
+
+	// the stored hash is used while the size and modification time match
+	writeInput("INPUT", modTime)
+	if key() != original {
+		t.Fatal("the stored hash was not used for an unchanged size and modification time")
+	}
+	writeInput("INPUT", modTime.Add(time.Second))
+	changed := key()
+	if changed == original {
+		t.Fatal("the stored hash was used after the modification time changed")
+	}
+	writeInput("input!", modTime.Add(time.Second))
+	if key() == changed {
+		t.Fatal("the stored hash was used after the size changed")
+	}
+
+	// hashes not used within the maximum age are pruned
+	c.MaxAge = time.Hour
+	if _, err := c.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(hashFile); err != nil {
+		t.Fatalf("a recently used hash was pruned: %v", err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(hashFile, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(hashFile); !os.IsNotExist(err) {
+		t.Fatal("an expired hash was not pruned")
+	}
+
+	// clearing the cache removes the hashes
+	key()
+	if _, err := c.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(c.hashDir()); !os.IsNotExist(err) {
+		t.Fatal("the hashes were not removed when clearing the cache")
+	}
+}
+
+func TestAviCacheGetPut(t *testing.T) {
+	c, remove := newTestCache(t)
+	defer remove()
+	key := testKey('a')
+
+	if _, ok := c.Get(key); ok {
+		t.Fatal("got an entry from an empty cache")
+	}
+	if entries, err := c.Entries(); err != nil || len(entries) != 0 {
+		t.Fatalf("got entries %v and error %v for a missing cache directory, want none", entries, err)
+	}
+
+	lastUsed := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fileName := putTestEntry(t, c, key, 10, lastUsed)
+	if !c.Contains(fileName) || c.Contains(filepath.Join(filepath.Dir(c.Dir), key+".avi")) {
+		t.Fatalf("Contains doesn't match the cached file %s", fileName)
+	}
+
+	entries, err := c.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != key || entries[0].File != fileName ||
+		entries[0].Size != 10 || entries[0].InputFile != key+".mp4" || !entries[0].LastUsed.Equal(lastUsed) {
+		t.Fatalf("got entries %+v, want the stored entry", entries)
+	}
+
+	got, ok := c.Get(key)
+	if !ok || got != fileName {
+		t.Fatalf("got file %s, want %s", got, fileName)
+	}
+	if info, err := os.Stat(fileName); err != nil || !info.ModTime().After(lastUsed) {
+		t.Fatal("Get didn't mark the entry as used")
+	}
+
+	// empty files are left by interrupted conversions
+	if err := ioutil.WriteFile(c.aviFile(testKey('b')), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(testKey('b')); ok {
+		t.Fatal("got an empty cached file")
+	}
+}
+
+func TestAviCachePrune(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		maxSize int64
+		maxAge  time.Duration
+		removed []string
+		kept    []string
+	}{
+		{
+			name:    "no limits",
+			removed: []string{},
+			kept:    []string{testKey('1'), testKey('2'), testKey('3')},
+		},
+		{
+			name:    "size",
+			maxSize: 25,
+			removed: []string{testKey('3')},
+			kept:    []string{testKey('1'), testKey('2')},
+		},
+		{
+			name:    "age",
+			maxAge:  90 * time.Minute,
+			removed: []string{testKey('2'), testKey('3')},
+			kept:    []string{testKey('1')},
+		},
+		{
+			name:    "size and age",
+			maxSize: 15,
+			maxAge:  150 * time.Minute,
+			removed: []string{testKey('2'), testKey('3')},
+			kept:    []string{testKey('1')},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, remove := newTestCache(t)
+			defer remove()
+			// the entries are last used one, two and three hours ago
+			for i := 1; i <= 3; i++ {
+				putTestEntry(t, c, testKey(byte('0'+i)), 10, now.Add(-time.Duration(i)*time.Hour))
+			}
+
+			c.MaxSize = test.maxSize
+			c.MaxAge = test.maxAge
+			removed, err := c.Prune()
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := c.Entries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalKeys(entryKeys(removed), test.removed) || !equalKeys(entryKeys(entries), test.kept) {
+				t.Fatalf("removed %v and kept %v, want to remove %v and keep %v",
+					entryKeys(removed), entryKeys(entries), test.removed, test.kept)
+			}
+			for _, entry := range removed {
+				if _, err := os.Stat(c.metadataFile(entry.Key)); !os.IsNotExist(err) {
+					t.Fatalf("metadata of removed entry %s exists", entry.Key)
+				}
+			}
+		})
+	}
+}
+
+func TestAviCachePutPrunes(t *testing.T) {
+	c, remove := newTestCache(t)
+	defer remove()
+	putTestEntry(t, c, testKey('1'), 10, time.Now())
+
+	// the stored entry is kept even if it exceeds the maximum size itself
+	c.MaxSize = 15
+	fileName := putTestEntry(t, c, testKey('2'), 20, time.Now())
+	entries, err := c.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].File != fileName {
+		t.Fatalf("got entries %v, want only the stored entry", entryKeys(entries))
+	}
+}
+
+func TestAviCacheClear(t *testing.T) {
+	c, remove := newTestCache(t)
+	defer remove()
+	for i := 1; i <= 2; i++ {
+		putTestEntry(t, c, testKey(byte('0'+i)), 10, time.Now().Add(-time.Duration(i)*time.Hour))
+	}
+	// other files in the cache directory are not entries
+	if err := ioutil.WriteFile(filepath.Join(c.Dir, "other.avi"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := c.Clear()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalKeys(entryKeys(removed), []string{testKey('1'), testKey('2')}) {
+		t.Fatalf("removed %v, want both entries", entryKeys(removed))
+	}
+	files, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "other.avi" {
+		t.Fatalf("got %d files in the cache directory, want only other.avi", len(files))
+	}
+}
+
+func TestAviCacheConvertToAvi(t *testing.T) {
+	pt := newPipelineTest(t)
+	defer pt.remove()
+	c := NewAviCache(filepath.Join(pt.dir, "cache"))
+	inputFile := filepath.Join(pt.dir, "input.mp4")
+	if err := ioutil.WriteFile(inputFile, []byte("input"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stages []string
+	observer := ObserverFunc(func(event Event) {
+		if event.Type == EventStage {
+			stages = append(stages, event.Stage)
+		}
+	})
+	convert := func(ffmpegPath string) (string, error) {
+		return c.ConvertToAvi(context.Background(), ffmpegPath, pt.ffprobe(t), "",
+			inputFile, 0, Segment{}, AviFormat{}, pt.dir, "input", AviEncodeOptions{Quality: 0.5}, nil, observer)
+	}
+
+	fileName, err := convert(pt.ffmpeg(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Contains(fileName) {
+		t.Fatalf("converted file %s is not cached", fileName)
+	}
+	if stages[len(stages)-1] == CachedAviStage {
+		t.Fatal("the first conversion loaded a cached file")
+	}
+
+	// ffmpeg isn't run for the cached file
+	stages = nil
+	cached, err := convert(pt.ffmpeg(t, "ffmpeg was run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != fileName || len(stages) != 1 || stages[0] != CachedAviStage {
+		t.Fatalf("got file %s with stages %v, want the cached file %s", cached, stages, fileName)
+	}
+	if data, err := ioutil.ReadFile(cached); err != nil || string(data) != string(pt.aviData) {
+		t.Fatal("cached file doesn't match the converted file")
+	}
+
+	// failed conversions are neither cached nor leave temp files behind
+	if err := ioutil.WriteFile(inputFile, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := convert(pt.ffmpeg(t, "invalid input")); err == nil {
+		t.Fatal("got no error for a failing conversion")
+	}
+	entries, err := c.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d cache entries, want 1", len(entries))
+	}
+	files, err := filepath.Glob(filepath.Join(pt.dir, "*.avi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got AVI files %v, want only the converted file", files)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/makeworld-the-better-one/moshpit"
+)
+
+// exit codes of batch commands
+const (
+	exitSuccess = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// batchCommands are the commands that can be run non-interactively
+// by passing them as the first argument after the options.
+var batchCommands = map[string]func(ctx context.Context, ffmpegPath string, ffprobePath string, ffmpegLogPath string, videoStream int, args []string) int{
+	commandScenes: batchScenes,
+	commandMosh:   batchMosh,
+	commandBloom:  batchBloom,
+	commandSplice: batchSplice,
+	commandCache:  batchCache,
+}
+
+// runBatch runs a single command without entering the prompt loop,
+// returning the exit code of the process.
+// Human-readable output is written to stderr, while the result
+// of the command is written to stdout in a machine-readable format.
+func runBatch(ctx context.Context, ffmpegPath string, ffprobePath string, ffmpegLogPath string, videoStream int, command string, args []string) int {
+	console = newConsole(os.Stderr)
+	return batchCommands[command](ctx, ffmpegPath, ffprobePath, ffmpegLogPath, videoStream, args)
+}
+
+// newBatchFlagSet returns a FlagSet for the arguments of a batch command,
+// with the -in flag specifying the input file.
+func newBatchFlagSet(command string, usage string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] %s %s\n", os.Args[0], command, usage)
+		flags.PrintDefaults()
+	}
+	in := flags.String("in", "", "path to the input file")
+	return flags, in
+}
+
+// parseBatchFlags parses the arguments of a batch command,
+// making sure the input file and the required flags are specified
+// and that the input file has the selected video stream.
+// It returns the opened input file or an exit code if parsing failed.
+func parseBatchFlags(ctx context.Context, ffprobePath string, videoStream int,
+	flags *flag.FlagSet, in *string, args []string, required ...string) (*os.File, int) {
+	if err := flags.Parse(args); err != nil {
+		return nil, exitUsage
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected argument: \"%s\"\n", flags.Arg(0))
+		flags.Usage()
+		return nil, exitUsage
+	}
+	for _, name := range append([]string{"in"}, required...) {
+		if flags.Lookup(name).Value.String() == "" {
+			fmt.Fprintf(os.Stderr, "Missing flag: -%s\n", name)
+			flags.Usage()
+			return nil, exitUsage
+		}
+	}
+
+	inputFilePath, err := filepath.Abs(*in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing input file path: %s\n", err.Error())
+		return nil, exitFailure
+	}
+	inputFile, err := os.Open(inputFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening input file: %s\n", err.Error())
+		return nil, exitFailure
+	}
+
+	if err := listStreams(ctx, ffprobePath, inputFile, videoStream); err != nil {
+		inputFile.Close()
+		return nil, batchResult(ctx, err)
+	}
+	return inputFile, exitSuccess
+}
+
+// batchResult writes the error of a batch command to stderr
+// and returns the corresponding exit code.
+func batchResult(ctx context.Context, err error) int {
+	select {
+	case <-ctx.Done():
+		fmt.Fprintln(os.Stderr, "Interrupted")
+		return exitFailure
+	default:
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return exitFailure
+	}
+	return exitSuccess
+}
+
+// splitList splits a comma-separated list of values.
+func splitList(list string) []string {
+	var values []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func batchScenes(ctx context.Context, ffmpegPath string, ffprobePath string, ffmpegLogPath string, videoStream int, args []string) int {
+	flags, in := newBatchFlagSet(commandScenes, "-in <file> [-threshold <threshold>] [-json] [-o <file>]")
+	threshold := flags.Float64("threshold", 0.2, "similarity threshold between 0 and 1")
+	jsonOutput := flags.Bool("json", false, "write the scene changes as a JSON array")
+	exportFile := flags.String("o", "", "export the scene changes to a .json, .csv, .edl or .fcpxml file")
+	file, code := parseBatchFlags(ctx, ffprobePath, videoStream, flags, in, args)
+	if file == nil {
+		return code
+	}
+	defer file.Close()
+
+	scenesArgs := []string{strconv.FormatFloat(*threshold, 'f', -1, 64)}
+	if *exportFile != "" {
+		scenesArgs = append(scenesArgs, "-o", *exportFile)
+	}
+	sceneTimes, err := cmdScenes(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, file, videoStream, scenesArgs)
+	if code := batchResult(ctx, err); code != exitSuccess {
+		return code
+	}
+
+	if *jsonOutput {
+		err := moshpit.ExportScenes(os.Stdout, moshpit.SceneFormatJSON, filepath.Base(file.Name()), sceneTimes)
+		return batchResult(ctx, err)
+	}
+
+	// write one scene change per line
+	for _, sceneTime := range sceneTimes {
+		fmt.Printf("%d\t%s\n", sceneTime.Frame, sceneTime.Timecode())
+	}
+	return exitSuccess
+}
+
+func batchMosh(ctx context.Context, ffmpegPath string, ffprobePath string, ffmpegLogPath string, videoStream int, args []string) int {
+	flags, in := newBatchFlagSet(commandMosh, "-in <file> -out <output> -frames <frame>[,...] [-threshold <threshold>] [-export-avi <file>]")
+	out := flags.String("out", "", "path to the output file")
+	exportAviFile := flags.String("export-avi", "", "also export the moshed AVI file to the given path")
+	frames := flags.String("frames", "", "comma-separated frames to mosh, or \"all\" and \"scenes[a:b]\" for scene changes")
+	threshold := flags.Float64("threshold", 0.2, "similarity threshold used to find scene changes for \"all\" and \"scenes[a:b]\"")
+	file, code := parseBatchFlags(ctx, ffprobePath, videoStream, flags, in, args, "out", "frames")
+	if file == nil {
+		return code
+	}
+	defer file.Close()
+
+	moshArgs := append([]string{*out}, splitList(*frames)...)
+
+	var sceneTimes []moshpit.VideoTime
+	if selectsScenes(moshArgs[1:]) {
+		// find the scene changes to mosh first
+		var err error
+		sceneTimes, err = cmdScenes(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, file, videoStream,
+			[]string{strconv.FormatFloat(*threshold, 'f', -1, 64)})
+		if code := batchResult(ctx, err); code != exitSuccess {
+			return code
+		}
+	}
+
+	result, err := cmdMosh(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, file, videoStream, sceneTimes, moshArgs)
+	return batchOutput(ctx, result, *out, *exportAviFile, err)
+}
+
+func batchBloom(ctx context.Context, ffmpegPath string, ffprobePath string, ffmpegLogPath string, videoStream int, args []string) int {
+	flags, in := newBatchFlagSet(commandBloom, "-in <file> -out <output> -frames <frame>x<count>[,...] [-stretch] [-export-avi <file>]")
+	out := flags.String("out", "", "path to the output file")
+	exportAviFile := flags.String("export-avi", "", "also export the moshed AVI file to the given path")
+	frames := flags.String("frames", "", "comma-separated frames to repeat in the format <frame>x<count>")
+	stretch := flags.Bool("stretch", false, "insert the repetitions instead of replacing the following frames")
+	file, code := parseBatchFlags(ctx, ffprobePath, videoStream, flags, in, args, "out", "frames")
+	if file == nil {
+		return code
+	}
+	defer file.Close()
+
+	bloomArgs := append([]string{*out}, splitList(*frames)...)
+	if *stretch {
+		bloomArgs = append(bloomArgs, "stretch")
+	}
+
+	result, err := cmdBloom(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, file, videoStream, bloomArgs)
+	return batchOutput(ctx, result, *out, *exportAviFile, err)
+}
+
+func batchSplice(ctx context.Context, ffmpegPath string, ffprobePath string, ffmpegLogPath string, videoStream int, args []string) int {
+	flags, in := newBatchFlagSet(commandSplice, "-in <file> -out <output> -motion <motion_file> -points <frame>[:<source>[:<length>]][,...] [-export-avi <file>]")
+	out := flags.String("out", "", "path to the output file")
+	exportAviFile := flags.String("export-avi", "", "also export the moshed AVI file to the given path")
+	motion := flags.String("motion", "", "path to the file to take the motion from")
+	points := flags.String("points", "", "comma-separated splice points in the format <frame>[:<source>[:<length>]]")
+	file, code := parseBatchFlags(ctx, ffprobePath, videoStream, flags, in, args, "out", "motion", "points")
+	if file == nil {
+		return code
+	}
+	defer file.Close()
+
+	spliceArgs := append([]string{*out, *motion}, splitList(*points)...)
+
+	result, err := cmdSplice(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, file, videoStream, spliceArgs)
+	return batchOutput(ctx, result, *out, *exportAviFile, err)
+}
+
+// batchOutput exports the moshed AVI file written by a batch command if
+// exportAviFile is not empty, removes the intermediate AVI files and
+// writes the path of the output file to stdout if it was successful.
+func batchOutput(ctx context.Context, result *moshpit.PipelineResult, outputFilePath string, exportAviFile string, err error) int {
+	if result != nil {
+		if err == nil && exportAviFile != "" {
+			err = cmdExportAvi(result.MoshedFile, []string{exportAviFile})
+		}
+		removeAvi(result.AviFile)
+		removeAvi(result.MoshedFile)
+	}
+	if code := batchResult(ctx, err); code != exitSuccess {
+		return code
+	}
+
+	outputFilePath, err = filepath.Abs(outputFilePath)
+	if err != nil {
+		return batchResult(ctx, err)
+	}
+	fmt.Println(outputFilePath)
+	return exitSuccess
+}
+
+// selectsScenes returns whether any of the frame specifications
+// selects scene changes, which have to be found first.
+func selectsScenes(specs []string) bool {
+	for _, spec := range specs {
+		spec = strings.ToLower(spec)
+		if spec == "all" || strings.HasPrefix(spec, "scenes[") {
+			return true
+		}
+	}
+	return false
+}
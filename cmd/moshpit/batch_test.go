@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// discardOutput discards the messages written to stderr
+// and the console until the returned function is called.
+func discardOutput() func() {
+	stderr, stdout := os.Stderr, console
+	os.Stderr, _ = os.Open(os.DevNull)
+	console = newConsole(os.Stderr)
+	return func() {
+		os.Stderr.Close()
+		os.Stderr, console = stderr, stdout
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		list   string
+		values []string
+	}{
+		{list: "", values: nil},
+		{list: "1", values: []string{"1"}},
+		{list: "1,2,3", values: []string{"1", "2", "3"}},
+		{list: " 1 , 2x3 ,,", values: []string{"1", "2x3"}},
+	}
+
+	for _, test := range tests {
+		values := splitList(test.list)
+		if len(values) != len(test.values) {
+			t.Fatalf("splitList(%q) = %q, want %q", test.list, values, test.values)
+		}
+		for i := range values {
+			if values[i] != test.values[i] {
+				t.Fatalf("splitList(%q) = %q, want %q", test.list, values, test.values)
+			}
+		}
+	}
+}
+
+func TestParseBatchFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moshpit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inputFile := filepath.Join(dir, "input.mp4")
+	if err := ioutil.WriteFile(inputFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// ffprobe reporting a single video stream
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts are not supported on windows")
+	}
+	ffprobePath := filepath.Join(dir, "ffprobe")
+	script := "#!/bin/sh\necho '{\"streams\": [{\"index\": 0, \"codec_type\": \"video\"}]}'\n"
+	if err := ioutil.WriteFile(ffprobePath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		args        []string
+		videoStream int
+		code        int
+	}{
+		{name: "all flags", args: []string{"-in", inputFile, "-out", "out.mp4"}, code: exitSuccess},
+		{name: "missing video stream", args: []string{"-in", inputFile, "-out", "out.mp4"}, videoStream: 1, code: exitFailure},
+		{name: "missing input", args: []string{"-out", "out.mp4"}, code: exitUsage},
+		{name: "missing required flag", args: []string{"-in", inputFile}, code: exitUsage},
+		{name: "unknown flag", args: []string{"-in", inputFile, "-out", "out.mp4", "-x"}, code: exitUsage},
+		{name: "unexpected argument", args: []string{"-in", inputFile, "-out", "out.mp4", "extra"}, code: exitUsage},
+		{name: "nonexistent input", args: []string{"-in", filepath.Join(dir, "missing.mp4"), "-out", "out.mp4"}, code: exitFailure},
+	}
+
+	defer discardOutput()()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flags, in := newBatchFlagSet("test", "")
+			flags.String("out", "", "")
+			file, code := parseBatchFlags(context.Background(), ffprobePath, test.videoStream, flags, in, test.args, "out")
+			if file != nil {
+				file.Close()
+			}
+			if code != test.code || (file != nil) != (code == exitSuccess) {
+				t.Fatalf("got exit code %d and file %v, want exit code %d", code, file, test.code)
+			}
+		})
+	}
+}
+
+func TestBatchResult(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		code int
+	}{
+		{name: "success", ctx: context.Background(), code: exitSuccess},
+		{name: "error", ctx: context.Background(), err: errors.New("error"), code: exitFailure},
+		{name: "interrupted", ctx: canceled, code: exitFailure},
+	}
+
+	defer discardOutput()()
+
+	for _, test := range tests {
+		if code := batchResult(test.ctx, test.err); code != test.code {
+			t.Errorf("%s: got exit code %d, want %d", test.name, code, test.code)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/moshpit"
+)
+
+const (
+	cacheList  = "list"
+	cachePrune = "prune"
+	cacheClear = "clear"
+)
+
+// aviCache stores the moshable AVI files between runs,
+// or is nil if caching is disabled using the -no-cache option.
+var aviCache *moshpit.AviCache
+
+// removeAvi removes an intermediate AVI file that is no longer needed,
+// unless it is stored in the cache or the -keep-intermediates option is set.
+func removeAvi(fileName string) {
+	if fileName == "" || *keepIntermediatesFlag || (aviCache != nil && aviCache.Contains(fileName)) {
+		return
+	}
+	os.Remove(fileName)
+}
+
+// aviObserver updates a progress bar while converting the input file,
+// remembering whether the AVI file was loaded from the cache.
+type aviObserver struct {
+	bar    *floatProgressBar
+	cached bool
+}
+
+func cachedAviObserver(bar *floatProgressBar) *aviObserver {
+	return &aviObserver{bar: bar}
+}
+
+// Observe implements moshpit.Observer.
+func (o *aviObserver) Observe(event moshpit.Event) {
+	if event.Type == moshpit.EventStage && event.Stage == moshpit.CachedAviStage {
+		o.cached = true
+	}
+	o.bar.Observe(event)
+}
+
+// message returns the message to show after the stage has finished,
+// which states that the AVI file was loaded from the cache if it was.
+func (o *aviObserver) message(done string) string {
+	if o.cached {
+		return "Loaded cached AVI file."
+	}
+	return done
+}
+
+// cmdCache lists, prunes or clears the cached moshable AVI files,
+// returning the entries that were listed or removed.
+func cmdCache(args []string) ([]moshpit.CacheEntry, error) {
+	if aviCache == nil {
+		return nil, errors.New("caching is disabled")
+	}
+
+	action := cacheList
+	if len(args) > 0 && args[0] != "" {
+		action = strings.ToLower(args[0])
+	}
+
+	switch action {
+	case cacheList:
+		entries, err := aviCache.Entries()
+		if err != nil {
+			return nil, fmt.Errorf("error reading cache directory: %s", err.Error())
+		}
+		for _, entry := range entries {
+			console.Printf("%s  %9s  %s (v:%d)\n", entry.LastUsed.Format("2006-01-02 15:04"),
+				formatBytes(uint64(entry.Size)), cacheEntryInput(entry), entry.VideoStream)
+		}
+		console.Printf("%d cached AVI files, %s in %s\n", len(entries), formatBytes(cacheSize(entries)), aviCache.Dir)
+		return entries, nil
+	case cachePrune, cacheClear:
+		var removed []moshpit.CacheEntry
+		var err error
+		if action == cachePrune {
+			removed, err = aviCache.Prune()
+		} else {
+			removed, err = aviCache.Clear()
+		}
+		console.Printf("Removed %d cached AVI files, %s\n", len(removed), formatBytes(cacheSize(removed)))
+		return removed, err
+	default:
+		return nil, fmt.Errorf("unknown cache action \"%s\", must be %s, %s or %s", args[0], cacheList, cachePrune, cacheClear)
+	}
+}
+
+func batchCache(ctx context.Context, ffmpegPath string, ffprobePath string, ffmpegLogPath string, videoStream int, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] %s <%s|%s|%s>\n", os.Args[0], commandCache, cacheList, cachePrune, cacheClear)
+		return exitUsage
+	}
+
+	entries, err := cmdCache(args)
+
+	// write one entry per line, even if removing the remaining entries failed
+	for _, entry := range entries {
+		fmt.Printf("%s\t%d\t%s\t%d\t%s\n", entry.Key, entry.Size,
+			entry.LastUsed.Format(time.RFC3339), entry.VideoStream, entry.InputFile)
+	}
+	return batchResult(ctx, err)
+}
+
+// cacheEntryInput returns the input file of the entry to show,
+// as older entries may be missing their metadata.
+func cacheEntryInput(entry moshpit.CacheEntry) string {
+	if entry.InputFile == "" {
+		return "unknown input file"
+	}
+	return entry.InputFile
+}
+
+func cacheSize(entries []moshpit.CacheEntry) uint64 {
+	var size uint64
+	for _, entry := range entries {
+		size += uint64(entry.Size)
+	}
+	return size
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/k0kubun/go-ansi"
+	"github.com/mitchellh/colorstring"
+)
+
+// console is where the human-readable output of commands is written to.
+// In batch mode, it writes to stderr, keeping stdout free
+// for the machine-readable results of the command.
+var console = newConsole(os.Stdout)
+
+// consoleWriter writes human-readable output to a file,
+// only coloring it and rendering progress bars
+// if the file is a terminal.
+type consoleWriter struct {
+	w        io.Writer
+	terminal bool
+	colorize colorstring.Colorize
+}
+
+func newConsole(f *os.File) *consoleWriter {
+	terminal := isTerminal(f)
+
+	var w io.Writer = f
+	if terminal {
+		// translate ANSI escape codes on windows
+		if f == os.Stderr {
+			w = ansi.NewAnsiStderr()
+		} else {
+			w = ansi.NewAnsiStdout()
+		}
+	}
+
+	return &consoleWriter{
+		w:        w,
+		terminal: terminal,
+		colorize: colorstring.Colorize{
+			Colors:  colorstring.DefaultColors,
+			Disable: !terminal,
+			Reset:   true,
+		},
+	}
+}
+
+// isTerminal returns whether the file is a character device,
+// which is the case for terminals.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+// Color returns the string with its color codes replaced
+// by ANSI escape codes if the console is a terminal,
+// or removed otherwise.
+func (c *consoleWriter) Color(v string) string {
+	return c.colorize.Color(v)
+}
+
+// Printf writes the formatted string, interpreting
+// the color codes in the format string.
+func (c *consoleWriter) Printf(format string, a ...interface{}) {
+	fmt.Fprintf(c.w, c.Color(format), a...)
+}
+
+// Print writes the string, interpreting its color codes.
+func (c *consoleWriter) Print(s string) {
+	fmt.Fprint(c.w, c.Color(s))
+}
+
+// Println writes the string followed by a newline,
+// interpreting its color codes.
+func (c *consoleWriter) Println(s string) {
+	fmt.Fprintln(c.w, c.Color(s))
+}
+
+// writeRaw writes the string without interpreting color codes.
+func (c *consoleWriter) writeRaw(s string) {
+	fmt.Fprint(c.w, s)
+}
@@ -6,11 +6,13 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
 	"os/signal"
-	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -19,37 +21,111 @@ import (
 	"github.com/c-bata/go-prompt"
 	"github.com/k0kubun/go-ansi"
 	"github.com/makeworld-the-better-one/moshpit"
-	"github.com/mitchellh/colorstring"
-	uuid "github.com/satori/go.uuid"
 )
 
 var ffmpegPathFlag = flag.String("ffmpeg", "ffmpeg", "path to ffmpeg executable")
+var ffprobePathFlag = flag.String("ffprobe", "ffprobe", "path to ffprobe executable")
 var ffmpegLogFlag = flag.String("log", "", "path to ffmpeg log output")
+var streamFlag = flag.String("stream", "v:0", "video stream of the input file to mosh, like v:1 for the second video stream")
+var cacheDirFlag = flag.String("cache-dir", "", "directory to cache moshable AVI files in (default is the moshpit directory in the user cache directory)")
+var noCacheFlag = flag.Bool("no-cache", false, "disable caching moshable AVI files")
+var cacheSizeFlag = flag.Uint("cache-size", 10240, "maximum total size of the cached AVI files in MB, or 0 for no limit")
+var cacheAgeFlag = flag.Duration("cache-age", 30*24*time.Hour, "maximum duration since a cached AVI file was last used, or 0 for no limit")
+var startFlag = flag.String("ss", "", "time to start processing the input file at, like 72.2, 1m12.2s or 01:12.2")
+var endFlag = flag.String("to", "", "time to stop processing the input file at, in the same format as -ss")
+var stitchFlag = flag.Bool("stitch", false, "stitch the moshed segment selected by -ss and -to back into the input file, encoding the whole video again")
+var fpsFlag = flag.String("fps", "", "constant frame rate to convert the input file to, like 25, 29.97 or 30000/1001")
+var cfrFlag = flag.Bool("cfr", false, "convert an input file with a variable frame rate to its average frame rate")
+var sizeFlag = flag.String("size", "", "resolution to scale the input file to, like 1280x720, or 1280x0 to keep the aspect ratio")
+var fitFlag = flag.String("fit", string(moshpit.FitPad), "how to fit the input file into the -size if the aspect ratio differs, one of pad, crop or stretch")
+var pixFmtFlag = flag.String("pix-fmt", "", "pixel format of the moshable AVI file, like yuv420p")
+var encoderFlag = flag.String("encoder", moshpit.EncoderMpeg4, "MPEG-4 encoder to write the moshable AVI file with, mpeg4 or libxvid")
+var encodePresetFlag = flag.String("encode-preset", "", "preset of encoder settings shaping the look of the mosh, one of "+encodePresetNames()+" (default is the highest quality with the defaults of the encoder)")
+var encodeOptsFlag = flag.String("encode-opts", "", "comma-separated encoder settings overriding the -encode-preset, like me=epzs,me_range=32,mbd=rd,trellis,qpel,gmc,4mv,q=0.8")
+var tempDirFlag = flag.String("tempdir", os.TempDir(), "directory to write the intermediate AVI files to")
+var keepIntermediatesFlag = flag.Bool("keep-intermediates", false, "keep the intermediate AVI files instead of removing them")
+var profileFlag = flag.String("profile", "", "output profile to encode the output file with, one of "+profileNames()+" (default is chosen by the output file extension)")
+var outputOptsFlag = flag.String("output-opts", "", "comma-separated ffmpeg output options overriding the options of the output profile, like crf=23,preset=slow")
+var maxFrameSizeFlag = flag.Int("max-frame-size", int(moshpit.MaxChunkSize/1024/1024), "maximum size of a single AVI frame in MB, or 0 for no limit")
 
 const (
-	commandScenes = "scenes"
-	commandMosh   = "mosh"
-	commandExit   = "exit"
+	commandScenes    = "scenes"
+	commandMosh      = "mosh"
+	commandBloom     = "bloom"
+	commandSplice    = "splice"
+	commandFrames    = "frames"
+	commandExportAvi = "export-avi"
+	commandCache     = "cache"
+	commandExit      = "exit"
 )
 
+// inputSegment is the segment of the input file
+// selected using the -ss and -to options.
+var inputSegment moshpit.Segment
+
+// aviFormat is the format the input file is converted to,
+// selected using the -fps, -cfr, -size, -fit, -pix-fmt and -encoder options.
+var aviFormat moshpit.AviFormat
+
+// aviEncoding are the encoder settings the moshable AVI file is written
+// with, selected using the -encode-preset and -encode-opts options.
+var aviEncoding moshpit.AviEncodeOptions
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <input_file>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [options] <scenes|mosh|bloom|splice> -in <input_file> [...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [options] cache <list|prune|clear>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	if len(os.Args) < 2 {
-		fmt.Printf("Usage: %s [options] <input_file>\n", os.Args[0])
-		os.Exit(1)
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(exitUsage)
 	}
 
-	inputFilePath, err := filepath.Abs(os.Args[len(os.Args)-1])
-	if err != nil {
-		fmt.Printf("Error parsing input file path: %s\n", err.Error())
-		os.Exit(1)
+	var err error
+	if moshpit.MaxChunkSize, err = parseMaxFrameSize(*maxFrameSizeFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -max-frame-size option: %s\n", err.Error())
+		os.Exit(exitUsage)
 	}
 
-	inputFile, err := os.Open(inputFilePath)
+	videoStream, err := parseVideoStream(*streamFlag)
 	if err != nil {
-		fmt.Printf("Error opening input file: %s\n", err.Error())
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Invalid -stream option: %s\n", err.Error())
+		os.Exit(exitUsage)
+	}
+
+	if inputSegment, err = moshpit.ParseSegment(*startFlag, *endFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -ss or -to option: %s\n", err.Error())
+		os.Exit(exitUsage)
+	}
+
+	if *stitchFlag && inputSegment.IsZero() {
+		fmt.Fprintln(os.Stderr, "The -stitch option requires a segment selected using -ss or -to")
+		os.Exit(exitUsage)
+	}
+
+	if aviFormat, err = parseAviFormat(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid AVI format option: %s\n", err.Error())
+		os.Exit(exitUsage)
+	}
+
+	if aviEncoding, err = parseAviEncoding(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -encode-preset or -encode-opts option: %s\n", err.Error())
+		os.Exit(exitUsage)
+	}
+
+	if _, err := moshpit.ParseOutputOptions(*outputOptsFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -output-opts option: %s\n", err.Error())
+		os.Exit(exitUsage)
+	}
+	if *profileFlag != "" {
+		if _, err := moshpit.OutputProfileByName(*profileFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -profile option: %s\n", err.Error())
+			os.Exit(exitUsage)
+		}
 	}
 
 	// create a context that is cancelled when SIGINT is received
@@ -67,18 +143,81 @@ func main() {
 	if *ffmpegLogFlag != "" {
 		ffmpegLogPath, err = filepath.Abs(*ffmpegLogFlag)
 		if err != nil {
-			fmt.Printf("Error parsing log file path: %s\n", err.Error())
-			os.Exit(1)
+			fmt.Fprintf(os.Stderr, "Error parsing log file path: %s\n", err.Error())
+			os.Exit(exitFailure)
+		}
+	}
+
+	if err := os.MkdirAll(*tempDirFlag, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating temp directory: %s\n", err.Error())
+		os.Exit(exitFailure)
+	}
+
+	if !*noCacheFlag {
+		cacheDir := *cacheDirFlag
+		if cacheDir == "" {
+			if cacheDir, err = moshpit.DefaultCacheDir(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error finding cache directory, use the -cache-dir option: %s\n", err.Error())
+				os.Exit(exitFailure)
+			}
 		}
+		aviCache = moshpit.NewAviCache(cacheDir)
+		aviCache.MaxSize = int64(*cacheSizeFlag) * 1024 * 1024
+		aviCache.MaxAge = *cacheAgeFlag
+	}
+
+	// run a single command if it is given after the options
+	if _, ok := batchCommands[flag.Arg(0)]; ok {
+		os.Exit(runBatch(ctx, *ffmpegPathFlag, *ffprobePathFlag, ffmpegLogPath, videoStream, flag.Arg(0), flag.Args()[1:]))
 	}
 
-	promptLoop(ctx, inputFile, *ffmpegPathFlag, ffmpegLogPath)
+	inputFilePath, err := filepath.Abs(os.Args[len(os.Args)-1])
+	if err != nil {
+		console.Printf("Error parsing input file path: %s\n", err.Error())
+		os.Exit(exitFailure)
+	}
+
+	inputFile, err := os.Open(inputFilePath)
+	if err != nil {
+		console.Printf("Error opening input file: %s\n", err.Error())
+		os.Exit(exitFailure)
+	}
+
+	if err := listStreams(ctx, *ffprobePathFlag, inputFile, videoStream); err != nil {
+		console.Printf("Error: %s\n", err.Error())
+		os.Exit(exitFailure)
+	}
+
+	promptLoop(ctx, inputFile, *ffmpegPathFlag, *ffprobePathFlag, ffmpegLogPath, videoStream)
 }
 
-func promptLoop(ctx context.Context, file *os.File, ffmpegPath string, ffmpegLogPath string) {
+func promptLoop(ctx context.Context, file *os.File, ffmpegPath string, ffprobePath string, ffmpegLogPath string, videoStream int) {
 	completer := promptCompleter(nil)
 	var sceneTimes []moshpit.VideoTime
 
+	// the moshable AVI file written by the last mosh or frames command,
+	// which is kept to be inspected using the frames command,
+	// and the moshed AVI file written by the last mosh command,
+	// which is kept to be exported using the export-avi command
+	var intermediates moshpit.PipelineResult
+	defer func() {
+		removeAvi(intermediates.AviFile)
+		removeAvi(intermediates.MoshedFile)
+	}()
+	keep := func(result *moshpit.PipelineResult) {
+		if result == nil {
+			return
+		}
+		if result.AviFile != "" && result.AviFile != intermediates.AviFile {
+			removeAvi(intermediates.AviFile)
+			intermediates.AviFile = result.AviFile
+		}
+		if result.MoshedFile != "" && result.MoshedFile != intermediates.MoshedFile {
+			removeAvi(intermediates.MoshedFile)
+			intermediates.MoshedFile = result.MoshedFile
+		}
+	}
+
 	inputChan := make(chan string)
 
 	// make sure to show cursor before exiting
@@ -110,35 +249,77 @@ func promptLoop(ctx context.Context, file *os.File, ffmpegPath string, ffmpegLog
 			switch strings.ToLower(command) {
 			case commandScenes:
 				var err error
-				sceneTimes, err = cmdScenes(ctx, ffmpegPath, ffmpegLogPath, file, args)
+				sceneTimes, err = cmdScenes(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, file, videoStream, args)
 				select {
 				case <-ctx.Done():
 					return
 				default:
 				}
 				if err != nil {
-					fmt.Printf("Error: %s\n", err.Error())
+					console.Printf("Error: %s\n", err.Error())
 				}
 
 				// update the prompt completer
 				// to suggest the newly found scene times
 				completer = promptCompleter(sceneTimes)
 			case commandMosh:
-				err := cmdMosh(ctx, ffmpegPath, ffmpegLogPath, file, sceneTimes, args)
+				result, err := cmdMosh(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, file, videoStream, sceneTimes, args)
+				keep(result)
 				select {
 				case <-ctx.Done():
 					return
 				default:
 				}
 				if err != nil {
-					fmt.Printf("Error: %s\n", err.Error())
+					console.Printf("Error: %s\n", err.Error())
+				}
+			case commandBloom:
+				result, err := cmdBloom(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, file, videoStream, args)
+				keep(result)
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+				if err != nil {
+					console.Printf("Error: %s\n", err.Error())
+				}
+			case commandSplice:
+				result, err := cmdSplice(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, file, videoStream, args)
+				keep(result)
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+				if err != nil {
+					console.Printf("Error: %s\n", err.Error())
+				}
+			case commandFrames:
+				framesAviFileName, err := cmdFrames(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, file, videoStream, intermediates.AviFile, args)
+				keep(&moshpit.PipelineResult{AviFile: framesAviFileName})
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+				if err != nil {
+					console.Printf("Error: %s\n", err.Error())
+				}
+			case commandExportAvi:
+				if err := cmdExportAvi(intermediates.MoshedFile, args); err != nil {
+					console.Printf("Error: %s\n", err.Error())
+				}
+			case commandCache:
+				if _, err := cmdCache(args); err != nil {
+					console.Printf("Error: %s\n", err.Error())
 				}
 			case commandExit:
 				return
 			case "":
 				// do nothing
 			default:
-				fmt.Printf("Unknown command: \"%s\"\n", command)
+				console.Printf("Unknown command: \"%s\"\n", command)
 			}
 
 		case <-ctx.Done():
@@ -151,6 +332,11 @@ func promptCompleter(sceneTimes []moshpit.VideoTime) prompt.Completer {
 	commands := []prompt.Suggest{
 		{Text: commandScenes, Description: "Finds scene changes in the video file"},
 		{Text: commandMosh, Description: "Applies a datamoshing effect to the video file at the given timestamps, and writes them to an output file"},
+		{Text: commandBloom, Description: "Repeats P-Frames of the video file to smear their motion across the picture, and writes them to an output file"},
+		{Text: commandSplice, Description: "Applies the motion of another video file to the video file at the given frames, and writes them to an output file"},
+		{Text: commandFrames, Description: "Lists the frame types of the moshable AVI file"},
+		{Text: commandExportAvi, Description: "Exports the moshed AVI file written by the last mosh, bloom or splice command"},
+		{Text: commandCache, Description: "Lists, prunes or clears the cached moshable AVI files"},
 		{Text: commandExit, Description: "Exits moshpit"},
 	}
 
@@ -188,9 +374,71 @@ func promptCompleter(sceneTimes []moshpit.VideoTime) prompt.Completer {
 	})
 }
 
-func cmdScenes(ctx context.Context, ffmpegPath string, ffmpegLogPath string, file *os.File, args []string) ([]moshpit.VideoTime, error) {
-	if len(args) != 1 {
-		return nil, errors.New("usage: scenes <threshold>")
+// parseVideoStream parses the index of a video stream among the video
+// streams of the input file, given as a stream specifier like v:1 or an index.
+func parseVideoStream(spec string) (int, error) {
+	index, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(spec), "v:"), 10, 31)
+	if err != nil {
+		return 0, fmt.Errorf(`"%s" is not a valid video stream, must be in the format v:<index>`, spec)
+	}
+	return int(index), nil
+}
+
+// parseMaxFrameSize converts the maximum frame size in MB
+// to the maximum chunk size in bytes, with 0 being no limit.
+func parseMaxFrameSize(mb int) (uint32, error) {
+	if mb < 0 || uint64(mb) > math.MaxUint32/(1<<20) {
+		return 0, fmt.Errorf("the maximum frame size must be between 0 and %d MB", math.MaxUint32/(1<<20))
+	}
+	return uint32(uint64(mb) * (1 << 20)), nil
+}
+
+// listStreams probes the input file and prints its streams,
+// highlighting the selected video stream.
+// It returns an error if the input file does not have the selected video stream.
+func listStreams(ctx context.Context, ffprobePath string, file *os.File, videoStream int) error {
+	info, err := moshpit.Probe(ctx, ffprobePath, file.Name())
+	if err != nil {
+		return fmt.Errorf("error probing input file: %s", err.Error())
+	}
+
+	console.Printf("Streams of %s:\n", filepath.Base(file.Name()))
+	for _, stream := range info.Streams {
+		var description string
+		switch stream.Type {
+		case "video":
+			description = fmt.Sprintf("%s, %dx%d, %.4g fps, %d frames",
+				stream.CodecName, stream.Width, stream.Height, stream.FrameRate(), stream.FrameCount)
+		case "audio":
+			description = fmt.Sprintf("%s, %d Hz, %d channels", stream.CodecName, stream.SampleRate, stream.Channels)
+		default:
+			description = fmt.Sprintf("%s %s", stream.Type, stream.CodecName)
+		}
+
+		if stream.Type == "video" && stream.TypeIndex == videoStream {
+			console.Printf("[green]> %-4s #%d %s[reset]\n", stream.StreamSpecifier(), stream.Index, description)
+		} else {
+			console.Printf("  %-4s #%d %s\n", stream.StreamSpecifier(), stream.Index, description)
+		}
+	}
+	if !inputSegment.IsZero() {
+		console.Printf("Processing segment [cyan]%s[reset]\n", inputSegment)
+	}
+	if !aviFormat.IsZero() {
+		console.Printf("Converting to [cyan]%s[reset]\n", aviFormat)
+	}
+	console.Println("")
+
+	if info.VideoStream(videoStream) == nil {
+		return fmt.Errorf("input file does not have a video stream v:%d", videoStream)
+	}
+	return nil
+}
+
+func cmdScenes(ctx context.Context, ffmpegPath string, ffprobePath string, ffmpegLogPath string, file *os.File, videoStream int, args []string) ([]moshpit.VideoTime, error) {
+	usage := errors.New("usage: scenes <threshold> [-o <file>]")
+	if len(args) != 1 && len(args) != 3 {
+		return nil, usage
 	}
 
 	threshold, err := strconv.ParseFloat(args[0], 64)
@@ -198,226 +446,782 @@ func cmdScenes(ctx context.Context, ffmpegPath string, ffmpegLogPath string, fil
 		return nil, errors.New("threshold must be a valid floating point number")
 	}
 
-	sceneTimeChan := make(chan moshpit.VideoTime)
-	progressChan := make(chan float64)
-	errorChan := make(chan error)
-	go moshpit.FindScenes(ctx, ffmpegPath, ffmpegLogPath, file.Name(), threshold, sceneTimeChan, progressChan, errorChan)
+	// parse and validate the file to export the scene changes to
+	var exportFilePath string
+	if len(args) == 3 {
+		if args[1] != "-o" {
+			return nil, usage
+		}
+		exportFilePath, err = filepath.Abs(args[2])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing export file path: %s", err.Error())
+		}
+		if _, err := moshpit.SceneFormatForFile(exportFilePath); err != nil {
+			return nil, err
+		}
+	}
 
 	// always write a newline before returning to ensure
 	// following command line output is written in the next line
-	defer fmt.Println("")
+	defer console.Println("")
 
 	bar := newDefaultFloatProgressBar("Detecting scene changes...")
 	bar.RenderBlank()
-	var sceneTimes []moshpit.VideoTime
-	for {
-		select {
-		case err, ok := <-errorChan:
-			if !ok {
-				bar.Clear()
-				ansi.Printf(colorstring.Color("Found [green]%d[reset] scene changes."), len(sceneTimes))
-				if len(sceneTimes) == 0 {
-					fmt.Println()
-					ansi.Print(colorstring.Color("Try using a lower threshold value."))
-				}
-				return sceneTimes, nil
+	sceneTimes, err := moshpit.FindScenesSync(ctx, ffmpegPath, ffprobePath, ffmpegLogPath,
+		file.Name(), videoStream, inputSegment, aviFormat, threshold, moshpit.ObserverFunc(func(event moshpit.Event) {
+			if event.Type != moshpit.EventResult {
+				bar.Observe(event)
+				return
 			}
-			return sceneTimes, err
-		case sceneTime := <-sceneTimeChan:
-			sceneTimes = append(sceneTimes, sceneTime)
+			sceneTime := event.Result.(moshpit.VideoTime)
 
 			// erase progress bar
 			bar.Clear()
 
-			colorstring.Fprintf(ansi.NewAnsiStdout(),
+			console.Printf(
 				"Found scene change at [cyan]%s[reset] (frame [red]%d[reset])",
 				sceneTime.Timecode(), sceneTime.Frame)
-			fmt.Println()
+			console.Println("")
 
 			// rewrite progress bar
 			bar.RenderBlank()
-		case progress := <-progressChan:
-			bar.SetProgress(progress)
+		}))
+	if err != nil {
+		return sceneTimes, err
+	}
+
+	bar.Clear()
+	console.Printf("Found [green]%d[reset] scene changes.", len(sceneTimes))
+	if len(sceneTimes) == 0 {
+		console.Println("")
+		console.Print("Try using a lower threshold value.")
+	}
+	if exportFilePath != "" {
+		if err := exportScenes(exportFilePath, file.Name(), sceneTimes); err != nil {
+			return sceneTimes, err
+		}
+		console.Println("")
+		console.Printf("Exported scene changes to [cyan]%s[reset].", exportFilePath)
+	}
+	return sceneTimes, nil
+}
+
+// exportScenes writes the scene changes found in the input file
+// to the export file, using the format matching its extension.
+func exportScenes(exportFilePath string, inputFileName string, sceneTimes []moshpit.VideoTime) error {
+	format, err := moshpit.SceneFormatForFile(exportFilePath)
+	if err != nil {
+		return err
+	}
+
+	exportFile, err := os.Create(exportFilePath)
+	if err != nil {
+		return fmt.Errorf("error creating export file: %s", err.Error())
+	}
+	defer exportFile.Close()
+
+	if err := moshpit.ExportScenes(exportFile, format, filepath.Base(inputFileName), sceneTimes); err != nil {
+		return fmt.Errorf("error exporting scene changes: %s", err.Error())
+	}
+	return exportFile.Close()
+}
+
+// importFrames reads the frame indices listed in the file,
+// using the format matching its extension.
+func importFrames(fileName string, fps float64) ([]uint64, error) {
+	format, err := moshpit.SceneFormatForFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %s", err.Error())
+	}
+	defer f.Close()
+
+	return moshpit.ImportFrames(f, format, fps)
+}
+
+// parseFrameSpec expands the frame specification,
+// using the frame rate and count of the video stream if it has been probed.
+func parseFrameSpec(spec string, video *moshpit.StreamInfo, sceneTimes []moshpit.VideoTime) ([]uint64, error) {
+	if video == nil {
+		return moshpit.ParseFrameSpec(spec, 0, 0, sceneTimes)
+	}
+	return moshpit.ParseFrameSpec(spec, aviFormat.VideoFrameRate(video), aviFormat.VideoFrameCount(video), sceneTimes)
+}
+
+// uniqueFrames returns the sorted frame indices without duplicates.
+func uniqueFrames(frames []uint64) []uint64 {
+	sort.Slice(frames, func(i, j int) bool {
+		return frames[i] < frames[j]
+	})
+	unique := frames[:0]
+	for _, frame := range frames {
+		if len(unique) == 0 || frame != unique[len(unique)-1] {
+			unique = append(unique, frame)
 		}
 	}
+	return unique
 }
 
-func cmdMosh(ctx context.Context, ffmpegPath string, ffmpegLogPath string, file *os.File,
-	sceneTimes []moshpit.VideoTime, args []string) error {
+// cmdMosh moshes the input file, returning the
+// intermediate AVI files it has written.
+func cmdMosh(ctx context.Context, ffmpegPath string, ffprobePath string, ffmpegLogPath string, file *os.File, videoStream int,
+	sceneTimes []moshpit.VideoTime, args []string) (*moshpit.PipelineResult, error) {
 	if len(args) < 2 {
-		return errors.New("usage: mosh <output> <frame> [...]")
+		return nil, errors.New("usage: mosh <output> <frames|@file> [...]")
 	}
 
 	// parse and validate output file path
 	outputFilePath, err := filepath.Abs(args[0])
 	if err != nil {
-		return fmt.Errorf("error parsing output file path: %s", err.Error())
+		return nil, fmt.Errorf("error parsing output file path: %s", err.Error())
 	}
 
-	if filepath.Ext(outputFilePath) != ".mp4" {
-		return errors.New("output file must have the .mp4 extension")
+	profile, err := outputProfile(outputFilePath)
+	if err != nil {
+		return nil, err
 	}
 
-	// parse and validate frame indices to mosh
+	// the input file is only probed if its video stream is
+	// required to convert timecodes, times or offsets to frame indices
+	var video *moshpit.StreamInfo
+	probeVideo := func() error {
+		if video != nil {
+			return nil
+		}
+		info, err := moshpit.Probe(ctx, ffprobePath, file.Name())
+		if err != nil {
+			return fmt.Errorf("error probing input file: %s", err.Error())
+		}
+		if video = info.VideoStream(videoStream); video == nil {
+			return fmt.Errorf("input file does not have a video stream v:%d", videoStream)
+		}
+		return nil
+	}
+
+	// parse and validate frames to mosh
 	var moshFrames []uint64
 	for _, arg := range args[1:] {
-		if arg == "all" {
-			// add all previously detected scene changes
-			// to the slice of frames to mosh
-			if len(sceneTimes) == 0 {
-				fmt.Printf(`WARNING: option "all": no scene changes were previously found\n`)
-				continue
-			}
-			for _, sceneTime := range sceneTimes {
-				moshFrames = append(moshFrames, sceneTime.Frame)
+		var frames []uint64
+		if strings.HasPrefix(arg, "@") {
+			// add the frames listed in the file
+			if err := probeVideo(); err != nil {
+				return nil, err
 			}
+			frames, err = importFrames(arg[1:], aviFormat.VideoFrameRate(video))
 		} else {
-			frame, err := strconv.ParseUint(arg, 10, 64)
-			if err != nil {
-				fmt.Printf(`WARNING: option "%s" is not a valid frame index\n`, arg)
-				continue
+			frames, err = parseFrameSpec(arg, video, sceneTimes)
+			if errors.Is(err, moshpit.ErrNoFrameRate) || errors.Is(err, moshpit.ErrNoFrameCount) {
+				if err := probeVideo(); err != nil {
+					return nil, err
+				}
+				frames, err = parseFrameSpec(arg, video, sceneTimes)
 			}
-			moshFrames = append(moshFrames, frame)
 		}
+		if err != nil {
+			console.Printf("WARNING: option \"%s\": %s\n", arg, err.Error())
+			continue
+		}
+		moshFrames = append(moshFrames, frames...)
 	}
 
 	if len(moshFrames) == 0 {
-		return errors.New("no valid frames to mosh were specified")
+		return nil, errors.New("no valid frames to mosh were specified")
 	}
+	moshFrames = uniqueFrames(moshFrames)
 
 	// keep track of execution time
 	startTime := time.Now()
 
-	aviFileName, err := convertToAvi(ctx, ffmpegPath, ffmpegLogPath, file, moshFrames)
+	p := newPipeline(ffmpegPath, ffprobePath, ffmpegLogPath, file, videoStream,
+		outputFilePath, profile, moshpit.RemoveFramesMosh(moshFrames), moshFrames)
+	result, err := runPipeline(ctx, p, 1, 3)
 	if err != nil {
-		return err
+		return result, err
 	}
-	defer os.Remove(aviFileName)
 
-	moshedFileName, err := moshAvi(ctx, aviFileName, moshFrames)
+	console.Printf("Moshing took [green]%s[reset].\n", time.Since(startTime).Round(time.Second))
+	return result, nil
+}
+
+// cmdBloom repeats P-Frames of the input file, returning
+// the intermediate AVI files it has written.
+func cmdBloom(ctx context.Context, ffmpegPath string, ffprobePath string, ffmpegLogPath string, file *os.File, videoStream int,
+	args []string) (*moshpit.PipelineResult, error) {
+	if len(args) < 2 {
+		return nil, errors.New("usage: bloom <output> <frame>x<count> [...] [stretch]")
+	}
+
+	// parse and validate output file path
+	outputFilePath, err := filepath.Abs(args[0])
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("error parsing output file path: %s", err.Error())
 	}
-	defer os.Remove(moshedFileName)
 
-	if err := bake(ctx, ffmpegPath, ffmpegLogPath, file.Name(), moshedFileName, outputFilePath); err != nil {
-		return err
+	profile, err := outputProfile(outputFilePath)
+	if err != nil {
+		return nil, err
 	}
 
-	fmt.Printf(colorstring.Color("Moshing took [green]%s[reset].\n"), time.Since(startTime).Round(time.Second))
-	return nil
+	// parse and validate the frames to repeat
+	repetitions := make(map[uint64]uint)
+	keepDuration := true
+	for _, arg := range args[1:] {
+		if arg == "stretch" {
+			keepDuration = false
+			continue
+		}
+
+		spl := strings.SplitN(arg, "x", 2)
+		if len(spl) != 2 {
+			console.Printf("WARNING: option \"%s\" does not have the format <frame>x<count>\n", arg)
+			continue
+		}
+		frame, err := strconv.ParseUint(spl[0], 10, 64)
+		if err != nil {
+			console.Printf("WARNING: option \"%s\" does not have a valid frame index\n", arg)
+			continue
+		}
+		count, err := strconv.ParseUint(spl[1], 10, 32)
+		if err != nil || count == 0 {
+			console.Printf("WARNING: option \"%s\" does not have a valid repetition count\n", arg)
+			continue
+		}
+		repetitions[frame] = uint(count)
+	}
+
+	if len(repetitions) == 0 {
+		return nil, errors.New("no valid frames to repeat were specified")
+	}
+
+	// keep track of execution time
+	startTime := time.Now()
+
+	// only place an I-Frame at the start of the video,
+	// so the repeated motion is never reset by an I-Frame
+	p := newPipeline(ffmpegPath, ffprobePath, ffmpegLogPath, file, videoStream,
+		outputFilePath, profile, moshpit.DuplicateFramesMosh(repetitions, keepDuration), []uint64{0})
+	result, err := runPipeline(ctx, p, 1, 3)
+	if err != nil {
+		return result, err
+	}
+
+	console.Printf("Moshing took [green]%s[reset].\n", time.Since(startTime).Round(time.Second))
+	return result, nil
 }
 
-func convertToAvi(ctx context.Context, ffmpegPath string, ffmpegLogPath string, file *os.File, moshFrames []uint64) (string, error) {
-	// convert input file to AVI with I-Frames at the given frame indices.
-	// generate file name for temporary AVI file
-	uid, err := uuid.NewV4()
+// cmdSplice applies the motion of a second file to the input file,
+// returning the intermediate AVI files it has written.
+func cmdSplice(ctx context.Context, ffmpegPath string, ffprobePath string, ffmpegLogPath string, file *os.File, videoStream int,
+	args []string) (*moshpit.PipelineResult, error) {
+	if len(args) < 3 {
+		return nil, errors.New("usage: splice <output> <motion_file> <frame>[:<source>[:<length>]] [...]")
+	}
+
+	// parse and validate output file path
+	outputFilePath, err := filepath.Abs(args[0])
 	if err != nil {
-		return "", fmt.Errorf("could not generate temp file name: %s", err.Error())
+		return nil, fmt.Errorf("error parsing output file path: %s", err.Error())
 	}
-	aviFileName := path.Join(os.TempDir(), fmt.Sprintf("%s.avi", uid.String()))
 
-	progressChan := make(chan float64)
-	errorChan := make(chan error)
-	go moshpit.ConvertToAvi(ctx, ffmpegPath, ffmpegLogPath, file.Name(), aviFileName, 1, moshFrames, progressChan, errorChan)
+	profile, err := outputProfile(outputFilePath)
+	if err != nil {
+		return nil, err
+	}
 
-	// always write a newline before returning to ensure
-	// following command line output is written in the next line
-	defer fmt.Println("")
+	// open the file to take the motion from
+	motionFilePath, err := filepath.Abs(args[1])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing motion file path: %s", err.Error())
+	}
+	motionFile, err := os.Open(motionFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening motion file: %s", err.Error())
+	}
+	defer motionFile.Close()
 
-	bar := newDefaultFloatProgressBar("[cyan][1/3][reset] Writing moshable file...")
-	bar.RenderBlank()
-	for {
-		select {
-		case err, ok := <-errorChan:
-			if !ok {
-				// processing has finished
-				bar.Clear()
-				ansi.Print(colorstring.Color("[cyan][1/3][reset] Wrote AVI file for moshing."))
-				return aviFileName, nil
-			}
-			os.Remove(aviFileName)
-			return "", fmt.Errorf("error writing AVI file: %s", err.Error())
-		case progress := <-progressChan:
-			bar.SetProgress(progress)
+	// parse and validate splice points
+	var splicePoints []moshpit.SplicePoint
+	for _, arg := range args[2:] {
+		splicePoint, err := parseSplicePoint(arg)
+		if err != nil {
+			console.Printf("WARNING: %s\n", err.Error())
+			continue
 		}
+		splicePoints = append(splicePoints, splicePoint)
 	}
+
+	if len(splicePoints) == 0 {
+		return nil, errors.New("no valid splice points were specified")
+	}
+
+	// keep track of execution time
+	startTime := time.Now()
+
+	// only place I-Frames at the start of the videos,
+	// so the spliced motion is never reset by an I-Frame
+	motionAviFileName, err := convertToAvi(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, motionFile, 0, moshpit.Segment{}, []uint64{0}, "[cyan][1/4][reset] ")
+	if err != nil {
+		return nil, err
+	}
+	defer removeAvi(motionAviFileName)
+
+	p := newPipeline(ffmpegPath, ffprobePath, ffmpegLogPath, file, videoStream,
+		outputFilePath, profile, moshpit.SpliceFramesMosh(motionAviFileName, splicePoints), []uint64{0})
+	result, err := runPipeline(ctx, p, 2, 4)
+	if err != nil {
+		return result, err
+	}
+
+	console.Printf("Moshing took [green]%s[reset].\n", time.Since(startTime).Round(time.Second))
+	return result, nil
 }
 
-func moshAvi(ctx context.Context, aviFileName string, moshFrames []uint64) (string, error) {
-	// remove I-Frames from the AVI file for the datamoshing effect
+// parseSplicePoint parses a splice point
+// in the format <frame>[:<source>[:<length>]].
+func parseSplicePoint(arg string) (moshpit.SplicePoint, error) {
+	var values [3]uint64
+	spl := strings.Split(arg, ":")
+	if len(spl) > len(values) {
+		return moshpit.SplicePoint{}, fmt.Errorf(`option "%s" is not a valid splice point`, arg)
+	}
+	for i, v := range spl {
+		var err error
+		values[i], err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return moshpit.SplicePoint{}, fmt.Errorf(`option "%s" is not a valid splice point`, arg)
+		}
+	}
+
+	return moshpit.SplicePoint{
+		Frame:  values[0],
+		Source: values[1],
+		Length: values[2],
+	}, nil
+}
+
+// cmdFrames lists the frames of the moshable AVI file,
+// which is written if aviFileName is empty.
+// It returns the name of the AVI file it has analyzed.
+func cmdFrames(ctx context.Context, ffmpegPath string, ffprobePath string, ffmpegLogPath string, file *os.File, videoStream int,
+	aviFileName string, args []string) (string, error) {
+	if len(args) > 1 {
+		return "", errors.New("usage: frames [<start>-<end>]")
+	}
+
+	// parse the range of frames to list
+	var start, end uint64 = 0, math.MaxUint64
+	if len(args) == 1 {
+		var err error
+		start, end, err = parseFrameRange(args[0])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if aviFileName == "" {
+		// write a moshable AVI file with automatically placed I-Frames
+		var err error
+		aviFileName, err = convertToAvi(ctx, ffmpegPath, ffprobePath, ffmpegLogPath, file, videoStream, inputSegment, nil, "")
+		if err != nil {
+			return "", err
+		}
+	}
+
 	aviFile, err := os.Open(aviFileName)
 	if err != nil {
-		return "", fmt.Errorf("could not open AVI file for datamoshing: %s", err.Error())
+		return aviFileName, fmt.Errorf("could not open AVI file: %s", err.Error())
 	}
 	defer aviFile.Close()
 
-	// create output file for moshed AVI
-	uid, err := uuid.NewV4()
+	allFrames, err := moshpit.AnalyzeFramesSync(ctx, aviFile, nil)
 	if err != nil {
-		return "", fmt.Errorf("could not generate temp file name: %s", err.Error())
+		return aviFileName, fmt.Errorf("error analyzing AVI file: %s", err.Error())
+	}
+
+	if !inputSegment.IsZero() {
+		// list the frames of the segment relative to the start of the input file
+		info, err := moshpit.Probe(ctx, ffprobePath, file.Name())
+		if err != nil {
+			return aviFileName, fmt.Errorf("error probing input file: %s", err.Error())
+		}
+		video := info.VideoStream(videoStream)
+		if video == nil {
+			return aviFileName, fmt.Errorf("input file does not have a video stream v:%d", videoStream)
+		}
+		firstFrame, err := inputSegment.FirstFrame(aviFormat.VideoFrameRate(video))
+		if err != nil {
+			return aviFileName, err
+		}
+		for i := range allFrames {
+			allFrames[i].Index += firstFrame
+			allFrames[i].Timestamp += inputSegment.Start
+		}
 	}
-	moshedFileName := path.Join(os.TempDir(), fmt.Sprintf("%s.avi", uid.String()))
-	moshedFile, err := os.Create(moshedFileName)
+
+	var frames []moshpit.FrameInfo
+	var keyframes []moshpit.FrameInfo
+	counts := make(map[moshpit.FrameType]int)
+	var totalSize uint64
+	for _, frame := range allFrames {
+		if frame.Index < start || frame.Index > end {
+			continue
+		}
+		frames = append(frames, frame)
+		counts[frame.Type]++
+		totalSize += uint64(frame.Size)
+		if frame.Type == moshpit.IFrame {
+			keyframes = append(keyframes, frame)
+		}
+	}
+
+	if len(frames) == 0 {
+		console.Println("No frames in the given range.")
+		return aviFileName, nil
+	}
+
+	printFramePattern(frames)
+	if len(args) == 1 {
+		printFrameTable(frames)
+	}
+
+	console.Println("")
+	console.Printf("Listed [green]%d[reset] frames (%s) with a total size of %s.\n",
+		len(frames), formatFrameCounts(counts), formatBytes(totalSize))
+	var positions []string
+	for _, f := range keyframes {
+		positions = append(positions, console.Color(fmt.Sprintf("[red]%d[reset] (%s)", f.Index, formatTimestamp(f.Timestamp))))
+	}
+	console.Printf("Keyframes: %s\n", strings.Join(positions, ", "))
+	return aviFileName, nil
+}
+
+// formatFrameCounts formats the number of frames of each type,
+// always listing I-, P- and B-Frames and the other types if there are any.
+func formatFrameCounts(counts map[moshpit.FrameType]int) string {
+	var parts []string
+	for _, t := range []moshpit.FrameType{moshpit.IFrame, moshpit.PFrame, moshpit.BFrame,
+		moshpit.SFrame, moshpit.NotCodedFrame, moshpit.DroppedFrame, moshpit.Unknown} {
+		count := counts[t]
+		switch t {
+		case moshpit.IFrame:
+			parts = append(parts, fmt.Sprintf("[red]%d[reset] %s", count, t))
+		case moshpit.BFrame:
+			parts = append(parts, fmt.Sprintf("[cyan]%d[reset] %s", count, t))
+		case moshpit.PFrame:
+			parts = append(parts, fmt.Sprintf("%d %s", count, t))
+		default:
+			if count > 0 {
+				parts = append(parts, fmt.Sprintf("%d %s", count, t))
+			}
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// cmdExportAvi copies the moshed AVI file written by
+// the last mosh, bloom or splice command to the output file.
+func cmdExportAvi(moshedFileName string, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return errors.New("usage: export-avi <output>")
+	}
+	if moshedFileName == "" {
+		return errors.New("no moshed AVI file has been written yet, use the mosh, bloom or splice command first")
+	}
+
+	outputFilePath, err := filepath.Abs(args[0])
 	if err != nil {
-		return "", fmt.Errorf("could not create AVI file for datamoshing: %s", err.Error())
+		return fmt.Errorf("error parsing output file path: %s", err.Error())
+	}
+	if !strings.EqualFold(filepath.Ext(outputFilePath), ".avi") {
+		return errors.New("output file must have the .avi extension")
 	}
-	defer moshedFile.Close()
 
-	processedChan := make(chan uint64)
-	errorChan := make(chan error)
-	go moshpit.RemoveFrames(ctx, aviFile, moshedFile, moshFrames, processedChan, errorChan)
+	if err := moshpit.ExportAvi(moshedFileName, outputFilePath); err != nil {
+		return fmt.Errorf("error exporting AVI file: %s", err.Error())
+	}
+	console.Printf("Exported moshed AVI file to [cyan]%s[reset].\n", outputFilePath)
+	return nil
+}
 
-	// always write a newline before returning to ensure
-	// following command line output is written in the next line
-	defer fmt.Println("")
+// parseFrameRange parses a range of frame indices
+// in the format <start>-<end> or <frame>.
+func parseFrameRange(arg string) (uint64, uint64, error) {
+	spl := strings.SplitN(arg, "-", 2)
+	start, err := strconv.ParseUint(spl[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf(`"%s" is not a valid frame range`, arg)
+	}
+	if len(spl) == 1 {
+		return start, start, nil
+	}
 
-	bar := newDefaultFloatProgressBar("[cyan][2/3][reset] Moshing AVI file...")
-	bar.RenderBlank()
-	for {
-		select {
-		case err, ok := <-errorChan:
-			if !ok {
-				// processing has finished
-				bar.Clear()
-				ansi.Print(colorstring.Color("[cyan][2/3][reset] Moshed AVI file."))
-				return moshedFileName, nil
+	end, err := strconv.ParseUint(spl[1], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, fmt.Errorf(`"%s" is not a valid frame range`, arg)
+	}
+	return start, end, nil
+}
+
+// the number of frames printed per line of the frame pattern
+const framePatternLineLength = 50
+
+// printFramePattern prints the types of the frames
+// as a sequence of letters, highlighting I- and B-Frames.
+func printFramePattern(frames []moshpit.FrameInfo) {
+	for i, frame := range frames {
+		if i%framePatternLineLength == 0 {
+			if i > 0 {
+				console.Println("")
 			}
-			os.Remove(moshedFileName)
-			return "", fmt.Errorf("error moshing AVI file: %s", err.Error())
-		case _ = <-processedChan:
-			bar.SetProgress(0.5) // TODO: proper progress
+			console.Printf("%8d ", frame.Index)
+		} else if i%10 == 0 {
+			console.Print(" ")
+		}
+
+		switch frame.Type {
+		case moshpit.IFrame:
+			console.Print("[red]" + frame.Type.String())
+		case moshpit.BFrame:
+			console.Print("[cyan]" + frame.Type.String())
+		default:
+			console.Print(frame.Type.String())
 		}
 	}
+	console.Println("")
 }
 
-func bake(ctx context.Context, ffmpegPath string, ffmpegLogPath string, originalFileName string,
-	moshedFileName string, outputFileName string) error {
+// printFrameTable prints the index, timestamp, type and size of each frame.
+func printFrameTable(frames []moshpit.FrameInfo) {
+	console.Println("")
+	console.Printf("%8s  %12s  %4s  %10s\n", "frame", "time", "type", "size")
+	for _, frame := range frames {
+		console.Printf("%8d  %12s  %4s  %10s\n", frame.Index,
+			formatTimestamp(frame.Timestamp), frame.Type.String(), formatBytes(uint64(frame.Size)))
+	}
+}
+
+func formatTimestamp(t time.Duration) string {
+	return t.Round(time.Millisecond).String()
+}
 
-	// convert avi to output mp4
-	progressChan := make(chan float64)
-	errorChan := make(chan error)
-	go moshpit.ConvertToMp4(ctx, ffmpegPath, ffmpegLogPath,
-		moshedFileName, originalFileName, outputFileName,
-		1, progressChan, errorChan)
+func formatBytes(bytes uint64) string {
+	switch {
+	case bytes >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/1024/1024)
+	case bytes >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(bytes)/1024)
+	default:
+		return fmt.Sprintf("%d B", bytes)
+	}
+}
 
+func convertToAvi(ctx context.Context, ffmpegPath string, ffprobePath string, ffmpegLogPath string, file *os.File, videoStream int,
+	segment moshpit.Segment, moshFrames []uint64, step string) (string, error) {
 	// always write a newline before returning to ensure
 	// following command line output is written in the next line
-	defer fmt.Println("")
+	defer console.Println("")
 
-	bar := newDefaultFloatProgressBar("[cyan][3/3][reset] Baking output file...")
+	bar := newDefaultFloatProgressBar(step + "Writing moshable file...")
 	bar.RenderBlank()
-	for {
-		select {
-		case err, ok := <-errorChan:
-			if !ok {
-				bar.Clear()
-				ansi.Print(colorstring.Color("[cyan][3/3][reset] Baked output file."))
-				return nil
-			}
-			return fmt.Errorf("error writing output file: %s", err.Error())
-		case progress := <-progressChan:
-			bar.SetProgress(progress)
+	observer := cachedAviObserver(bar)
+
+	// convert input file to AVI with I-Frames at the given frame indices.
+	var aviFileName string
+	var err error
+	if aviCache != nil {
+		aviFileName, err = aviCache.ConvertToAvi(ctx, ffmpegPath, ffprobePath, ffmpegLogPath,
+			file.Name(), videoStream, segment, aviFormat, *tempDirFlag, moshpit.ProjectName(file.Name()), aviEncoding, moshFrames, observer)
+	} else {
+		// create a temporary AVI file named after the input file
+		var f *os.File
+		if f, err = ioutil.TempFile(*tempDirFlag, moshpit.ProjectName(file.Name())+"-converted-*.avi"); err != nil {
+			return "", fmt.Errorf("could not create temp file: %s", err.Error())
+		}
+		f.Close()
+		aviFileName = f.Name()
+		err = moshpit.ConvertToAviSync(ctx, ffmpegPath, ffprobePath, ffmpegLogPath,
+			file.Name(), videoStream, segment, aviFormat, aviFileName, aviEncoding, moshFrames, observer)
+	}
+	if err != nil {
+		removeAvi(aviFileName)
+		return "", fmt.Errorf("error writing AVI file: %s", err.Error())
+	}
+
+	bar.Clear()
+	console.Print(step + observer.message("Wrote AVI file for moshing."))
+	return aviFileName, nil
+}
+
+// outputProfile returns the output profile selected using the -profile option,
+// or the default profile for the extension of the output file,
+// with the options given using the -output-opts option.
+func outputProfile(outputFilePath string) (*moshpit.OutputProfile, error) {
+	var profile *moshpit.OutputProfile
+	var err error
+	if *profileFlag != "" {
+		profile, err = moshpit.OutputProfileByName(*profileFlag)
+	} else {
+		profile, err = moshpit.OutputProfileForFile(outputFilePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !profile.Supports(outputFilePath) {
+		return nil, fmt.Errorf("output file of the %s profile must have the %s extension",
+			profile.Name, strings.Join(profile.Extensions, " or "))
+	}
+
+	options, err := moshpit.ParseOutputOptions(*outputOptsFlag)
+	if err != nil {
+		return nil, err
+	}
+	return profile.WithOptions(options), nil
+}
+
+// parseAviFormat returns the format the input file is converted to,
+// selected using the -fps, -cfr, -size, -fit, -pix-fmt and -encoder options.
+func parseAviFormat() (moshpit.AviFormat, error) {
+	format := moshpit.AviFormat{
+		ConstantFrameRate: *cfrFlag,
+		PixelFormat:       *pixFmtFlag,
+	}
+	var err error
+	if *fpsFlag != "" {
+		if format.FrameRate, err = moshpit.ParseFrameRate(*fpsFlag); err != nil {
+			return moshpit.AviFormat{}, err
+		}
+	}
+	if *sizeFlag != "" {
+		if format.Width, format.Height, err = moshpit.ParseSize(*sizeFlag); err != nil {
+			return moshpit.AviFormat{}, err
 		}
+		if format.Width%2 != 0 || format.Height%2 != 0 {
+			return moshpit.AviFormat{}, errors.New("the width and height must be even")
+		}
+	}
+	if format.Fit, err = moshpit.ParseFit(*fitFlag); err != nil {
+		return moshpit.AviFormat{}, err
+	}
+	if format.Encoder, err = moshpit.ParseEncoder(*encoderFlag); err != nil {
+		return moshpit.AviFormat{}, err
+	}
+	return format, nil
+}
+
+// parseAviEncoding returns the encoder settings selected using
+// the -encode-preset and -encode-opts options.
+func parseAviEncoding() (moshpit.AviEncodeOptions, error) {
+	options := moshpit.AviEncodeOptions{Quality: 1}
+	if *encodePresetFlag != "" {
+		var err error
+		if options, err = moshpit.AviEncodePresetByName(*encodePresetFlag); err != nil {
+			return moshpit.AviEncodeOptions{}, err
+		}
+	}
+	options, err := moshpit.ParseAviEncodeOptions(*encodeOptsFlag, options)
+	if err != nil {
+		return moshpit.AviEncodeOptions{}, err
+	}
+	if options.GlobalMotion && aviFormat.Encoder != moshpit.EncoderXvid {
+		return moshpit.AviEncodeOptions{}, fmt.Errorf("gmc requires the %s encoder, use -encoder %s",
+			moshpit.EncoderXvid, moshpit.EncoderXvid)
+	}
+	return options, nil
+}
+
+// encodePresetNames returns the names of the encode presets
+// to list them in the usage of the -encode-preset option.
+func encodePresetNames() string {
+	var names []string
+	for _, preset := range moshpit.AviEncodePresets() {
+		names = append(names, preset.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// profileNames returns the names of the output profiles
+// to list them in the usage of the -profile option.
+func profileNames() string {
+	var names []string
+	for _, profile := range moshpit.OutputProfiles() {
+		names = append(names, profile.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// newPipeline returns a Pipeline applying the datamoshing effect
+// to the video stream of the input file, writing the output file.
+func newPipeline(ffmpegPath string, ffprobePath string, ffmpegLogPath string, file *os.File, videoStream int,
+	outputFilePath string, profile *moshpit.OutputProfile, mosh moshpit.MoshFunc, iFrames []uint64) *moshpit.Pipeline {
+	p := moshpit.NewPipeline(file.Name(), outputFilePath, mosh)
+	p.FFmpegPath = ffmpegPath
+	p.FFprobePath = ffprobePath
+	p.FFmpegLogPath = ffmpegLogPath
+	p.VideoStream = videoStream
+	p.Profile = profile
+	p.Segment = inputSegment
+	p.Stitch = *stitchFlag
+	p.Format = aviFormat
+	p.Encoding = aviEncoding
+	p.IFrames = iFrames
+	p.TempDir = *tempDirFlag
+	p.Cache = aviCache
+	return p
+}
+
+// pipelineSteps are the descriptions of the pipeline stages
+// shown while and after running them.
+var pipelineSteps = map[moshpit.PipelineStage][2]string{
+	moshpit.StageConvert: {"Writing moshable file...", "Wrote AVI file for moshing."},
+	moshpit.StageMosh:    {"Moshing AVI file...", "Moshed AVI file."},
+	moshpit.StageBake:    {"Baking output file...", "Baked output file."},
+}
+
+// runPipeline runs the pipeline, showing a progress bar for each stage,
+// which are numbered starting at firstStep out of totalSteps.
+// It returns the intermediate AVI files the pipeline has written,
+// which are kept to be inspected and exported.
+func runPipeline(ctx context.Context, p *moshpit.Pipeline, firstStep int, totalSteps int) (*moshpit.PipelineResult, error) {
+	var bar *floatProgressBar
+	step := func(stage moshpit.PipelineStage) string {
+		return fmt.Sprintf("[cyan][%d/%d][reset] ", firstStep+int(stage), totalSteps)
+	}
+	var observer *aviObserver
+	p.StageStarted = func(stage moshpit.PipelineStage) {
+		bar = newDefaultFloatProgressBar(step(stage) + pipelineSteps[stage][0])
+		bar.RenderBlank()
+		observer = cachedAviObserver(bar)
+	}
+	p.StageFinished = func(stage moshpit.PipelineStage, err error) {
+		bar.Clear()
+		if err == nil {
+			console.Print(step(stage) + observer.message(pipelineSteps[stage][1]))
+		}
+		// always write a newline to ensure following
+		// command line output is written in the next line
+		console.Println("")
+	}
+	p.Observer = moshpit.ObserverFunc(func(event moshpit.Event) {
+		observer.Observe(event)
+	})
+	p.KeepIntermediates = true
+
+	result, err := p.Run(ctx)
+	if err != nil {
+		// the moshed AVI file is incomplete
+		removeAvi(result.MoshedFile)
+		result.MoshedFile = ""
+	} else if *keepIntermediatesFlag {
+		console.Printf("Kept intermediate files [cyan]%s[reset] and [cyan]%s[reset].\n", result.AviFile, result.MoshedFile)
+	}
+
+	var tooLarge *moshpit.ChunkTooLargeError
+	if errors.As(err, &tooLarge) {
+		err = fmt.Errorf("%s, try increasing the -max-frame-size option", err.Error())
 	}
+	return result, err
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/makeworld-the-better-one/moshpit"
+)
+
+func TestParseFrameRange(t *testing.T) {
+	tests := []struct {
+		arg   string
+		start uint64
+		end   uint64
+		err   bool
+	}{
+		{arg: "12", start: 12, end: 12},
+		{arg: "0-99", start: 0, end: 99},
+		{arg: "5-5", start: 5, end: 5},
+		{arg: "9-5", err: true},
+		{arg: "-5", err: true},
+		{arg: "5-", err: true},
+		{arg: "a-b", err: true},
+		{arg: "", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.arg, func(t *testing.T) {
+			start, end, err := parseFrameRange(test.arg)
+			if test.err {
+				if err == nil {
+					t.Fatalf("got range %d-%d, want an error", start, end)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if start != test.start || end != test.end {
+				t.Fatalf("got range %d-%d, want %d-%d", start, end, test.start, test.end)
+			}
+		})
+	}
+}
+
+func TestFormatTimestamp(t *testing.T) {
+	tests := []struct {
+		t    time.Duration
+		want string
+	}{
+		{t: 0, want: "0s"},
+		{t: 40 * time.Millisecond, want: "40ms"},
+		{t: 1234567 * time.Microsecond, want: "1.235s"},
+		{t: 61 * time.Second, want: "1m1s"},
+	}
+
+	for _, test := range tests {
+		if got := formatTimestamp(test.t); got != test.want {
+			t.Errorf("formatTimestamp(%v) = %s, want %s", test.t, got, test.want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		bytes uint64
+		want  string
+	}{
+		{bytes: 0, want: "0 B"},
+		{bytes: 1023, want: "1023 B"},
+		{bytes: 1024, want: "1.0 KB"},
+		{bytes: 1536, want: "1.5 KB"},
+		{bytes: 1024 * 1024, want: "1.0 MB"},
+		{bytes: 5 * 1024 * 1024 / 2, want: "2.5 MB"},
+	}
+
+	for _, test := range tests {
+		if got := formatBytes(test.bytes); got != test.want {
+			t.Errorf("formatBytes(%d) = %s, want %s", test.bytes, got, test.want)
+		}
+	}
+}
+
+func TestParseSplicePoint(t *testing.T) {
+	tests := []struct {
+		arg   string
+		point moshpit.SplicePoint
+		err   bool
+	}{
+		{arg: "10", point: moshpit.SplicePoint{Frame: 10}},
+		{arg: "10:20", point: moshpit.SplicePoint{Frame: 10, Source: 20}},
+		{arg: "10:20:30", point: moshpit.SplicePoint{Frame: 10, Source: 20, Length: 30}},
+		{arg: "10:20:30:40", err: true},
+		{arg: "10::30", err: true},
+		{arg: "-1", err: true},
+		{arg: "", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.arg, func(t *testing.T) {
+			point, err := parseSplicePoint(test.arg)
+			if test.err {
+				if err == nil {
+					t.Fatalf("got splice point %+v, want an error", point)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if point != test.point {
+				t.Fatalf("got splice point %+v, want %+v", point, test.point)
+			}
+		})
+	}
+}
+
+func TestParseVideoStream(t *testing.T) {
+	tests := []struct {
+		spec  string
+		index int
+		err   bool
+	}{
+		{spec: "0", index: 0},
+		{spec: "v:1", index: 1},
+		{spec: "V:12", index: 12},
+		{spec: "a:1", err: true},
+		{spec: "v:-1", err: true},
+		{spec: "v:", err: true},
+		{spec: "v:2147483648", err: true},
+	}
+
+	for _, test := range tests {
+		index, err := parseVideoStream(test.spec)
+		if (err != nil) != test.err || index != test.index {
+			t.Errorf("parseVideoStream(%s) = %d, %v, want %d", test.spec, index, err, test.index)
+		}
+	}
+}
+
+func TestFormatFrameCounts(t *testing.T) {
+	tests := []struct {
+		counts map[moshpit.FrameType]int
+		str    string
+	}{
+		{
+			counts: map[moshpit.FrameType]int{},
+			str:    "[red]0[reset] I, 0 P, [cyan]0[reset] B",
+		},
+		{
+			counts: map[moshpit.FrameType]int{moshpit.IFrame: 2, moshpit.PFrame: 48},
+			str:    "[red]2[reset] I, 48 P, [cyan]0[reset] B",
+		},
+		{
+			counts: map[moshpit.FrameType]int{
+				moshpit.IFrame: 1, moshpit.PFrame: 10, moshpit.BFrame: 5, moshpit.SFrame: 3,
+				moshpit.NotCodedFrame: 2, moshpit.DroppedFrame: 1, moshpit.Unknown: 4,
+			},
+			str: "[red]1[reset] I, 10 P, [cyan]5[reset] B, 3 S, 2 N, 1 D, 4 ?",
+		},
+	}
+
+	for _, test := range tests {
+		if str := formatFrameCounts(test.counts); str != test.str {
+			t.Errorf("got %s for %v, want %s", str, test.counts, test.str)
+		}
+	}
+}
+
+func TestParseMaxFrameSize(t *testing.T) {
+	tests := []struct {
+		mb   int
+		size uint32
+		err  bool
+	}{
+		{mb: 0, size: 0},
+		{mb: 1, size: 1 << 20},
+		{mb: 256, size: 256 << 20},
+		{mb: 4095, size: 4095 << 20},
+		{mb: 4096, err: true},
+		{mb: math.MaxInt32, err: true},
+		{mb: -1, err: true},
+	}
+
+	for _, test := range tests {
+		size, err := parseMaxFrameSize(test.mb)
+		if (err != nil) != test.err || size != test.size {
+			t.Errorf("parseMaxFrameSize(%d) = %d, %v, want %d", test.mb, size, err, test.size)
+		}
+	}
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"bytes"
 
-	"github.com/k0kubun/go-ansi"
+	"github.com/makeworld-the-better-one/moshpit"
 	"github.com/schollz/progressbar/v2"
 )
 
@@ -66,6 +66,14 @@ func (p *floatProgressBar) SetProgress(progress float64) {
 	p.writeRendered()
 }
 
+// Observe implements moshpit.Observer,
+// updating the progress bar with the reported progress.
+func (p *floatProgressBar) Observe(event moshpit.Event) {
+	if event.Type == moshpit.EventProgress {
+		p.SetProgress(event.Progress)
+	}
+}
+
 func (p *floatProgressBar) RenderBlank() {
 	p.buf.Reset()
 	p.ProgressBar.RenderBlank()
@@ -79,5 +87,9 @@ func (p *floatProgressBar) Clear() {
 }
 
 func (p *floatProgressBar) writeRendered() {
-	ansi.Print(p.buf.String())
+	// progress bars are only rendered on terminals,
+	// as they rely on carriage returns to update
+	if console.terminal {
+		console.writeRaw(p.buf.String())
+	}
 }
@@ -6,53 +6,107 @@ import (
 	"math"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 )
 
 // ConvertToAvi uses ffmpeg to convert the input file
 // into a mute AVI file for datamoshing.
-// The encoding quality of the output file is determined
-// by the quality parameter, with 0.0 being the lowest
-// and 1.0 being highest possible quality setting.
+// The video is encoded using the given encoder settings,
+// which determine the encoding quality of the output file
+// and the look of the datamoshing effect.
+// Only the video stream with the given index among the video streams
+// of the input file is converted, like the stream selected by the
+// ffmpeg stream specifier v:1 for index 1.
+// Only the given segment of the input file is converted,
+// and it is converted to the given format.
 // If iFrameIndices is not nil, automatic I-Frame generation
-// is disabled and I-Frames are placed at the given frame indices.
-// The encoding progress is frequently written to the
-// progress channel as a value between 0.0 and 1.0.
-// The error channel is closed when processing is finished.
-func ConvertToAvi(ctx context.Context, ffmpegPath string,
-	ffmpegLogPath string, inputFile string, outputFile string, quality float64,
-	iFrameIndices []uint64, progressChan chan<- float64,
-	errorChan chan<- error) {
+// is disabled and I-Frames are placed at the given frame indices,
+// which are relative to the start of the segment
+// and count the frames at the frame rate of the format.
+// The input file is probed using ffprobe to determine
+// its duration and frame rate.
+// The encoding progress and the lines of ffmpeg output
+// are sent to the events channel.
+// If converting fails, an EventError is sent as the last event.
+// The events channel is closed when processing is finished.
+func ConvertToAvi(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, inputFile string, videoStream int, segment Segment, format AviFormat, outputFile string,
+	options AviEncodeOptions, iFrameIndices []uint64, events chan<- Event) {
+	sendEvents(ctx, events, func(r reporter) error {
+		return convertToAvi(ctx, ffmpegPath, ffprobePath, ffmpegLogPath,
+			inputFile, videoStream, nil, 0, segment, format, outputFile, options, iFrameIndices, r)
+	})
+}
+
+// ConvertToAviSync is like ConvertToAvi, but blocks until converting
+// has finished, notifying the observer of the events if it is not nil.
+func ConvertToAviSync(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, inputFile string, videoStream int, segment Segment, format AviFormat, outputFile string,
+	options AviEncodeOptions, iFrameIndices []uint64, observer Observer) error {
+	return convertToAvi(ctx, ffmpegPath, ffprobePath, ffmpegLogPath,
+		inputFile, videoStream, nil, 0, segment, format, outputFile, options, iFrameIndices, newReporter(observer, nil))
+}
+
+// convertToAvi converts the input file like ConvertToAvi,
+// using the given video stream and duration if the input file
+// has already been probed, or probing it if video is nil.
+func convertToAvi(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, inputFile string, videoStream int, video *StreamInfo, duration time.Duration,
+	segment Segment, format AviFormat, outputFile string,
+	options AviEncodeOptions, iFrameIndices []uint64, r reporter) error {
 
 	if filepath.Ext(outputFile) != ".avi" {
-		errorChan <- errors.New("output file must have the .avi extension")
-		close(errorChan)
-		return
+		return errors.New("output file must have the .avi extension")
 	}
 
-	if quality < 0 || quality > 1 {
-		errorChan <- errors.New("quality setting must be a value between 0 and 1")
-		close(errorChan)
-		return
+	if err := segment.validate(); err != nil {
+		return err
+	}
+	if err := format.validate(); err != nil {
+		return err
+	}
+	if err := options.validate(format.encoder()); err != nil {
+		return err
 	}
 
-	// the ffmpeg quality setting ranges from 0 to 31,
-	// with 0 being the best quality.
-	ffmpegQuality := uint64(math.Round(31.0 * (1 - quality)))
+	// probe the duration of the input file to report the progress,
+	// and its frame rate to convert it to a constant frame rate
+	if video == nil {
+		r.stage("Probing input file")
+		var err error
+		if video, duration, err = probeVideo(ctx, ffprobePath, inputFile, videoStream); err != nil {
+			return err
+		}
+	}
 
-	// construct ffmpeg arguments
-	args := []string{
+	// construct ffmpeg arguments,
+	// only reading the segment of the input file
+	args := append(segment.inputArgs(),
 		"-i", inputFile,
+		// only convert the selected video stream
+		"-map", fmt.Sprintf("0:v:%d", videoStream),
 		// disable audio to avoid audio frames
 		// messing with the datamoshing to perform
 		"-an",
-		// set output quality to desired value
-		"-q", strconv.FormatUint(ffmpegQuality, 10),
-		// force overwrite the output file
-		// to avoid the command line prompt before execution
-		"-y",
+	)
+	// convert the frame rate and resolution
+	filters, err := format.filters(video)
+	if err != nil {
+		return err
 	}
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+	// select the MPEG-4 encoder and pixel format,
+	// and apply the encoder settings
+	args = append(args, format.encodeArgs()...)
+	args = append(args, options.args(format.encoder())...)
+	// force overwrite the output file
+	// to avoid the command line prompt before execution
+	args = append(args, "-y")
 
 	if iFrameIndices != nil {
 		// disable automatic I-Frame generation by setting the
@@ -69,6 +123,8 @@ func ConvertToAvi(ctx context.Context, ffmpegPath string,
 		// whether the current frame index n is equal to it,
 		// and adds the results together, which is equivalent
 		// to a logical or.
+		// ffmpeg fails on an empty expression, so it is only passed
+		// if any I-Frame indices were given
 		expr := "expr:"
 		for i, frame := range iFrameIndices {
 			if i != 0 {
@@ -76,79 +132,82 @@ func ConvertToAvi(ctx context.Context, ffmpegPath string,
 			}
 			expr += fmt.Sprintf("eq(n,%d)", frame)
 		}
-		args = append(args, "-force_key_frames", expr)
+		if len(iFrameIndices) > 0 {
+			args = append(args, "-force_key_frames", expr)
+		}
 	}
 
 	// append output file as last argument
 	args = append(args, outputFile)
 
-	runFFmpeg(ctx, ffmpegPath, args, ffmpegLogPath, progressChan, nil, errorChan)
+	r.stage("Converting to AVI")
+	return runFFmpeg(ctx, ffmpegPath, args, ffmpegLogPath, segment.duration(duration), r, nil)
 }
 
 // ConvertToMp4 uses ffmpeg to convert the input file
 // into an MP4 file, taking the audio stream from another file.
+// It encodes the file as fast as possible, use Bake
+// to encode the file using an OutputProfile instead.
+// Only the video stream with the given index among the video streams
+// of the AVI file is converted, which is 0 for files written by ConvertToAvi.
 // If the sound file path is empty, no audio is added to the output file.
 // The encoding quality of the output file is determined
 // by the quality parameter, with 0.0 being the lowest
 // and 1.0 being highest possible quality setting.
-// The encoding progress is frequently written to the
-// progress channel as a value between 0.0 and 1.0.
-// Any errors encountered are sent to the error channel.
-// The error channel is closed when processing is finished.
-func ConvertToMp4(ctx context.Context, ffmpegPath string,
-	ffmpegLogPath string, aviFile string, soundFile string,
-	outputFile string, quality float64,
-	progressChan chan<- float64, errorChan chan<- error) {
+// The AVI file is probed using ffprobe to determine its duration.
+// The encoding progress and the lines of ffmpeg output
+// are sent to the events channel.
+// If converting fails, an EventError is sent as the last event.
+// The events channel is closed when processing is finished.
+func ConvertToMp4(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, aviFile string, videoStream int, soundFile string,
+	outputFile string, quality float64, events chan<- Event) {
+	sendEvents(ctx, events, func(r reporter) error {
+		return convertToMp4(ctx, ffmpegPath, ffprobePath, ffmpegLogPath,
+			aviFile, videoStream, soundFile, outputFile, quality, r)
+	})
+}
+
+// ConvertToMp4Sync is like ConvertToMp4, but blocks until converting
+// has finished, notifying the observer of the events if it is not nil.
+func ConvertToMp4Sync(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, aviFile string, videoStream int, soundFile string,
+	outputFile string, quality float64, observer Observer) error {
+	return convertToMp4(ctx, ffmpegPath, ffprobePath, ffmpegLogPath,
+		aviFile, videoStream, soundFile, outputFile, quality, newReporter(observer, nil))
+}
+
+func convertToMp4(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, aviFile string, videoStream int, soundFile string,
+	outputFile string, quality float64, r reporter) error {
 
 	if filepath.Ext(outputFile) != ".mp4" {
-		errorChan <- errors.New("output file must have the .mp4 extension")
-		close(errorChan)
-		return
+		return errors.New("output file must have the .mp4 extension")
 	}
 
 	if quality < 0 || quality > 1 {
-		errorChan <- errors.New("quality setting must be a value between 0 and 1")
-		close(errorChan)
-		return
+		return errors.New("quality setting must be a value between 0 and 1")
 	}
 
 	// the ffmpeg quality setting ranges from 0 to 31,
 	// with 0 being the best quality.
 	ffmpegQuality := uint64(math.Round(31.0 * (1 - quality)))
 
-	// construct ffmpeg arguments
-	args := []string{
-		"-i", aviFile,
-	}
-
-	if soundFile != "" {
-		args = append(args, "-i", soundFile)
-
-		// take the video stream from the input file,
-		// and the audio stream from the sound file
-
-		// makeworld: Question mark was added to support videos with
-		// no audio stream. See this issue: https://github.com/CrushedPixel/moshpit/issues/1
-
-		args = append(args, "-map", "0:v:0", "-map", "1:a:0?")
-
-		// the mp4 format requires the aac format for audio streams.
-		// use a high bitrate to ensure high-quality audio
-		args = append(args, "-c:a", "aac", "-b:a", "320k")
+	profile := &OutputProfile{
+		Name:       "mp4",
+		Extensions: []string{".mp4"},
+		Audio:      true,
+		Options: map[string]string{
+			// the mp4 format requires the aac format for audio streams.
+			// use a high bitrate to ensure high-quality audio
+			"c:a": "aac",
+			"b:a": "320k",
+			// set output quality to desired value
+			"q": strconv.FormatUint(ffmpegQuality, 10),
+			// speed up encoding at the cost of a larger file size
+			"preset": "ultrafast",
+		},
 	}
-
-	// set output quality to desired value
-	args = append(args, "-q", strconv.FormatUint(ffmpegQuality, 10))
-
-	// speed up encoding at the cost of a larger file size
-	args = append(args, "-preset", "ultrafast")
-
-	// force overwrite the output file
-	// to avoid the command line prompt before execution
-	args = append(args, "-y")
-
-	// append output file as last argument
-	args = append(args, outputFile)
-
-	runFFmpeg(ctx, ffmpegPath, args, ffmpegLogPath, progressChan, nil, errorChan)
+	return bake(ctx, ffmpegPath, ffprobePath, ffmpegLogPath,
+		aviFile, videoStream, soundFile, Segment{}, outputFile, profile, r)
 }
@@ -0,0 +1,95 @@
+package moshpit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestConvertToAvi(t *testing.T) {
+	pt := newPipelineTest(t)
+	defer pt.remove()
+	ffmpegPath, argsFile := pt.recordingFFmpeg(t)
+	progress := "-progress " + os.Stdout.Name()
+
+	tests := []struct {
+		name          string
+		segment       Segment
+		format        AviFormat
+		options       AviEncodeOptions
+		iFrameIndices []uint64
+		outputFile    string
+		args          string
+		err           string
+	}{
+		{
+			name:    "defaults",
+			options: AviEncodeOptions{Quality: 1},
+			args:    "-i input.mp4 -map 0:v:0 -an -c:v mpeg4 -q 0 -y " + progress + " {out}",
+		},
+		{
+			name: "default quality",
+			args: "-i input.mp4 -map 0:v:0 -an -c:v mpeg4 -y " + progress + " {out}",
+		},
+		{
+			name:    "segment and format",
+			segment: Segment{Start: 2 * time.Second, End: 4 * time.Second},
+			format:  AviFormat{FrameRate: Rational{25, 1}, Width: 640, Encoder: EncoderXvid},
+			options: AviEncodeOptions{Quality: 0.5, MotionEstimation: MotionEstimationZero},
+			args: "-ss 2 -to 4 -i input.mp4 -map 0:v:0 -an -vf fps=25/1,scale=640:-2,setsar=1 " +
+				"-c:v libxvid -q 16 -me_quality 0 -y " + progress + " {out}",
+		},
+		{
+			name:          "I-Frames",
+			options:       AviEncodeOptions{Quality: 1},
+			iFrameIndices: []uint64{0, 10},
+			args: "-i input.mp4 -map 0:v:0 -an -c:v mpeg4 -q 0 -y " +
+				"-g 2147483647 -strict experimental -force_key_frames expr:eq(n,0)+eq(n,10) " + progress + " {out}",
+		},
+		{
+			name:          "no I-Frames",
+			options:       AviEncodeOptions{Quality: 1},
+			iFrameIndices: []uint64{},
+			args: "-i input.mp4 -map 0:v:0 -an -c:v mpeg4 -q 0 -y " +
+				"-g 2147483647 -strict experimental " + progress + " {out}",
+		},
+		{
+			name:       "output file extension",
+			outputFile: "output.mp4",
+			err:        "output file must have the .avi extension",
+		},
+		{
+			name:    "invalid options",
+			options: AviEncodeOptions{Quality: 1, GlobalMotion: true},
+			err:     "global motion compensation requires the libxvid encoder",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outputFile := filepath.Join(pt.dir, "output.avi")
+			if test.outputFile != "" {
+				outputFile = filepath.Join(pt.dir, test.outputFile)
+			}
+			err := ConvertToAviSync(context.Background(), ffmpegPath, pt.ffprobe(t), "", "input.mp4", 0,
+				test.segment, test.format, outputFile, test.options, test.iFrameIndices, nil)
+			args := recordedArgs(t, argsFile)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := strings.Replace(test.args, "{out}", outputFile, 1); args != expected {
+				t.Fatalf("got arguments\n%s\nwant\n%s", args, expected)
+			}
+		})
+	}
+}
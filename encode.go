@@ -0,0 +1,269 @@
+package moshpit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MotionEstimation is the algorithm the encoder
+// searches the motion vectors of P-Frames with.
+type MotionEstimation string
+
+const (
+	// MotionEstimationZero doesn't search motion vectors,
+	// encoding all motion as the difference to the preceding frame.
+	MotionEstimationZero MotionEstimation = "zero"
+	// MotionEstimationEPZS is the default predictive zonal search.
+	MotionEstimationEPZS MotionEstimation = "epzs"
+	// MotionEstimationXOne is the most exhaustive search.
+	MotionEstimationXOne MotionEstimation = "xone"
+)
+
+// MacroblockDecision is how the encoder decides
+// the way each macroblock is encoded.
+type MacroblockDecision string
+
+const (
+	// MacroblockDecisionSimple compares the blocks directly.
+	MacroblockDecisionSimple MacroblockDecision = "simple"
+	// MacroblockDecisionBits chooses the mode needing the fewest bits.
+	MacroblockDecisionBits MacroblockDecision = "bits"
+	// MacroblockDecisionRD chooses the mode with the best rate distortion.
+	MacroblockDecisionRD MacroblockDecision = "rd"
+)
+
+// AviEncodeOptions are the settings of the MPEG-4 encoder ConvertToAvi
+// writes the moshable AVI file with. The way the P-Frames are encoded
+// shapes the look of the datamoshing effect, as it determines
+// which motion is carried over to the following frames.
+// Options left at their zero value use the defaults of the encoder.
+type AviEncodeOptions struct {
+	// Quality is the encoding quality, with values close to 0.0 being
+	// the lowest and 1.0 being the highest possible quality setting.
+	// If it is 0, the default quality of the encoder is used.
+	Quality float64 `json:"quality"`
+	// MotionEstimation is the motion estimation method.
+	// For the libxvid encoder, it selects the motion search quality.
+	MotionEstimation MotionEstimation `json:"motionEstimation"`
+	// MotionRange limits the length of the motion vectors in pixels,
+	// or is 0 for no limit. It is ignored by the libxvid encoder.
+	MotionRange int `json:"motionRange"`
+	// MacroblockDecision is the macroblock decision mode.
+	MacroblockDecision MacroblockDecision `json:"macroblockDecision"`
+	// Trellis enables trellis quantization.
+	Trellis bool `json:"trellis"`
+	// QuarterPel enables motion vectors with quarter pixel precision.
+	QuarterPel bool `json:"quarterPel"`
+	// GlobalMotion enables global motion compensation,
+	// which writes S-Frames. It requires the libxvid encoder.
+	GlobalMotion bool `json:"globalMotion"`
+	// FourMotionVectors enables four motion vectors per macroblock.
+	FourMotionVectors bool `json:"fourMotionVectors"`
+}
+
+// AviEncodePreset is a named set of AviEncodeOptions
+// producing a certain look of the datamoshing effect.
+type AviEncodePreset struct {
+	Name        string
+	Description string
+	Options     AviEncodeOptions
+}
+
+// the presets that can be selected by name
+var aviEncodePresets = []AviEncodePreset{
+	{
+		Name:        "smeary",
+		Description: "Long, precise motion vectors that drag the picture across the frame",
+		Options: AviEncodeOptions{
+			Quality:            1,
+			MotionEstimation:   MotionEstimationXOne,
+			MacroblockDecision: MacroblockDecisionRD,
+			QuarterPel:         true,
+			FourMotionVectors:  true,
+		},
+	},
+	{
+		Name:        "blocky",
+		Description: "No motion vectors, leaving coarse blocks of the moving picture behind",
+		Options: AviEncodeOptions{
+			Quality:            0.6,
+			MotionEstimation:   MotionEstimationZero,
+			MacroblockDecision: MacroblockDecisionSimple,
+		},
+	},
+	{
+		Name:        "clean",
+		Description: "Short, accurate motion vectors that move the picture without tearing it",
+		Options: AviEncodeOptions{
+			Quality:            1,
+			MotionEstimation:   MotionEstimationEPZS,
+			MotionRange:        16,
+			MacroblockDecision: MacroblockDecisionRD,
+			Trellis:            true,
+			FourMotionVectors:  true,
+		},
+	},
+}
+
+// the motion search quality of the libxvid encoder
+// used for each motion estimation method
+var xvidMotionQuality = map[MotionEstimation]int{
+	MotionEstimationZero: 0,
+	MotionEstimationEPZS: 4,
+	MotionEstimationXOne: 6,
+}
+
+// AviEncodePresets returns the presets
+// that can be selected using AviEncodePresetByName.
+func AviEncodePresets() []AviEncodePreset {
+	return append([]AviEncodePreset(nil), aviEncodePresets...)
+}
+
+// AviEncodePresetByName returns the options of the preset with the given name.
+func AviEncodePresetByName(name string) (AviEncodeOptions, error) {
+	for _, preset := range aviEncodePresets {
+		if strings.EqualFold(preset.Name, name) {
+			return preset.Options, nil
+		}
+	}
+	names := make([]string, len(aviEncodePresets))
+	for i, preset := range aviEncodePresets {
+		names[i] = preset.Name
+	}
+	return AviEncodeOptions{}, fmt.Errorf(`unknown encode preset "%s", must be one of %s`, name, strings.Join(names, ", "))
+}
+
+// ParseAviEncodeOptions parses a comma-separated list of encoder settings
+// in the format <name>=<value> or <name>, like "me=epzs,me_range=32,qpel",
+// overriding the settings of the given options.
+// The settings are q for the quality between 0 and 1, with 0 being the
+// default of the encoder, me for the motion estimation method, me_range,
+// mbd for the macroblock decision mode, and trellis, qpel, gmc and 4mv,
+// which are enabled if no value is given.
+func ParseAviEncodeOptions(list string, options AviEncodeOptions) (AviEncodeOptions, error) {
+	for _, option := range strings.Split(list, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		spl := strings.SplitN(option, "=", 2)
+		name := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(spl[0]), "-"))
+		value := ""
+		if len(spl) == 2 {
+			value = strings.ToLower(strings.TrimSpace(spl[1]))
+		}
+		invalid := fmt.Errorf(`"%s" is not a valid encode option`, option)
+
+		// parses the value of a setting that is enabled without a value
+		parseFlag := func() (bool, error) {
+			if len(spl) == 1 {
+				return true, nil
+			}
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return false, invalid
+			}
+			return enabled, nil
+		}
+
+		var err error
+		switch name {
+		case "q":
+			options.Quality, err = strconv.ParseFloat(value, 64)
+		case "me":
+			options.MotionEstimation = MotionEstimation(value)
+		case "me_range":
+			options.MotionRange, err = strconv.Atoi(value)
+		case "mbd":
+			options.MacroblockDecision = MacroblockDecision(value)
+		case "trellis":
+			options.Trellis, err = parseFlag()
+		case "qpel":
+			options.QuarterPel, err = parseFlag()
+		case "gmc":
+			options.GlobalMotion, err = parseFlag()
+		case "4mv":
+			options.FourMotionVectors, err = parseFlag()
+		default:
+			return AviEncodeOptions{}, fmt.Errorf(`unknown encode option "%s", must be one of q, me, me_range, mbd, trellis, qpel, gmc, 4mv`, name)
+		}
+		if err != nil {
+			return AviEncodeOptions{}, invalid
+		}
+	}
+	return options, options.validate("")
+}
+
+// validate returns an error if the options are invalid
+// or can't be used with the encoder, unless it is empty.
+func (o AviEncodeOptions) validate(encoder string) error {
+	if o.Quality < 0 || o.Quality > 1 {
+		return errors.New("quality setting must be a value between 0 and 1")
+	}
+	switch o.MotionEstimation {
+	case "", MotionEstimationZero, MotionEstimationEPZS, MotionEstimationXOne:
+	default:
+		return fmt.Errorf(`unknown motion estimation method "%s", must be %s, %s or %s`,
+			o.MotionEstimation, MotionEstimationZero, MotionEstimationEPZS, MotionEstimationXOne)
+	}
+	if o.MotionRange < 0 {
+		return errors.New("the motion range must not be negative")
+	}
+	switch o.MacroblockDecision {
+	case "", MacroblockDecisionSimple, MacroblockDecisionBits, MacroblockDecisionRD:
+	default:
+		return fmt.Errorf(`unknown macroblock decision mode "%s", must be %s, %s or %s`,
+			o.MacroblockDecision, MacroblockDecisionSimple, MacroblockDecisionBits, MacroblockDecisionRD)
+	}
+	if o.GlobalMotion && encoder != "" && encoder != EncoderXvid {
+		return fmt.Errorf("global motion compensation requires the %s encoder", EncoderXvid)
+	}
+	return nil
+}
+
+// args returns the ffmpeg output options
+// applying the settings to the encoder.
+func (o AviEncodeOptions) args(encoder string) []string {
+	var args []string
+	if o.Quality > 0 {
+		// the ffmpeg quality setting ranges from 0 to 31,
+		// with 0 being the best quality.
+		ffmpegQuality := uint64(math.Round(31.0 * (1 - o.Quality)))
+		args = append(args, "-q", strconv.FormatUint(ffmpegQuality, 10))
+	}
+
+	if o.MotionEstimation != "" {
+		if encoder == EncoderXvid {
+			args = append(args, "-me_quality", strconv.Itoa(xvidMotionQuality[o.MotionEstimation]))
+		} else {
+			args = append(args, "-motion_est", string(o.MotionEstimation))
+		}
+	}
+	if o.MotionRange > 0 && encoder != EncoderXvid {
+		args = append(args, "-me_range", strconv.Itoa(o.MotionRange))
+	}
+	if o.MacroblockDecision != "" {
+		args = append(args, "-mbd", string(o.MacroblockDecision))
+	}
+	if o.Trellis {
+		args = append(args, "-trellis", "1")
+	}
+	if o.GlobalMotion {
+		args = append(args, "-gmc", "1")
+	}
+
+	var flags string
+	if o.QuarterPel {
+		flags += "+qpel"
+	}
+	if o.FourMotionVectors {
+		flags += "+mv4"
+	}
+	if flags != "" {
+		args = append(args, "-flags", flags)
+	}
+	return args
+}
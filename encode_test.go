@@ -0,0 +1,164 @@
+package moshpit
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAviEncodePresetByName(t *testing.T) {
+	tests := []struct {
+		name    string
+		options AviEncodeOptions
+		err     string
+	}{
+		{
+			name: "Smeary",
+			options: AviEncodeOptions{
+				Quality: 1, MotionEstimation: MotionEstimationXOne, MacroblockDecision: MacroblockDecisionRD,
+				QuarterPel: true, FourMotionVectors: true,
+			},
+		},
+		{
+			name: "blocky",
+			options: AviEncodeOptions{
+				Quality: 0.6, MotionEstimation: MotionEstimationZero, MacroblockDecision: MacroblockDecisionSimple,
+			},
+		},
+		{name: "glitchy", err: `unknown encode preset "glitchy", must be one of smeary, blocky, clean`},
+	}
+
+	for _, test := range tests {
+		options, err := AviEncodePresetByName(test.name)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil || options != test.options {
+			t.Errorf("%s: got options %+v and error %v, want %+v", test.name, options, err, test.options)
+		}
+	}
+
+	// the presets are valid for the mpeg4 encoder
+	for _, preset := range AviEncodePresets() {
+		if err := preset.Options.validate(EncoderMpeg4); err != nil {
+			t.Errorf("preset %s: %v", preset.Name, err)
+		}
+	}
+}
+
+func TestParseAviEncodeOptions(t *testing.T) {
+	base := AviEncodeOptions{Quality: 1, MotionEstimation: MotionEstimationEPZS, Trellis: true}
+	tests := []struct {
+		list    string
+		options AviEncodeOptions
+		err     string
+	}{
+		{list: "", options: base},
+		{
+			list:    "q=0.5, me=ZERO ,me_range=32",
+			options: AviEncodeOptions{Quality: 0.5, MotionEstimation: MotionEstimationZero, MotionRange: 32, Trellis: true},
+		},
+		{
+			list:    "q=0",
+			options: AviEncodeOptions{MotionEstimation: MotionEstimationEPZS, Trellis: true},
+		},
+		{
+			list: "-mbd=rd,qpel,gmc=true,4mv,trellis=0",
+			options: AviEncodeOptions{
+				Quality: 1, MotionEstimation: MotionEstimationEPZS, MacroblockDecision: MacroblockDecisionRD,
+				QuarterPel: true, GlobalMotion: true, FourMotionVectors: true,
+			},
+		},
+		{list: "q=high", err: `"q=high" is not a valid encode option`},
+		{list: "qpel=maybe", err: `"qpel=maybe" is not a valid encode option`},
+		{list: "me_range=-1", err: "the motion range must not be negative"},
+		{list: "q=2", err: "quality setting must be a value between 0 and 1"},
+		{list: "me=full", err: `unknown motion estimation method "full", must be zero, epzs or xone`},
+		{list: "mbd=best", err: `unknown macroblock decision mode "best", must be simple, bits or rd`},
+		{list: "bf=2", err: `unknown encode option "bf", must be one of q, me, me_range, mbd, trellis, qpel, gmc, 4mv`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.list, func(t *testing.T) {
+			options, err := ParseAviEncodeOptions(test.list, base)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil || options != test.options {
+				t.Fatalf("got options %+v and error %v, want %+v", options, err, test.options)
+			}
+		})
+	}
+}
+
+func TestAviEncodeOptionsArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		options AviEncodeOptions
+		encoder string
+		args    string
+		err     string
+	}{
+		{
+			name:    "highest quality",
+			options: AviEncodeOptions{Quality: 1},
+			encoder: EncoderMpeg4,
+			args:    "-q 0",
+		},
+		{
+			name:    "default quality",
+			options: AviEncodeOptions{},
+			encoder: EncoderMpeg4,
+			args:    "",
+		},
+		{
+			name:    "lowest quality",
+			options: AviEncodeOptions{Quality: 0.01, MotionEstimation: MotionEstimationZero},
+			encoder: EncoderMpeg4,
+			args:    "-q 31 -motion_est zero",
+		},
+		{
+			name: "all options",
+			options: AviEncodeOptions{
+				Quality: 0.5, MotionEstimation: MotionEstimationXOne, MotionRange: 16,
+				MacroblockDecision: MacroblockDecisionBits, Trellis: true, QuarterPel: true, FourMotionVectors: true,
+			},
+			encoder: EncoderMpeg4,
+			args:    "-q 16 -motion_est xone -me_range 16 -mbd bits -trellis 1 -flags +qpel+mv4",
+		},
+		{
+			name: "xvid",
+			options: AviEncodeOptions{
+				Quality: 1, MotionEstimation: MotionEstimationEPZS, MotionRange: 16, GlobalMotion: true,
+			},
+			encoder: EncoderXvid,
+			args:    "-q 0 -me_quality 4 -gmc 1",
+		},
+		{
+			name:    "global motion without xvid",
+			options: AviEncodeOptions{GlobalMotion: true},
+			encoder: EncoderMpeg4,
+			err:     "global motion compensation requires the libxvid encoder",
+		},
+	}
+
+	for _, test := range tests {
+		err := test.options.validate(test.encoder)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if args := strings.Join(test.options.args(test.encoder), " "); args != test.args {
+			t.Errorf("%s: got arguments %s, want %s", test.name, args, test.args)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package moshpit
+
+import (
+	"golang.org/x/net/context"
+)
+
+// EventType is the type of an Event.
+type EventType uint
+
+const (
+	// EventProgress reports the progress of the current stage
+	// as a value between 0.0 and 1.0.
+	EventProgress EventType = iota
+	// EventStage reports that a new stage of the operation has started.
+	EventStage
+	// EventLog reports a line of ffmpeg output,
+	// or a warning that doesn't fail the operation.
+	EventLog
+	// EventResult reports a single result of the operation,
+	// like a scene change found by FindScenes.
+	EventResult
+	// EventError reports the error the operation failed with.
+	// It is the last event of an operation.
+	EventError
+)
+
+// Event is reported by long-running operations
+// like FindScenes, ConvertToAvi or RemoveFrames.
+type Event struct {
+	Type EventType
+	// Progress is the progress of an EventProgress
+	// as a value between 0.0 and 1.0.
+	Progress float64
+	// Stage is the description of the stage started by an EventStage.
+	Stage string
+	// Line is the line of output of an EventLog.
+	Line string
+	// Result is the result of an EventResult, which is a VideoTime
+	// for FindScenes and a FrameInfo for AnalyzeFrames.
+	Result interface{}
+	// Err is the error of an EventError.
+	Err error
+}
+
+// Observer is notified of the events of an operation run by one of the
+// blocking functions like FindScenesSync, which call it synchronously
+// from the goroutine they were called from.
+type Observer interface {
+	Observe(event Event)
+}
+
+// ObserverFunc is a function implementing the Observer interface.
+type ObserverFunc func(event Event)
+
+// Observe calls f(event).
+func (f ObserverFunc) Observe(event Event) {
+	f(event)
+}
+
+// reporter reports the events of an operation to an Observer.
+type reporter struct {
+	observer Observer
+}
+
+func (r reporter) progress(progress float64) {
+	r.observer.Observe(Event{Type: EventProgress, Progress: progress})
+}
+
+func (r reporter) stage(stage string) {
+	r.observer.Observe(Event{Type: EventStage, Stage: stage})
+}
+
+func (r reporter) log(line string) {
+	r.observer.Observe(Event{Type: EventLog, Line: line})
+}
+
+func (r reporter) result(result interface{}) {
+	r.observer.Observe(Event{Type: EventResult, Result: result})
+}
+
+// newReporter returns a reporter notifying the observer,
+// which may be nil if the caller isn't interested in the events.
+// If collect is not nil, it is called with each result.
+func newReporter(observer Observer, collect func(result interface{})) reporter {
+	return reporter{ObserverFunc(func(event Event) {
+		if event.Type == EventResult && collect != nil {
+			collect(event.Result)
+		}
+		if observer != nil {
+			observer.Observe(event)
+		}
+	})}
+}
+
+// sendEvents runs the operation, sending its events to the events channel
+// and closing it when the operation has finished.
+// If the operation fails, an EventError is sent as the last event.
+// Events are dropped once the context is done, so the operation
+// doesn't block if the receiver stops reading from the channel.
+func sendEvents(ctx context.Context, events chan<- Event, operation func(r reporter) error) {
+	defer close(events)
+
+	send := func(event Event) {
+		select {
+		case events <- event:
+		case <-ctx.Done():
+		}
+	}
+
+	if err := operation(reporter{ObserverFunc(send)}); err != nil {
+		send(Event{Type: EventError, Err: err})
+	}
+}
@@ -0,0 +1,124 @@
+package moshpit
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// reportEvents reports one event of each type.
+func reportEvents(r reporter) {
+	r.stage("stage")
+	r.progress(0.5)
+	r.log("line")
+	r.result(1)
+}
+
+func TestSendEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		events []EventType
+	}{
+		{
+			name:   "success",
+			events: []EventType{EventStage, EventProgress, EventLog, EventResult},
+		},
+		{
+			name:   "error",
+			err:    errors.New("error"),
+			events: []EventType{EventStage, EventProgress, EventLog, EventResult, EventError},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events := make(chan Event)
+			go sendEvents(context.Background(), events, func(r reporter) error {
+				reportEvents(r)
+				return test.err
+			})
+
+			var received []Event
+			for event := range events {
+				received = append(received, event)
+			}
+			if len(received) != len(test.events) {
+				t.Fatalf("got %d events, want %d", len(received), len(test.events))
+			}
+			for i, event := range received {
+				if event.Type != test.events[i] {
+					t.Fatalf("event %d has type %d, want %d", i, event.Type, test.events[i])
+				}
+			}
+
+			first := received[:4]
+			if first[0].Stage != "stage" || first[1].Progress != 0.5 || first[2].Line != "line" || first[3].Result != 1 {
+				t.Fatalf("got events %+v, want the reported values", first)
+			}
+			if test.err != nil && received[len(received)-1].Err != test.err {
+				t.Fatalf("got error %v, want %v", received[len(received)-1].Err, test.err)
+			}
+		})
+	}
+}
+
+func TestSendEventsCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the events are dropped without blocking the operation,
+	// as nobody is receiving them
+	events := make(chan Event)
+	sendEvents(ctx, events, func(r reporter) error {
+		reportEvents(r)
+		return errors.New("error")
+	})
+	if _, ok := <-events; ok {
+		t.Fatal("got an event, want the channel to be closed")
+	}
+}
+
+func TestNewReporter(t *testing.T) {
+	var results []interface{}
+	collect := func(result interface{}) {
+		results = append(results, result)
+	}
+	var observed []EventType
+	observer := ObserverFunc(func(event Event) {
+		observed = append(observed, event.Type)
+	})
+
+	reportEvents(newReporter(observer, collect))
+	if len(observed) != 4 || len(results) != 1 || results[0] != 1 {
+		t.Fatalf("observed %v and collected %v, want 4 events and the result", observed, results)
+	}
+
+	// neither the observer nor the collect function are required
+	reportEvents(newReporter(nil, collect))
+	reportEvents(newReporter(nil, nil))
+	if len(observed) != 4 || len(results) != 2 {
+		t.Fatalf("observed %v and collected %v, want no further events and the second result", observed, results)
+	}
+}
+
+func TestAnalyzeFramesEvents(t *testing.T) {
+	input := testAviFile(frameChunks(moshTestFrames(3)...), 0)
+	events := make(chan Event)
+	go AnalyzeFrames(context.Background(), bytes.NewReader(input), events)
+
+	var frames []FrameInfo
+	for event := range events {
+		switch event.Type {
+		case EventResult:
+			frames = append(frames, event.Result.(FrameInfo))
+		case EventError:
+			t.Fatal(event.Err)
+		}
+	}
+	if len(frames) != 3 || frames[0].Type != IFrame || frames[2].Index != 2 {
+		t.Fatalf("got frames %+v, want the 3 frames of the input", frames)
+	}
+}
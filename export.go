@@ -0,0 +1,290 @@
+package moshpit
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/crushedpixel/go-timecode/timecode"
+)
+
+// SceneFormat is a file format scene changes can be exported to.
+type SceneFormat string
+
+const (
+	// SceneFormatJSON is a JSON array of objects
+	// holding the frame, time, timecode and fps of each scene change.
+	SceneFormatJSON SceneFormat = "json"
+	// SceneFormatCSV is a CSV file with a header row and
+	// the frame, time, timecode and fps of each scene change.
+	SceneFormatCSV SceneFormat = "csv"
+	// SceneFormatEDL is a CMX3600 edit decision list with
+	// a single-frame event at each scene change.
+	SceneFormatEDL SceneFormat = "edl"
+	// SceneFormatFCPXML is a Final Cut Pro XML file with
+	// a marker at each scene change.
+	SceneFormatFCPXML SceneFormat = "fcpxml"
+	// SceneFormatText is a plain text file with
+	// the timecode of each scene change on its own line.
+	SceneFormatText SceneFormat = "txt"
+)
+
+// SceneFormatForFile returns the scene format
+// matching the extension of the file name.
+func SceneFormatForFile(fileName string) (SceneFormat, error) {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(fileName), "."))
+	switch format := SceneFormat(ext); format {
+	case SceneFormatJSON, SceneFormatCSV, SceneFormatEDL, SceneFormatFCPXML, SceneFormatText:
+		return format, nil
+	}
+	return "", fmt.Errorf(`unsupported scene file extension "%s", must be one of .json, .csv, .edl, .fcpxml or .txt`, filepath.Ext(fileName))
+}
+
+// ExportScenes writes the scene changes to the output in the given format.
+// The name is used as the title of EDL and FCPXML files
+// and should be the name of the analyzed file.
+func ExportScenes(output io.Writer, format SceneFormat, name string, sceneTimes []VideoTime) error {
+	switch format {
+	case SceneFormatJSON:
+		return exportScenesJSON(output, sceneTimes)
+	case SceneFormatCSV:
+		return exportScenesCSV(output, sceneTimes)
+	case SceneFormatEDL:
+		return exportScenesEDL(output, name, sceneTimes)
+	case SceneFormatFCPXML:
+		return exportScenesFCPXML(output, name, sceneTimes)
+	case SceneFormatText:
+		return exportScenesText(output, sceneTimes)
+	}
+	return fmt.Errorf(`unsupported scene format "%s"`, format)
+}
+
+// sceneJSON is the JSON representation of a scene change.
+type sceneJSON struct {
+	Frame    uint64  `json:"frame"`
+	Time     float64 `json:"time"`
+	Timecode string  `json:"timecode"`
+	Fps      float64 `json:"fps"`
+}
+
+func exportScenesJSON(output io.Writer, sceneTimes []VideoTime) error {
+	scenes := make([]sceneJSON, 0, len(sceneTimes))
+	for _, sceneTime := range sceneTimes {
+		scenes = append(scenes, sceneJSON{
+			Frame:    sceneTime.Frame,
+			Time:     sceneTime.Time.Seconds(),
+			Timecode: sceneTime.Timecode(),
+			Fps:      sceneTime.Fps,
+		})
+	}
+
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(scenes)
+}
+
+// the header row of exported CSV files
+var sceneCSVHeader = []string{"frame", "time", "timecode", "fps"}
+
+func exportScenesCSV(output io.Writer, sceneTimes []VideoTime) error {
+	w := csv.NewWriter(output)
+	if err := w.Write(sceneCSVHeader); err != nil {
+		return err
+	}
+	for _, sceneTime := range sceneTimes {
+		err := w.Write([]string{
+			strconv.FormatUint(sceneTime.Frame, 10),
+			strconv.FormatFloat(sceneTime.Time.Seconds(), 'f', -1, 64),
+			sceneTime.Timecode(),
+			strconv.FormatFloat(sceneTime.Fps, 'f', -1, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func exportScenesText(output io.Writer, sceneTimes []VideoTime) error {
+	for _, sceneTime := range sceneTimes {
+		if _, err := fmt.Fprintln(output, sceneTime.Timecode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportScenesEDL writes a CMX3600 EDL with a single-frame event
+// at each scene change. Each event is followed by a clip name comment
+// and a marker comment, so the scene changes can be imported
+// as edit points or as timeline markers.
+func exportScenesEDL(output io.Writer, name string, sceneTimes []VideoTime) error {
+	fcm := "NON-DROP FRAME"
+	if len(sceneTimes) > 0 && timecode.NewFloatRate(float32(sceneTimes[0].Fps)).IsDrop() {
+		fcm = "DROP FRAME"
+	}
+
+	// CMX3600 titles are limited to 70 characters
+	title := name
+	if len(title) > 70 {
+		title = title[:70]
+	}
+	if _, err := fmt.Fprintf(output, "TITLE: %s\r\nFCM: %s\r\n\r\n", title, fcm); err != nil {
+		return err
+	}
+
+	for i, sceneTime := range sceneTimes {
+		in := frameTimecode(sceneTime.Frame, sceneTime.Fps)
+		out := frameTimecode(sceneTime.Frame+1, sceneTime.Fps)
+		_, err := fmt.Fprintf(output,
+			"%03d  AX       V     C        %s %s %s %s\r\n"+
+				"* FROM CLIP NAME: %s\r\n"+
+				" |C:ResolveColorRed |M:Scene change %d |D:1\r\n\r\n",
+			i+1, in, out, in, out, name, i+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// frameTimecode returns the SMPTE timecode of the frame index
+// at the given frame rate, using drop-frame timecodes
+// for NTSC frame rates like 29.97 fps.
+func frameTimecode(frame uint64, fps float64) string {
+	rate := timecode.NewFloatRate(float32(fps))
+	if rate.IsDrop() {
+		return timecode.New(rate.Duration(int64(frame)), rate).String()
+	}
+
+	base := uint64(math.Round(fps))
+	if base == 0 {
+		base = 1
+	}
+	return fmt.Sprintf("%02d:%02d:%02d:%02d",
+		frame/(base*3600), frame/(base*60)%60, frame/base%60, frame%base)
+}
+
+type fcpxmlDocument struct {
+	XMLName xml.Name     `xml:"fcpxml"`
+	Version string       `xml:"version,attr"`
+	Format  fcpxmlFormat `xml:"resources>format"`
+	Event   fcpxmlEvent  `xml:"library>event"`
+}
+
+type fcpxmlEvent struct {
+	Name    string        `xml:"name,attr"`
+	Project fcpxmlProject `xml:"project"`
+}
+
+type fcpxmlProject struct {
+	Name     string         `xml:"name,attr"`
+	Sequence fcpxmlSequence `xml:"sequence"`
+}
+
+type fcpxmlFormat struct {
+	ID            string `xml:"id,attr"`
+	FrameDuration string `xml:"frameDuration,attr"`
+}
+
+type fcpxmlSequence struct {
+	Format   string    `xml:"format,attr"`
+	TCStart  string    `xml:"tcStart,attr"`
+	TCFormat string    `xml:"tcFormat,attr"`
+	Gap      fcpxmlGap `xml:"spine>gap"`
+}
+
+type fcpxmlGap struct {
+	Name     string         `xml:"name,attr"`
+	Offset   string         `xml:"offset,attr"`
+	Start    string         `xml:"start,attr"`
+	Duration string         `xml:"duration,attr"`
+	Markers  []fcpxmlMarker `xml:"marker"`
+}
+
+type fcpxmlMarker struct {
+	Start    string `xml:"start,attr"`
+	Duration string `xml:"duration,attr"`
+	Value    string `xml:"value,attr"`
+}
+
+// exportScenesFCPXML writes an FCPXML project with a marker at each
+// scene change, placed on a gap spanning up to the last scene change.
+func exportScenesFCPXML(output io.Writer, name string, sceneTimes []VideoTime) error {
+	fps := 25.0
+	if len(sceneTimes) > 0 {
+		fps = sceneTimes[0].Fps
+	}
+	rate := timecode.NewFloatRate(float32(fps))
+	num, den := rate.Fraction()
+
+	// rational time of the given frame index in seconds
+	frameTime := func(frame uint64) string {
+		if frame == 0 {
+			return "0s"
+		}
+		return fmt.Sprintf("%d/%ds", frame*uint64(den), num)
+	}
+
+	tcFormat := "NDF"
+	if rate.IsDrop() {
+		tcFormat = "DF"
+	}
+
+	var duration uint64 = 1
+	var markers []fcpxmlMarker
+	for i, sceneTime := range sceneTimes {
+		markers = append(markers, fcpxmlMarker{
+			Start:    frameTime(sceneTime.Frame),
+			Duration: frameTime(1),
+			Value:    fmt.Sprintf("Scene change %d", i+1),
+		})
+		if sceneTime.Frame+1 > duration {
+			duration = sceneTime.Frame + 1
+		}
+	}
+
+	doc := fcpxmlDocument{
+		Version: "1.8",
+		Format: fcpxmlFormat{
+			ID:            "r1",
+			FrameDuration: frameTime(1),
+		},
+		Event: fcpxmlEvent{
+			Name: name,
+			Project: fcpxmlProject{
+				Name: name,
+				Sequence: fcpxmlSequence{
+					Format:   "r1",
+					TCStart:  "0s",
+					TCFormat: tcFormat,
+					Gap: fcpxmlGap{
+						Name:     "Gap",
+						Offset:   "0s",
+						Start:    "0s",
+						Duration: frameTime(duration),
+						Markers:  markers,
+					},
+				},
+			},
+		},
+	}
+
+	if _, err := io.WriteString(output, xml.Header+"<!DOCTYPE fcpxml>\n"); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(output)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(output, "\n")
+	return err
+}
@@ -0,0 +1,171 @@
+package moshpit
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// testSceneTimes are scene changes of a 25 fps video.
+var testSceneTimes = []VideoTime{
+	{Time: 400 * time.Millisecond, Frame: 10, Fps: 25, timecode: "00:00:00:10"},
+	{Time: 62 * time.Second, Frame: 1550, Fps: 25, timecode: "00:01:02:00"},
+}
+
+func TestExportScenes(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     SceneFormat
+		sceneTimes []VideoTime
+		output     string
+	}{
+		{
+			name:       "JSON",
+			format:     SceneFormatJSON,
+			sceneTimes: testSceneTimes,
+			output: `[
+  {
+    "frame": 10,
+    "time": 0.4,
+    "timecode": "00:00:00:10",
+    "fps": 25
+  },
+  {
+    "frame": 1550,
+    "time": 62,
+    "timecode": "00:01:02:00",
+    "fps": 25
+  }
+]
+`,
+		},
+		{
+			name:       "JSON without scene changes",
+			format:     SceneFormatJSON,
+			sceneTimes: nil,
+			output:     "[]\n",
+		},
+		{
+			name:       "CSV",
+			format:     SceneFormatCSV,
+			sceneTimes: testSceneTimes,
+			output: `frame,time,timecode,fps
+10,0.4,00:00:00:10,25
+1550,62,00:01:02:00,25
+`,
+		},
+		{
+			name:       "EDL",
+			format:     SceneFormatEDL,
+			sceneTimes: testSceneTimes,
+			output: "TITLE: clip.mp4\r\nFCM: NON-DROP FRAME\r\n\r\n" +
+				"001  AX       V     C        00:00:00:10 00:00:00:11 00:00:00:10 00:00:00:11\r\n" +
+				"* FROM CLIP NAME: clip.mp4\r\n" +
+				" |C:ResolveColorRed |M:Scene change 1 |D:1\r\n\r\n" +
+				"002  AX       V     C        00:01:02:00 00:01:02:01 00:01:02:00 00:01:02:01\r\n" +
+				"* FROM CLIP NAME: clip.mp4\r\n" +
+				" |C:ResolveColorRed |M:Scene change 2 |D:1\r\n\r\n",
+		},
+		{
+			name:       "drop-frame EDL",
+			format:     SceneFormatEDL,
+			sceneTimes: []VideoTime{{Time: 60060 * time.Millisecond, Frame: 1800, Fps: 29.97}},
+			output: "TITLE: clip.mp4\r\nFCM: DROP FRAME\r\n\r\n" +
+				"001  AX       V     C        00:01:00;02 00:01:00;03 00:01:00;02 00:01:00;03\r\n" +
+				"* FROM CLIP NAME: clip.mp4\r\n" +
+				" |C:ResolveColorRed |M:Scene change 1 |D:1\r\n\r\n",
+		},
+		{
+			name:       "FCPXML",
+			format:     SceneFormatFCPXML,
+			sceneTimes: testSceneTimes,
+			output: `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE fcpxml>
+<fcpxml version="1.8">
+  <resources>
+    <format id="r1" frameDuration="1/25s"></format>
+  </resources>
+  <library>
+    <event name="clip.mp4">
+      <project name="clip.mp4">
+        <sequence format="r1" tcStart="0s" tcFormat="NDF">
+          <spine>
+            <gap name="Gap" offset="0s" start="0s" duration="1551/25s">
+              <marker start="10/25s" duration="1/25s" value="Scene change 1"></marker>
+              <marker start="1550/25s" duration="1/25s" value="Scene change 2"></marker>
+            </gap>
+          </spine>
+        </sequence>
+      </project>
+    </event>
+  </library>
+</fcpxml>
+`,
+		},
+		{
+			name:       "text",
+			format:     SceneFormatText,
+			sceneTimes: testSceneTimes,
+			output:     "00:00:00:10\n00:01:02:00\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var output bytes.Buffer
+			if err := ExportScenes(&output, test.format, "clip.mp4", test.sceneTimes); err != nil {
+				t.Fatal(err)
+			}
+			if output.String() != test.output {
+				t.Fatalf("got output\n%q\nwant\n%q", output.String(), test.output)
+			}
+		})
+	}
+}
+
+func TestSceneFormatForFile(t *testing.T) {
+	tests := []struct {
+		fileName string
+		format   SceneFormat
+		err      bool
+	}{
+		{fileName: "scenes.json", format: SceneFormatJSON},
+		{fileName: "scenes.CSV", format: SceneFormatCSV},
+		{fileName: "dir.d/scenes.edl", format: SceneFormatEDL},
+		{fileName: "scenes.fcpxml", format: SceneFormatFCPXML},
+		{fileName: "scenes.txt", format: SceneFormatText},
+		{fileName: "scenes.xml", err: true},
+		{fileName: "scenes", err: true},
+	}
+
+	for _, test := range tests {
+		format, err := SceneFormatForFile(test.fileName)
+		if (err != nil) != test.err || format != test.format {
+			t.Errorf("SceneFormatForFile(%s) = %s, %v, want %s", test.fileName, format, err, test.format)
+		}
+	}
+}
+
+func TestFrameTimecode(t *testing.T) {
+	tests := []struct {
+		frame    uint64
+		fps      float64
+		timecode string
+	}{
+		{frame: 0, fps: 25, timecode: "00:00:00:00"},
+		{frame: 90000, fps: 25, timecode: "01:00:00:00"},
+		{frame: 24, fps: 23.976, timecode: "00:00:01:00"},
+		{frame: 1799, fps: 29.97, timecode: "00:00:59;29"},
+		{frame: 1800, fps: 29.97, timecode: "00:01:00;02"},
+		{frame: 17982, fps: 29.97, timecode: "00:10:00;00"},
+		{frame: 3600, fps: 59.94, timecode: "00:01:00;04"},
+		// an unknown frame rate counts the frames as seconds
+		{frame: 7, fps: 0, timecode: "00:00:07:00"},
+	}
+
+	for _, test := range tests {
+		if timecode := frameTimecode(test.frame, test.fps); timecode != test.timecode {
+			t.Errorf("frameTimecode(%d, %v) = %s, want %s", test.frame, test.fps, timecode, test.timecode)
+		}
+	}
+}
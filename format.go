@@ -0,0 +1,303 @@
+package moshpit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Fit determines how a video is fit into the size of an AviFormat
+// if its aspect ratio differs from the aspect ratio of the size.
+type Fit string
+
+const (
+	// FitPad scales the video to fit into the size,
+	// filling the remaining area with black bars.
+	FitPad Fit = "pad"
+	// FitCrop scales the video to cover the size,
+	// cropping the parts that exceed it.
+	FitCrop Fit = "crop"
+	// FitStretch scales the video to the size, distorting it.
+	FitStretch Fit = "stretch"
+)
+
+// the MPEG-4 Part 2 encoders whose frames can be moshed
+const (
+	// EncoderMpeg4 is the native MPEG-4 encoder of ffmpeg.
+	EncoderMpeg4 = "mpeg4"
+	// EncoderXvid is the Xvid encoder, which requires
+	// ffmpeg to be built with libxvid.
+	EncoderXvid = "libxvid"
+)
+
+// AviFormat describes the format of the video stream
+// of a moshable AVI file written by ConvertToAvi.
+// The zero AviFormat keeps the frame rate, resolution and
+// pixel format of the input file and uses the mpeg4 encoder.
+type AviFormat struct {
+	// FrameRate is the constant frame rate the video is converted to
+	// by duplicating or dropping frames, or 0 to keep its frame rate.
+	FrameRate Rational `json:"frameRate"`
+	// ConstantFrameRate specifies whether a video with a variable
+	// frame rate is converted to its average frame rate if FrameRate is 0,
+	// so the frame indices match the timestamps of the input file.
+	ConstantFrameRate bool `json:"constantFrameRate"`
+	// Width and Height are the resolution the video is scaled to.
+	// If only one of them is 0, it is chosen to keep the aspect ratio,
+	// and if both are 0, the video is not scaled.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Fit determines how the video is fit into the resolution
+	// if both Width and Height are set. The default is FitPad.
+	Fit Fit `json:"fit"`
+	// PixelFormat is the ffmpeg pixel format of the video,
+	// like yuv420p, or an empty string for the default of the encoder.
+	PixelFormat string `json:"pixelFormat"`
+	// Encoder is EncoderMpeg4 or EncoderXvid.
+	// The default is EncoderMpeg4.
+	Encoder string `json:"encoder"`
+}
+
+// ParseFrameRate parses a frame rate like 25, 29.97 or 30000/1001.
+func ParseFrameRate(s string) (Rational, error) {
+	s = strings.TrimSpace(s)
+	invalid := fmt.Errorf(`"%s" is not a valid frame rate`, s)
+
+	var rate Rational
+	if strings.Contains(s, "/") {
+		var err error
+		if rate, err = parseRational(s); err != nil {
+			return Rational{}, invalid
+		}
+	} else {
+		fps, err := strconv.ParseFloat(s, 64)
+		if err != nil || fps > math.MaxInt32 {
+			return Rational{}, invalid
+		}
+		// keep up to three decimal places, like 23.976
+		rate = Rational{Num: int64(math.Round(fps * 1000)), Den: 1000}
+	}
+	if rate.Num <= 0 || rate.Den <= 0 {
+		return Rational{}, invalid
+	}
+	return rate.reduce(), nil
+}
+
+// ParseSize parses a resolution in the format <width>x<height>,
+// like 1280x720. Either dimension may be 0 to keep the aspect ratio.
+func ParseSize(s string) (int, int, error) {
+	invalid := fmt.Errorf(`"%s" is not a valid size, must be in the format <width>x<height>`, s)
+	spl := strings.SplitN(strings.ToLower(strings.TrimSpace(s)), "x", 2)
+	if len(spl) != 2 {
+		return 0, 0, invalid
+	}
+	width, err := strconv.ParseUint(spl[0], 10, 16)
+	if err != nil {
+		return 0, 0, invalid
+	}
+	height, err := strconv.ParseUint(spl[1], 10, 16)
+	if err != nil {
+		return 0, 0, invalid
+	}
+	return int(width), int(height), nil
+}
+
+// ParseFit parses the name of a Fit.
+func ParseFit(s string) (Fit, error) {
+	fit := Fit(strings.ToLower(strings.TrimSpace(s)))
+	switch fit {
+	case FitPad, FitCrop, FitStretch:
+		return fit, nil
+	default:
+		return "", fmt.Errorf(`unknown fit "%s", must be %s, %s or %s`, s, FitPad, FitCrop, FitStretch)
+	}
+}
+
+// ParseEncoder parses the name of an MPEG-4 encoder,
+// which is EncoderMpeg4 or EncoderXvid.
+func ParseEncoder(s string) (string, error) {
+	encoder := strings.ToLower(strings.TrimSpace(s))
+	switch encoder {
+	case EncoderMpeg4, EncoderXvid:
+		return encoder, nil
+	default:
+		return "", fmt.Errorf(`unknown encoder "%s", must be %s or %s`, s, EncoderMpeg4, EncoderXvid)
+	}
+}
+
+// IsZero returns whether the format keeps the format of the input file
+// and uses the mpeg4 encoder.
+func (f AviFormat) IsZero() bool {
+	return f.normalized() == AviFormat{}
+}
+
+// String returns a description of the format,
+// like "1280x720 (pad), 30/1 fps, mpeg4".
+func (f AviFormat) String() string {
+	var parts []string
+	if f.Width > 0 || f.Height > 0 {
+		size := fmt.Sprintf("%dx%d", f.Width, f.Height)
+		if f.Width > 0 && f.Height > 0 {
+			size += fmt.Sprintf(" (%s)", f.fit())
+		}
+		parts = append(parts, size)
+	}
+	if f.FrameRate.Num > 0 {
+		parts = append(parts, f.FrameRate.String()+" fps")
+	} else if f.ConstantFrameRate {
+		parts = append(parts, "constant frame rate")
+	}
+	if f.PixelFormat != "" {
+		parts = append(parts, f.PixelFormat)
+	}
+	parts = append(parts, f.encoder())
+	return strings.Join(parts, ", ")
+}
+
+// VideoFrameRate returns the frame rate of the AVI file
+// the video stream is converted to.
+func (f AviFormat) VideoFrameRate(video *StreamInfo) float64 {
+	if f.FrameRate.Num > 0 {
+		return f.FrameRate.Float64()
+	}
+	return video.FrameRate()
+}
+
+// VideoFrameCount returns the number of frames of the AVI file
+// the video stream is converted to, which is estimated from
+// the duration of the video stream if its frame rate is changed.
+func (f AviFormat) VideoFrameCount(video *StreamInfo) uint64 {
+	if f.FrameRate.Num == 0 || video.Duration == 0 {
+		return video.FrameCount
+	}
+	return uint64(math.Round(video.Duration.Seconds() * f.FrameRate.Float64()))
+}
+
+func (f AviFormat) validate() error {
+	if f.FrameRate.Num < 0 || (f.FrameRate.Num > 0 && f.FrameRate.Den <= 0) {
+		return errors.New("the frame rate must be positive")
+	}
+	if f.Width < 0 || f.Height < 0 {
+		return errors.New("the resolution must not be negative")
+	}
+	if f.Width%2 != 0 || f.Height%2 != 0 {
+		return errors.New("the width and height must be even")
+	}
+	if f.Fit != "" {
+		if _, err := ParseFit(string(f.Fit)); err != nil {
+			return err
+		}
+	}
+	if f.Encoder != "" {
+		if _, err := ParseEncoder(f.Encoder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalized returns the format with the fields
+// that are set to their default values cleared,
+// so equivalent formats are equal.
+func (f AviFormat) normalized() AviFormat {
+	if f.FrameRate.Num > 0 {
+		f.FrameRate = f.FrameRate.reduce()
+		f.ConstantFrameRate = false
+	}
+	if f.Width == 0 || f.Height == 0 || f.Fit == FitPad {
+		f.Fit = ""
+	}
+	if f.Encoder == EncoderMpeg4 {
+		f.Encoder = ""
+	}
+	return f
+}
+
+func (f AviFormat) fit() Fit {
+	if f.Fit == "" {
+		return FitPad
+	}
+	return f.Fit
+}
+
+func (f AviFormat) encoder() string {
+	if f.Encoder == "" {
+		return EncoderMpeg4
+	}
+	return f.Encoder
+}
+
+// frameRateFilter returns the ffmpeg filter converting the video stream
+// to a constant frame rate, or an empty string if it keeps its frame rate.
+// It fails if the video is converted to its own frame rate,
+// but ffprobe didn't report it.
+func (f AviFormat) frameRateFilter(video *StreamInfo) (string, error) {
+	rate := f.FrameRate
+	if rate.Num == 0 {
+		if !f.ConstantFrameRate {
+			return "", nil
+		}
+		if rate = video.AvgFrameRate; rate.Num <= 0 || rate.Den <= 0 {
+			rate = video.RFrameRate
+		}
+		if rate.Num <= 0 || rate.Den <= 0 {
+			return "", errors.New("the frame rate of the video is unknown, set FrameRate")
+		}
+	}
+	return "fps=" + rate.String(), nil
+}
+
+// filters returns the ffmpeg filters converting the video stream
+// to the frame rate and resolution of the format.
+func (f AviFormat) filters(video *StreamInfo) ([]string, error) {
+	var filters []string
+	fps, err := f.frameRateFilter(video)
+	if err != nil {
+		return nil, err
+	}
+	if fps != "" {
+		filters = append(filters, fps)
+	}
+
+	if f.Width == 0 && f.Height == 0 {
+		return filters, nil
+	}
+	if f.Width == 0 || f.Height == 0 {
+		// scale to an even size keeping the aspect ratio
+		w, h := strconv.Itoa(f.Width), strconv.Itoa(f.Height)
+		if f.Width == 0 {
+			w = "-2"
+		} else {
+			h = "-2"
+		}
+		return append(filters, fmt.Sprintf("scale=%s:%s", w, h), "setsar=1"), nil
+	}
+
+	size := fmt.Sprintf("%d:%d", f.Width, f.Height)
+	switch f.fit() {
+	case FitCrop:
+		filters = append(filters,
+			"scale="+size+":force_original_aspect_ratio=increase",
+			"crop="+size)
+	case FitStretch:
+		filters = append(filters, "scale="+size)
+	default:
+		filters = append(filters,
+			"scale="+size+":force_original_aspect_ratio=decrease",
+			"pad="+size+":(ow-iw)/2:(oh-ih)/2")
+	}
+	// the pixels of the scaled video are square
+	return append(filters, "setsar=1"), nil
+}
+
+// encodeArgs returns the ffmpeg output options
+// selecting the encoder and pixel format.
+func (f AviFormat) encodeArgs() []string {
+	args := []string{"-c:v", f.encoder()}
+	if f.PixelFormat != "" {
+		args = append(args, "-pix_fmt", f.PixelFormat)
+	}
+	return args
+}
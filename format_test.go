@@ -0,0 +1,351 @@
+package moshpit
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFrameRate(t *testing.T) {
+	tests := []struct {
+		s       string
+		rate    Rational
+		invalid bool
+	}{
+		{s: "25", rate: Rational{25, 1}},
+		{s: " 29.97 ", rate: Rational{2997, 100}},
+		{s: "23.976", rate: Rational{2997, 125}},
+		{s: "30000/1001", rate: Rational{30000, 1001}},
+		{s: "60/2", rate: Rational{30, 1}},
+		{s: "0", invalid: true},
+		{s: "-25", invalid: true},
+		{s: "25/0", invalid: true},
+		{s: "1e10", invalid: true},
+		{s: "fast", invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.s, func(t *testing.T) {
+			rate, err := ParseFrameRate(test.s)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("got %s, want an error", rate)
+				}
+				return
+			}
+			if err != nil || rate != test.rate {
+				t.Fatalf("got %s and error %v, want %s", rate, err, test.rate)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s       string
+		width   int
+		height  int
+		invalid bool
+	}{
+		{s: "1280x720", width: 1280, height: 720},
+		{s: " 640X0 ", width: 640, height: 0},
+		{s: "0x480", width: 0, height: 480},
+		{s: "1280", invalid: true},
+		{s: "1280x", invalid: true},
+		{s: "-1x720", invalid: true},
+		{s: "1280x720x1", invalid: true},
+		{s: "100000x720", invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.s, func(t *testing.T) {
+			width, height, err := ParseSize(test.s)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("got %dx%d, want an error", width, height)
+				}
+				return
+			}
+			if err != nil || width != test.width || height != test.height {
+				t.Fatalf("got %dx%d and error %v, want %dx%d", width, height, err, test.width, test.height)
+			}
+		})
+	}
+}
+
+func TestParseFitAndEncoder(t *testing.T) {
+	if fit, err := ParseFit(" Crop "); err != nil || fit != FitCrop {
+		t.Fatalf("got fit %s and error %v, want %s", fit, err, FitCrop)
+	}
+	if _, err := ParseFit("zoom"); err == nil || err.Error() != `unknown fit "zoom", must be pad, crop or stretch` {
+		t.Fatalf("got error %v for an unknown fit", err)
+	}
+	if encoder, err := ParseEncoder("LIBXVID"); err != nil || encoder != EncoderXvid {
+		t.Fatalf("got encoder %s and error %v, want %s", encoder, err, EncoderXvid)
+	}
+	if _, err := ParseEncoder("libx264"); err == nil || err.Error() != `unknown encoder "libx264", must be mpeg4 or libxvid` {
+		t.Fatalf("got error %v for an unknown encoder", err)
+	}
+}
+
+func TestAviFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		format AviFormat
+		str    string
+		zero   bool
+		err    string
+	}{
+		{
+			name:   "zero",
+			format: AviFormat{},
+			str:    "mpeg4",
+			zero:   true,
+		},
+		{
+			name:   "default values",
+			format: AviFormat{Width: 640, Fit: FitCrop, Encoder: EncoderMpeg4},
+			str:    "640x0, mpeg4",
+		},
+		{
+			name:   "default fit",
+			format: AviFormat{Fit: FitPad, Encoder: EncoderMpeg4},
+			str:    "mpeg4",
+			zero:   true,
+		},
+		{
+			name: "all fields",
+			format: AviFormat{
+				FrameRate: Rational{60, 2}, Width: 1280, Height: 720, Fit: FitStretch,
+				PixelFormat: "yuv420p", Encoder: EncoderXvid,
+			},
+			str: "1280x720 (stretch), 60/2 fps, yuv420p, libxvid",
+		},
+		{
+			name:   "constant frame rate",
+			format: AviFormat{ConstantFrameRate: true, Width: 640, Height: 480},
+			str:    "640x480 (pad), constant frame rate, mpeg4",
+		},
+		{
+			name:   "negative frame rate",
+			format: AviFormat{FrameRate: Rational{-25, 1}},
+			err:    "the frame rate must be positive",
+		},
+		{
+			name:   "frame rate without denominator",
+			format: AviFormat{FrameRate: Rational{25, 0}},
+			err:    "the frame rate must be positive",
+		},
+		{
+			name:   "negative resolution",
+			format: AviFormat{Width: -2},
+			err:    "the resolution must not be negative",
+		},
+		{
+			name:   "odd resolution",
+			format: AviFormat{Width: 640, Height: 481},
+			err:    "the width and height must be even",
+		},
+		{
+			name:   "unknown fit",
+			format: AviFormat{Fit: "zoom"},
+			err:    `unknown fit "zoom", must be pad, crop or stretch`,
+		},
+		{
+			name:   "unknown encoder",
+			format: AviFormat{Encoder: "h264"},
+			err:    `unknown encoder "h264", must be mpeg4 or libxvid`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.format.validate()
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if str := test.format.String(); str != test.str {
+				t.Fatalf("got string %s, want %s", str, test.str)
+			}
+			if zero := test.format.IsZero(); zero != test.zero {
+				t.Fatalf("got IsZero %v, want %v", zero, test.zero)
+			}
+		})
+	}
+}
+
+func TestAviFormatNormalized(t *testing.T) {
+	// equivalent formats are equal when normalized,
+	// as they share the same cache entries
+	tests := []struct {
+		a AviFormat
+		b AviFormat
+	}{
+		{a: AviFormat{}, b: AviFormat{Encoder: EncoderMpeg4, Fit: FitCrop}},
+		{a: AviFormat{FrameRate: Rational{25, 1}}, b: AviFormat{FrameRate: Rational{50, 2}, ConstantFrameRate: true}},
+		{a: AviFormat{Width: 640, Height: 480}, b: AviFormat{Width: 640, Height: 480, Fit: FitPad}},
+		{a: AviFormat{Width: 640}, b: AviFormat{Width: 640, Fit: FitStretch}},
+	}
+
+	for _, test := range tests {
+		if test.a.normalized() != test.b.normalized() {
+			t.Errorf("normalized formats %+v and %+v differ", test.a, test.b)
+		}
+	}
+	if (AviFormat{Width: 640, Height: 480}).normalized() == (AviFormat{Width: 640, Height: 480, Fit: FitCrop}).normalized() {
+		t.Error("normalized formats with different fits are equal")
+	}
+}
+
+func TestAviFormatVideo(t *testing.T) {
+	video := &StreamInfo{
+		Duration:     10 * time.Second,
+		FrameCount:   299,
+		RFrameRate:   Rational{30, 1},
+		AvgFrameRate: Rational{299, 10},
+	}
+	tests := []struct {
+		name   string
+		format AviFormat
+		video  *StreamInfo
+		fps    float64
+		count  uint64
+	}{
+		{name: "input frame rate", format: AviFormat{}, video: video, fps: 29.9, count: 299},
+		{name: "converted frame rate", format: AviFormat{FrameRate: Rational{25, 1}}, video: video, fps: 25, count: 250},
+		{
+			name:   "unknown duration",
+			format: AviFormat{FrameRate: Rational{25, 1}},
+			video:  &StreamInfo{FrameCount: 100, RFrameRate: Rational{30, 1}},
+			fps:    25,
+			count:  100,
+		},
+	}
+
+	for _, test := range tests {
+		if fps := test.format.VideoFrameRate(test.video); fps != test.fps {
+			t.Errorf("%s: got frame rate %v, want %v", test.name, fps, test.fps)
+		}
+		if count := test.format.VideoFrameCount(test.video); count != test.count {
+			t.Errorf("%s: got frame count %d, want %d", test.name, count, test.count)
+		}
+	}
+}
+
+func TestAviFormatArgs(t *testing.T) {
+	video := &StreamInfo{RFrameRate: Rational{30, 1}, AvgFrameRate: Rational{30000, 1001}}
+	tests := []struct {
+		name    string
+		format  AviFormat
+		video   *StreamInfo
+		filters string
+		args    string
+		err     string
+	}{
+		{
+			name:   "zero",
+			format: AviFormat{},
+			video:  video,
+			args:   "-c:v mpeg4",
+		},
+		{
+			name:    "frame rate",
+			format:  AviFormat{FrameRate: Rational{25, 1}, ConstantFrameRate: true},
+			video:   video,
+			filters: "fps=25/1",
+			args:    "-c:v mpeg4",
+		},
+		{
+			name:    "average frame rate",
+			format:  AviFormat{ConstantFrameRate: true},
+			video:   video,
+			filters: "fps=30000/1001",
+			args:    "-c:v mpeg4",
+		},
+		{
+			name:    "unknown average frame rate",
+			format:  AviFormat{ConstantFrameRate: true},
+			video:   &StreamInfo{RFrameRate: Rational{30, 1}, AvgFrameRate: Rational{0, 0}},
+			filters: "fps=30/1",
+			args:    "-c:v mpeg4",
+		},
+		{
+			name:   "unknown frame rate",
+			format: AviFormat{ConstantFrameRate: true},
+			video:  &StreamInfo{RFrameRate: Rational{0, 0}, AvgFrameRate: Rational{0, 0}},
+			err:    "the frame rate of the video is unknown, set FrameRate",
+		},
+		{
+			name:   "unknown frame rate kept",
+			format: AviFormat{},
+			video:  &StreamInfo{},
+			args:   "-c:v mpeg4",
+		},
+		{
+			name:    "unknown frame rate converted",
+			format:  AviFormat{FrameRate: Rational{25, 1}},
+			video:   &StreamInfo{},
+			filters: "fps=25/1",
+			args:    "-c:v mpeg4",
+		},
+		{
+			name:    "width",
+			format:  AviFormat{Width: 640, PixelFormat: "yuv420p"},
+			video:   video,
+			filters: "scale=640:-2,setsar=1",
+			args:    "-c:v mpeg4 -pix_fmt yuv420p",
+		},
+		{
+			name:    "height",
+			format:  AviFormat{Height: 480, Encoder: EncoderXvid},
+			video:   video,
+			filters: "scale=-2:480,setsar=1",
+			args:    "-c:v libxvid",
+		},
+		{
+			name:    "pad",
+			format:  AviFormat{FrameRate: Rational{24, 1}, Width: 640, Height: 480},
+			video:   video,
+			filters: "fps=24/1,scale=640:480:force_original_aspect_ratio=decrease,pad=640:480:(ow-iw)/2:(oh-ih)/2,setsar=1",
+			args:    "-c:v mpeg4",
+		},
+		{
+			name:    "crop",
+			format:  AviFormat{Width: 640, Height: 480, Fit: FitCrop},
+			video:   video,
+			filters: "scale=640:480:force_original_aspect_ratio=increase,crop=640:480,setsar=1",
+			args:    "-c:v mpeg4",
+		},
+		{
+			name:    "stretch",
+			format:  AviFormat{Width: 640, Height: 480, Fit: FitStretch},
+			video:   video,
+			filters: "scale=640:480,setsar=1",
+			args:    "-c:v mpeg4",
+		},
+	}
+
+	for _, test := range tests {
+		filters, err := test.format.filters(test.video)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if filters := strings.Join(filters, ","); filters != test.filters {
+			t.Errorf("%s: got filters %s, want %s", test.name, filters, test.filters)
+		}
+		if args := strings.Join(test.format.encodeArgs(), " "); args != test.args {
+			t.Errorf("%s: got arguments %s, want %s", test.name, args, test.args)
+		}
+	}
+}
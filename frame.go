@@ -0,0 +1,285 @@
+package moshpit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crushedpixel/go-timecode/timecode"
+)
+
+// ErrNoFrameRate is returned when converting timecodes or times
+// to frame indices without knowing the frame rate of the video.
+var ErrNoFrameRate = errors.New("the frame rate is required to convert timecodes to frame indices")
+
+// ErrNoFrameCount is returned when resolving negative offsets
+// from the end of the video without knowing its frame count.
+var ErrNoFrameCount = errors.New("the frame count is required to resolve offsets from the end of the video")
+
+// maxRangeFrames is the maximum number of frames
+// a range of a frame specification expands to.
+const maxRangeFrames = 1000000
+
+// ParseFrameSpec expands a frame specification into frame indices.
+// The specification is one of the following:
+//
+//	120, 00:01:12:05, 72.2s  a single frame as accepted by ParseFrame
+//	-30, -2s                 an offset from the end of the video, -1 being the last frame
+//	100-400                  all frames from 100 up to and including 400
+//	100-400/25               every 25th frame from 100 up to 400
+//	all                      the frames of all scene changes
+//	scenes[2:5]              the frames of the scene changes with the indices 2 up to
+//	                         excluding 5, with omitted and negative indices behaving
+//	                         like in Python slices, or a single scene change like scenes[-1]
+//
+// The frame rate is required to convert timecodes and times,
+// and the frame count of the video to resolve negative offsets.
+// If they are required but 0, ErrNoFrameRate or ErrNoFrameCount is returned.
+// If the frame count is known, ranges must end before it.
+// A range expands to at most 1,000,000 frames.
+// The scene changes are the ones found by FindScenes.
+func ParseFrameSpec(spec string, fps float64, frameCount uint64, sceneTimes []VideoTime) ([]uint64, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.EqualFold(spec, "all") {
+		if len(sceneTimes) == 0 {
+			return nil, errors.New("no scene changes were found")
+		}
+		return sceneFrames(sceneTimes), nil
+	}
+
+	if strings.HasPrefix(strings.ToLower(spec), "scenes[") {
+		if !strings.HasSuffix(spec, "]") {
+			return nil, fmt.Errorf(`"%s" is not a valid scene selector`, spec)
+		}
+		return selectScenes(spec[len("scenes["):len(spec)-1], sceneTimes)
+	}
+
+	// split off the stride
+	stride := uint64(1)
+	rangeSpec := spec
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		var err error
+		stride, err = strconv.ParseUint(spec[i+1:], 10, 64)
+		if err != nil || stride == 0 {
+			return nil, fmt.Errorf(`"%s" is not a valid stride`, spec[i+1:])
+		}
+		rangeSpec = spec[:i]
+	}
+
+	// the range separator is the first dash that
+	// is not the sign of a negative start offset
+	sep := strings.Index(strings.TrimPrefix(rangeSpec, "-"), "-")
+	if sep < 0 {
+		if rangeSpec != spec {
+			return nil, fmt.Errorf(`"%s": a stride can only be applied to a range`, spec)
+		}
+		frame, err := parseFrameOffset(spec, fps, frameCount)
+		if err != nil {
+			return nil, err
+		}
+		return []uint64{frame}, nil
+	}
+	if strings.HasPrefix(rangeSpec, "-") {
+		sep++
+	}
+
+	start, err := parseFrameOffset(rangeSpec[:sep], fps, frameCount)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseFrameOffset(rangeSpec[sep+1:], fps, frameCount)
+	if err != nil {
+		return nil, err
+	}
+	if end < start {
+		return nil, fmt.Errorf(`"%s": the end of the range is before its start`, spec)
+	}
+
+	if frameCount > 0 && end >= frameCount {
+		return nil, fmt.Errorf(`"%s": the end of the range is after the last frame %d`, spec, frameCount-1)
+	}
+
+	// the number of frames following the start,
+	// which doesn't overflow at the end of the value range
+	count := (end - start) / stride
+	if count >= maxRangeFrames {
+		return nil, fmt.Errorf(`"%s": the range must not select more than %d frames`, spec, maxRangeFrames)
+	}
+	frames := make([]uint64, count+1)
+	for i := range frames {
+		frames[i] = start + uint64(i)*stride
+	}
+	return frames, nil
+}
+
+// parseFrameOffset parses a frame as accepted by ParseFrame,
+// or an offset from the end of the video if it is negative.
+func parseFrameOffset(s string, fps float64, frameCount uint64) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "-") {
+		return ParseFrame(s, fps)
+	}
+
+	offset, err := ParseFrame(s[1:], fps)
+	if err != nil {
+		return 0, err
+	}
+	if frameCount == 0 {
+		return 0, ErrNoFrameCount
+	}
+	if offset == 0 || offset > frameCount {
+		return 0, fmt.Errorf(`"%s" is not a valid offset for a video with %d frames`, s, frameCount)
+	}
+	return frameCount - offset, nil
+}
+
+// selectScenes returns the frames of the scene changes
+// selected by a Python-style index or slice.
+func selectScenes(selector string, sceneTimes []VideoTime) ([]uint64, error) {
+	n := len(sceneTimes)
+	if n == 0 {
+		return nil, errors.New("no scene changes were found")
+	}
+
+	// parseIndex parses a scene index, resolving negative indices
+	parseIndex := func(s string) (int, error) {
+		i, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return 0, fmt.Errorf(`"%s" is not a valid scene index`, s)
+		}
+		if i < 0 {
+			i += n
+		}
+		return i, nil
+	}
+
+	spl := strings.Split(selector, ":")
+	switch len(spl) {
+	case 1:
+		i, err := parseIndex(spl[0])
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= n {
+			return nil, fmt.Errorf("scene index %s is out of range, %d scene changes were found", spl[0], n)
+		}
+		return []uint64{sceneTimes[i].Frame}, nil
+	case 2:
+		start, end := 0, n
+		var err error
+		if strings.TrimSpace(spl[0]) != "" {
+			if start, err = parseIndex(spl[0]); err != nil {
+				return nil, err
+			}
+		}
+		if strings.TrimSpace(spl[1]) != "" {
+			if end, err = parseIndex(spl[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		// clamp the slice bounds like Python does
+		start = clamp(start, 0, n)
+		end = clamp(end, start, n)
+		if start == end {
+			return nil, fmt.Errorf("scenes[%s] selects none of the %d scene changes", selector, n)
+		}
+		return sceneFrames(sceneTimes[start:end]), nil
+	}
+	return nil, fmt.Errorf(`"scenes[%s]" is not a valid scene selector`, selector)
+}
+
+// sceneFrames returns the frame indices of the scene changes.
+func sceneFrames(sceneTimes []VideoTime) []uint64 {
+	frames := make([]uint64, len(sceneTimes))
+	for i, sceneTime := range sceneTimes {
+		frames[i] = sceneTime.Frame
+	}
+	return frames
+}
+
+func clamp(v int, min int, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// ParseFrame parses a frame index, a SMPTE timecode like 00:01:12:05,
+// or a time like 72.2s or 1m12.2s, returning the frame index.
+// Timecodes and times are converted to frame indices using the
+// frame rate of the video they refer to, which may be 0
+// if only frame indices are to be parsed.
+// For NTSC frame rates like 29.97 fps, timecodes are treated
+// as drop-frame timecodes, which may also be written
+// with a semicolon like 00:01:12;05.
+func ParseFrame(s string, fps float64) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if frame, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return frame, nil
+	}
+
+	if strings.ContainsAny(s, ":;") {
+		return timecodeFrame(s, fps)
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf(`"%s" is not a valid frame index, timecode or time`, s)
+	}
+	return timeFrame(d, fps)
+}
+
+// timecodeFrame returns the frame index of the SMPTE timecode
+// at the given frame rate, treating timecodes as drop-frame
+// timecodes for NTSC frame rates like 29.97 fps.
+func timecodeFrame(s string, fps float64) (uint64, error) {
+	if fps <= 0 {
+		return 0, ErrNoFrameRate
+	}
+	tc, err := timecode.Parse(s)
+	if err != nil {
+		return 0, fmt.Errorf(`"%s" is not a valid timecode`, s)
+	}
+	rate := timecode.NewFloatRate(float32(fps))
+	tc.SetRate(rate)
+	return uint64(tc.FrameAtRate(rate)), nil
+}
+
+// timeFrame returns the index of the frame
+// shown at the given time at the given frame rate.
+func timeFrame(t time.Duration, fps float64) (uint64, error) {
+	if fps <= 0 {
+		return 0, ErrNoFrameRate
+	}
+	if t < 0 {
+		return 0, fmt.Errorf("%s is not a valid time", t)
+	}
+	rate := timecode.NewFloatRate(float32(fps))
+	return uint64(timecode.New(t, rate).FrameAtRate(rate)), nil
+}
+
+// secondsFrame returns the index of the frame
+// shown at the given time in seconds.
+func secondsFrame(seconds float64, fps float64) (uint64, error) {
+	if math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, fmt.Errorf("%f is not a valid time in seconds", seconds)
+	}
+	return timeFrame(time.Duration(seconds*float64(time.Second)), fps)
+}
+
+// parseSecondsFrame parses a time in seconds,
+// returning the index of the frame shown at that time.
+func parseSecondsFrame(s string, fps float64) (uint64, error) {
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, fmt.Errorf(`"%s" is not a valid time in seconds`, s)
+	}
+	return secondsFrame(seconds, fps)
+}
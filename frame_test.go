@@ -0,0 +1,167 @@
+package moshpit
+
+import "testing"
+
+func TestParseFrame(t *testing.T) {
+	tests := []struct {
+		s     string
+		fps   float64
+		frame uint64
+		err   error
+	}{
+		{s: "0", fps: 0, frame: 0},
+		{s: " 120 ", fps: 0, frame: 120},
+		{s: "18446744073709551615", fps: 0, frame: 18446744073709551615},
+		{s: "00:01:12:05", fps: 25, frame: 1805},
+		{s: "00:01:00:00", fps: 30, frame: 1800},
+		{s: "01:00:00:00", fps: 24, frame: 86400},
+		{s: "72.2s", fps: 25, frame: 1805},
+		{s: "1m12.2s", fps: 25, frame: 1805},
+		{s: "500ms", fps: 30, frame: 15},
+
+		// drop-frame timecodes skip the first two frame numbers
+		// of each minute except every tenth minute
+		{s: "00:00:59;29", fps: 29.97, frame: 1799},
+		{s: "00:01:00;02", fps: 29.97, frame: 1800},
+		{s: "00:01:00:02", fps: 29.97, frame: 1800},
+		{s: "00:02:00;02", fps: 29.97, frame: 3598},
+		{s: "00:10:00;00", fps: 29.97, frame: 17982},
+		{s: "01:00:00;00", fps: 29.97, frame: 107892},
+		{s: "00:01:00;04", fps: 59.94, frame: 3600},
+
+		{s: "00:01:12:05", fps: 0, err: ErrNoFrameRate},
+		{s: "72.2s", fps: 0, err: ErrNoFrameRate},
+	}
+
+	for _, test := range tests {
+		t.Run(test.s, func(t *testing.T) {
+			frame, err := ParseFrame(test.s, test.fps)
+			if err != test.err || frame != test.frame {
+				t.Fatalf("got frame %d and error %v at %v fps, want frame %d and error %v",
+					frame, err, test.fps, test.frame, test.err)
+			}
+		})
+	}
+}
+
+func TestParseFrameInvalid(t *testing.T) {
+	for _, s := range []string{"", "abc", "-1", "-1s", "1.5", "00:01:xx:05", "18446744073709551616"} {
+		t.Run(s, func(t *testing.T) {
+			if frame, err := ParseFrame(s, 25); err == nil {
+				t.Fatalf("got frame %d, want an error", frame)
+			}
+		})
+	}
+}
+
+func TestParseFrameSpec(t *testing.T) {
+	scenes := []VideoTime{{Frame: 10}, {Frame: 50}, {Frame: 120}, {Frame: 400}, {Frame: 800}}
+	tests := []struct {
+		spec       string
+		frameCount uint64
+		scenes     []VideoTime
+		frames     []uint64
+		err        error
+		invalid    bool
+	}{
+		{spec: "120", frames: []uint64{120}},
+		{spec: "00:00:04:05", frames: []uint64{105}},
+		{spec: "4.2s", frames: []uint64{105}},
+
+		// offsets from the end of the video
+		{spec: "-1", frameCount: 1000, frames: []uint64{999}},
+		{spec: "-1000", frameCount: 1000, frames: []uint64{0}},
+		{spec: "-2s", frameCount: 1000, frames: []uint64{950}},
+		{spec: "-1001", frameCount: 1000, invalid: true},
+		{spec: "-0", frameCount: 1000, invalid: true},
+		{spec: "-1", frameCount: 0, err: ErrNoFrameCount},
+		{spec: "-1-5", frameCount: 0, err: ErrNoFrameCount},
+
+		// ranges
+		{spec: "100-104", frames: []uint64{100, 101, 102, 103, 104}},
+		{spec: "5-5", frames: []uint64{5}},
+		{spec: "00:00:04:00-00:00:04:02", frames: []uint64{100, 101, 102}},
+		{spec: "-10--8", frameCount: 1000, frames: []uint64{990, 991, 992}},
+		{spec: "-10-992", frameCount: 1000, frames: []uint64{990, 991, 992}},
+		{spec: "997--1", frameCount: 1000, frames: []uint64{997, 998, 999}},
+		{spec: "990-999", frameCount: 1000, frames: []uint64{990, 991, 992, 993, 994, 995, 996, 997, 998, 999}},
+		{spec: "990-1000", frameCount: 1000, invalid: true},
+		{spec: "10-5", invalid: true},
+		{spec: "10-", invalid: true},
+		{spec: "-", invalid: true},
+
+		// strides
+		{spec: "100-400/100", frames: []uint64{100, 200, 300, 400}},
+		{spec: "100-399/100", frames: []uint64{100, 200, 300}},
+		{spec: "100-400/1000", frames: []uint64{100}},
+		{spec: "10-20/0", invalid: true},
+		{spec: "10-20/-1", invalid: true},
+		{spec: "10-20/x", invalid: true},
+		{spec: "10/2", invalid: true},
+
+		// ranges expand to a limited number of frames
+		{spec: "0-18446744073709551615", invalid: true},
+		{spec: "0-1000000", invalid: true},
+		{spec: "0-2000000/2", invalid: true},
+		{spec: "0-2000000/3", frames: rangeFrames(0, 2000000, 3)},
+		{spec: "0-999999", frames: rangeFrames(0, 999999, 1)},
+
+		// strides near the end of the value range must not overflow
+		{spec: "18446744073709551610-18446744073709551615/2",
+			frames: []uint64{18446744073709551610, 18446744073709551612, 18446744073709551614}},
+		{spec: "18446744073709551614-18446744073709551615",
+			frames: []uint64{18446744073709551614, 18446744073709551615}},
+		{spec: "0-18446744073709551615/9223372036854775808",
+			frames: []uint64{0, 9223372036854775808}},
+		{spec: "0-18446744073709551615/18446744073709551615",
+			frames: []uint64{0, 18446744073709551615}},
+
+		// scene changes
+		{spec: "all", scenes: scenes, frames: []uint64{10, 50, 120, 400, 800}},
+		{spec: " ALL ", scenes: scenes, frames: []uint64{10, 50, 120, 400, 800}},
+		{spec: "all", invalid: true},
+		{spec: "scenes[1:3]", scenes: scenes, frames: []uint64{50, 120}},
+		{spec: "scenes[1]", scenes: scenes, frames: []uint64{50}},
+		{spec: "scenes[-1]", scenes: scenes, frames: []uint64{800}},
+		{spec: "scenes[-2:]", scenes: scenes, frames: []uint64{400, 800}},
+		{spec: "scenes[:2]", scenes: scenes, frames: []uint64{10, 50}},
+		{spec: "scenes[:]", scenes: scenes, frames: []uint64{10, 50, 120, 400, 800}},
+		{spec: "scenes[:-3]", scenes: scenes, frames: []uint64{10, 50}},
+		{spec: "scenes[-10:2]", scenes: scenes, frames: []uint64{10, 50}},
+		{spec: "scenes[3:100]", scenes: scenes, frames: []uint64{400, 800}},
+		{spec: "Scenes[ 0 : 1 ]", scenes: scenes, frames: []uint64{10}},
+		{spec: "scenes[3:1]", scenes: scenes, invalid: true},
+		{spec: "scenes[5:]", scenes: scenes, invalid: true},
+		{spec: "scenes[5]", scenes: scenes, invalid: true},
+		{spec: "scenes[-6]", scenes: scenes, invalid: true},
+		{spec: "scenes[1:2:3]", scenes: scenes, invalid: true},
+		{spec: "scenes[a]", scenes: scenes, invalid: true},
+		{spec: "scenes[1", scenes: scenes, invalid: true},
+		{spec: "scenes[0]", invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			frames, err := ParseFrameSpec(test.spec, 25, test.frameCount, test.scenes)
+			switch {
+			case test.invalid:
+				if err == nil {
+					t.Fatalf("got frames %v, want an error", frames)
+				}
+			case err != test.err:
+				t.Fatalf("got error %v, want %v", err, test.err)
+			case !equalFrames(frames, test.frames):
+				t.Fatalf("got frames %v, want %v", frames, test.frames)
+			}
+		})
+	}
+}
+
+// rangeFrames returns every stride-th frame from start up to end.
+func rangeFrames(start, end, stride uint64) []uint64 {
+	var frames []uint64
+	for frame := start; frame <= end; frame += stride {
+		frames = append(frames, frame)
+	}
+	return frames
+}
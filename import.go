@@ -0,0 +1,253 @@
+package moshpit
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImportFrames reads a list of frame indices from the input in the given format,
+// like the scene changes written by ExportScenes or the markers exported by an NLE.
+// Timecodes and times are converted to frame indices using the
+// frame rate of the video they refer to, which may be 0
+// if the input only contains frame indices.
+//
+// JSON input is an array of frame indices, timecodes or times, or objects with a
+// frame, timecode or time key. CSV input must have a header row,
+// with the values taken from the frame, timecode, source in, in, record in
+// or time column, whichever comes first in that order.
+// EDL input uses the source in timecode of each event,
+// and FCPXML input the start of each marker.
+// Text input has a frame index, timecode or time on each line,
+// ignoring empty lines and lines starting with #.
+func ImportFrames(input io.Reader, format SceneFormat, fps float64) ([]uint64, error) {
+	switch format {
+	case SceneFormatJSON:
+		return importFramesJSON(input, fps)
+	case SceneFormatCSV:
+		return importFramesCSV(input, fps)
+	case SceneFormatEDL:
+		return importFramesEDL(input, fps)
+	case SceneFormatFCPXML:
+		return importFramesFCPXML(input, fps)
+	case SceneFormatText:
+		return importFramesText(input, fps)
+	}
+	return nil, fmt.Errorf(`unsupported scene format "%s"`, format)
+}
+
+func importFramesJSON(input io.Reader, fps float64) ([]uint64, error) {
+	var values []json.RawMessage
+	if err := json.NewDecoder(input).Decode(&values); err != nil {
+		return nil, fmt.Errorf("error parsing JSON: %s", err.Error())
+	}
+
+	var frames []uint64
+	for i, value := range values {
+		frame, err := parseFrameJSON(value, fps)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %s", i, err.Error())
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// parseFrameJSON parses a frame index, a timecode,
+// or an object with a frame, timecode or time key.
+func parseFrameJSON(value json.RawMessage, fps float64) (uint64, error) {
+	var frame uint64
+	if err := json.Unmarshal(value, &frame); err == nil {
+		return frame, nil
+	}
+
+	var tc string
+	if err := json.Unmarshal(value, &tc); err == nil {
+		return ParseFrame(tc, fps)
+	}
+
+	var object struct {
+		Frame    *uint64  `json:"frame"`
+		Timecode *string  `json:"timecode"`
+		Time     *float64 `json:"time"`
+	}
+	if err := json.Unmarshal(value, &object); err != nil {
+		return 0, errors.New("must be a frame index, a timecode or an object")
+	}
+	switch {
+	case object.Frame != nil:
+		return *object.Frame, nil
+	case object.Timecode != nil:
+		return timecodeFrame(*object.Timecode, fps)
+	case object.Time != nil:
+		return secondsFrame(*object.Time, fps)
+	}
+	return 0, errors.New("object must have a frame, timecode or time key")
+}
+
+// the names of the CSV columns frames are read from,
+// in the order of preference
+var frameCSVColumns = []string{"frame", "timecode", "source in", "in", "record in", "time"}
+
+func importFramesCSV(input io.Reader, fps float64) ([]uint64, error) {
+	r := csv.NewReader(input)
+	// NLEs don't always write the same number of fields per row
+	r.FieldsPerRecord = -1
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %s", err.Error())
+	}
+
+	column := -1
+	var columnName string
+find:
+	for _, name := range frameCSVColumns {
+		for i, field := range header {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				column = i
+				columnName = name
+				break find
+			}
+		}
+	}
+	if column < 0 {
+		return nil, fmt.Errorf("CSV header must contain one of the columns %s", strings.Join(frameCSVColumns, ", "))
+	}
+
+	var frames []uint64
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV: %s", err.Error())
+		}
+		if column >= len(record) || strings.TrimSpace(record[column]) == "" {
+			continue
+		}
+
+		var frame uint64
+		if columnName == "time" {
+			frame, err = parseSecondsFrame(record[column], fps)
+		} else {
+			frame, err = ParseFrame(record[column], fps)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func importFramesEDL(input io.Reader, fps float64) ([]uint64, error) {
+	var frames []uint64
+	scanner := bufio.NewScanner(input)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+
+		// event lines start with the event number and
+		// end with the source and record in and out timecodes
+		if len(fields) < 8 {
+			continue
+		}
+		if _, err := strconv.ParseUint(fields[0], 10, 64); err != nil {
+			continue
+		}
+
+		frame, err := timecodeFrame(fields[len(fields)-4], fps)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		frames = append(frames, frame)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading EDL: %s", err.Error())
+	}
+	return frames, nil
+}
+
+func importFramesFCPXML(input io.Reader, fps float64) ([]uint64, error) {
+	var frames []uint64
+	decoder := xml.NewDecoder(input)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing FCPXML: %s", err.Error())
+		}
+
+		element, ok := token.(xml.StartElement)
+		if !ok || (element.Name.Local != "marker" && element.Name.Local != "chapter-marker") {
+			continue
+		}
+		for _, attr := range element.Attr {
+			if attr.Name.Local != "start" {
+				continue
+			}
+			t, err := parseFCPXMLTime(attr.Value)
+			if err != nil {
+				return nil, err
+			}
+			frame, err := timeFrame(t, fps)
+			if err != nil {
+				return nil, err
+			}
+			frames = append(frames, frame)
+		}
+	}
+}
+
+// parseFCPXMLTime parses an FCPXML time value,
+// which is a rational number of seconds like 1001/30000s.
+func parseFCPXMLTime(s string) (time.Duration, error) {
+	invalid := fmt.Errorf(`"%s" is not a valid FCPXML time`, s)
+	if !strings.HasSuffix(s, "s") {
+		return 0, invalid
+	}
+
+	spl := strings.SplitN(strings.TrimSuffix(s, "s"), "/", 2)
+	num, err := strconv.ParseInt(spl[0], 10, 64)
+	if err != nil || num < 0 {
+		return 0, invalid
+	}
+	den := int64(1)
+	if len(spl) == 2 {
+		den, err = strconv.ParseInt(spl[1], 10, 64)
+		if err != nil || den <= 0 {
+			return 0, invalid
+		}
+	}
+	return time.Duration(float64(num) / float64(den) * float64(time.Second)), nil
+}
+
+func importFramesText(input io.Reader, fps float64) ([]uint64, error) {
+	var frames []uint64
+	scanner := bufio.NewScanner(input)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		frame, err := ParseFrame(text, fps)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		frames = append(frames, frame)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading text: %s", err.Error())
+	}
+	return frames, nil
+}
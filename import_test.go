@@ -0,0 +1,182 @@
+package moshpit
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportFramesRoundTrip(t *testing.T) {
+	dropFrameSceneTimes := []VideoTime{
+		{Time: 1001 * time.Millisecond, Frame: 30, Fps: 29.97, timecode: "00:00:01;00"},
+		{Time: 60060 * time.Millisecond, Frame: 1800, Fps: 29.97, timecode: "00:01:00;02"},
+	}
+	formats := []SceneFormat{SceneFormatJSON, SceneFormatCSV, SceneFormatEDL, SceneFormatFCPXML, SceneFormatText}
+
+	for _, sceneTimes := range [][]VideoTime{testSceneTimes, dropFrameSceneTimes} {
+		for _, format := range formats {
+			fps := sceneTimes[0].Fps
+			t.Run(fmt.Sprintf("%s at %v fps", format, fps), func(t *testing.T) {
+				var b bytes.Buffer
+				if err := ExportScenes(&b, format, "clip.mp4", sceneTimes); err != nil {
+					t.Fatal(err)
+				}
+				frames, err := ImportFrames(&b, format, fps)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected := make([]uint64, len(sceneTimes))
+				for i, sceneTime := range sceneTimes {
+					expected[i] = sceneTime.Frame
+				}
+				if !equalFrames(frames, expected) {
+					t.Fatalf("got frames %v, want %v", frames, expected)
+				}
+			})
+		}
+	}
+}
+
+func TestImportFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		format SceneFormat
+		input  string
+		fps    float64
+		frames []uint64
+		err    string
+	}{
+		{
+			name:   "JSON values",
+			format: SceneFormatJSON,
+			input:  `[12, "00:00:01:00", {"frame": 3}, {"timecode": "00:00:03:00"}, {"time": 2}]`,
+			fps:    25,
+			frames: []uint64{12, 25, 3, 75, 50},
+		},
+		{
+			name:   "JSON frame indices without frame rate",
+			format: SceneFormatJSON,
+			input:  `[1, {"frame": 2}]`,
+			frames: []uint64{1, 2},
+		},
+		{
+			name:   "JSON timecode without frame rate",
+			format: SceneFormatJSON,
+			input:  `["00:00:01:00"]`,
+			err:    "element 0: the frame rate is required to convert timecodes to frame indices",
+		},
+		{
+			name:   "JSON object without frame",
+			format: SceneFormatJSON,
+			input:  `[{"name": "marker"}]`,
+			fps:    25,
+			err:    "element 0: object must have a frame, timecode or time key",
+		},
+		{
+			name:   "CSV source in column",
+			format: SceneFormatCSV,
+			input:  "#,Name,Source In,Source Out\n1,Marker 1,00:00:02:00,00:00:02:01\n2,Marker 2,,\n3,Marker 3,00:00:04:05,00:00:04:06\n",
+			fps:    25,
+			frames: []uint64{50, 105},
+		},
+		{
+			name:   "CSV time column",
+			format: SceneFormatCSV,
+			input:  "time,comment\n0.4,a\n62,b\n",
+			fps:    25,
+			frames: []uint64{10, 1550},
+		},
+		{
+			name:   "CSV without frame column",
+			format: SceneFormatCSV,
+			input:  "name,comment\na,b\n",
+			fps:    25,
+			err:    "CSV header must contain one of the columns frame, timecode, source in, in, record in, time",
+		},
+		{
+			name:   "CSV invalid value",
+			format: SceneFormatCSV,
+			input:  "frame\n1\nx\n",
+			err:    `line 3: "x" is not a valid frame index, timecode or time`,
+		},
+		{
+			name:   "EDL",
+			format: SceneFormatEDL,
+			input: "TITLE: Timeline 1\nFCM: NON-DROP FRAME\n\n" +
+				"001  AX       V     C        00:00:10:00 00:00:10:01 01:00:00:00 01:00:00:01\n" +
+				"* FROM CLIP NAME: clip.mp4\n" +
+				"002  AX       V     C        00:00:20:12 00:00:20:13 01:00:00:01 01:00:00:02\n",
+			fps:    25,
+			frames: []uint64{250, 512},
+		},
+		{
+			name:   "FCPXML markers",
+			format: SceneFormatFCPXML,
+			input: `<fcpxml version="1.8"><library><event><project><sequence><spine>` +
+				`<asset-clip offset="0s" start="0s" duration="10s">` +
+				`<marker start="1001/30000s" duration="1001/30000s" value="a"/>` +
+				`<chapter-marker start="2s" duration="1001/30000s" value="b"/>` +
+				`</asset-clip></spine></sequence></project></event></library></fcpxml>`,
+			fps:    29.97,
+			frames: []uint64{1, 60},
+		},
+		{
+			name:   "FCPXML invalid time",
+			format: SceneFormatFCPXML,
+			input:  `<fcpxml><marker start="1/0s"/></fcpxml>`,
+			fps:    25,
+			err:    `"1/0s" is not a valid FCPXML time`,
+		},
+		{
+			name:   "text",
+			format: SceneFormatText,
+			input:  "# scene changes\n10\n\n  00:00:02:00  \n3s\n",
+			fps:    25,
+			frames: []uint64{10, 50, 75},
+		},
+		{
+			name:   "text invalid value",
+			format: SceneFormatText,
+			input:  "10\nten\n",
+			err:    `line 2: "ten" is not a valid frame index, timecode or time`,
+		},
+		{
+			name:   "unsupported format",
+			format: "xml",
+			input:  "",
+			err:    `unsupported scene format "xml"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frames, err := ImportFrames(strings.NewReader(test.input), test.format, test.fps)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalFrames(frames, test.frames) {
+				t.Fatalf("got frames %v, want %v", frames, test.frames)
+			}
+		})
+	}
+}
+
+func equalFrames(a []uint64, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -2,73 +2,390 @@ package moshpit
 
 import (
 	"bytes"
-	"golang.org/x/net/context"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"sort"
+
+	"golang.org/x/net/context"
 )
 
 // RemoveFrames writes a copy of the AVI data from the input reader
 // to the output writer, replacing the frames at the given indices
 // with the following frame.
-// Any errors encountered are sent to the error channel.
-// The error channel is closed when processing is finished.
-func RemoveFrames(ctx context.Context, input io.Reader, output io.Writer,
-	framesToRemove []uint64, processedChan chan<- uint64, errorChan chan<- error) {
+// The index and header of the output file are updated
+// to match the written frames, which requires the output
+// writer to be seekable.
+// Progress is sent to the events channel,
+// relative to the number of frames stated in the AVI header.
+// If moshing fails, an EventError is sent as the last event.
+// The events channel is closed when processing is finished.
+func RemoveFrames(ctx context.Context, input io.Reader, output io.WriteSeeker,
+	framesToRemove []uint64, events chan<- Event) {
+	sendEvents(ctx, events, func(r reporter) error {
+		return removeFrames(ctx, input, output, framesToRemove, r)
+	})
+}
 
-	defer close(errorChan)
-	r := AviScanner(input)
+// RemoveFramesSync is like RemoveFrames, but blocks until moshing
+// has finished, notifying the observer of the events if it is not nil.
+func RemoveFramesSync(ctx context.Context, input io.Reader, output io.WriteSeeker,
+	framesToRemove []uint64, observer Observer) error {
+	return removeFrames(ctx, input, output, framesToRemove, newReporter(observer, nil))
+}
 
+func removeFrames(ctx context.Context, input io.Reader, output io.WriteSeeker,
+	framesToRemove []uint64, r reporter) error {
 	// counter of how many frames to duplicate
 	duplicate := 0
-	i := 0
+	return transformFrames(ctx, input, output, r,
+		func(w *aviWriter, frame *Chunk, i uint64) error {
+			// the first frame is never removed, as there
+			// is no picture before it the following
+			// frames' motion could be applied to
+			if i > 0 && contains(framesToRemove, i) {
+				duplicate++
+				return nil
+			}
+
+			duplicate++
+			for duplicate > 0 {
+				if err := w.WriteChunk(frame); err != nil {
+					return err
+				}
+				duplicate--
+			}
+			return nil
+		})
+}
+
+// DuplicateFrames writes a copy of the AVI data from the input reader
+// to the output writer, repeating the frames at the given indices
+// so they are shown the given number of times.
+// Repeating P-Frames applies their motion over and over again,
+// making the picture "bloom" in the direction of the motion.
+// If keepDuration is true, the repetitions replace the frames
+// following the repeated frame, so the output has the same number
+// of frames as the input. Otherwise, the repetitions are inserted,
+// making the output longer.
+// The index and header of the output file are updated
+// to match the written frames, which requires the output
+// writer to be seekable.
+// Progress is sent to the events channel,
+// relative to the number of frames stated in the AVI header.
+// If moshing fails, an EventError is sent as the last event.
+// The events channel is closed when processing is finished.
+func DuplicateFrames(ctx context.Context, input io.Reader, output io.WriteSeeker,
+	repetitions map[uint64]uint, keepDuration bool, events chan<- Event) {
+	sendEvents(ctx, events, func(r reporter) error {
+		return duplicateFrames(ctx, input, output, repetitions, keepDuration, r)
+	})
+}
+
+// DuplicateFramesSync is like DuplicateFrames, but blocks until moshing
+// has finished, notifying the observer of the events if it is not nil.
+func DuplicateFramesSync(ctx context.Context, input io.Reader, output io.WriteSeeker,
+	repetitions map[uint64]uint, keepDuration bool, observer Observer) error {
+	return duplicateFrames(ctx, input, output, repetitions, keepDuration, newReporter(observer, nil))
+}
+
+func duplicateFrames(ctx context.Context, input io.Reader, output io.WriteSeeker,
+	repetitions map[uint64]uint, keepDuration bool, r reporter) error {
+	// the frame written in place of the following frames
+	// if the duration is kept, and how many frames it replaces
+	var repeated *Chunk
+	var replace uint
+	return transformFrames(ctx, input, output, r,
+		func(w *aviWriter, frame *Chunk, i uint64) error {
+			if replace > 0 {
+				replace--
+				return w.WriteChunk(repeated)
+			}
+
+			count := repetitions[i]
+			if count == 0 {
+				count = 1
+			}
+			if keepDuration {
+				if count > 1 {
+					// the frame's data is only valid until the next
+					// frame is read, so it is copied for the repetitions
+					c := *frame
+					c.Data = append([]byte(nil), frame.Data...)
+					repeated = &c
+					replace = count - 1
+				}
+				return w.WriteChunk(frame)
+			}
+
+			for ; count > 0; count-- {
+				if err := w.WriteChunk(frame); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+}
+
+// SplicePoint describes where the frames of a second video
+// are spliced into the first video by SpliceFrames.
+type SplicePoint struct {
+	// Frame is the index of the first frame
+	// of the first video to be replaced.
+	Frame uint64
+	// Source is the index of the first frame
+	// taken from the second video.
+	Source uint64
+	// Length is the number of frames taken from the second video.
+	// If it is 0, frames are taken until the next splice point.
+	Length uint64
+}
+
+// SpliceFrames writes a copy of the AVI data from the input reader
+// to the output writer, replacing the frames at the splice points
+// with the frames of the AVI data from the motion reader.
+// The I-Frames of the motion input are replaced by the following
+// frame, so the motion of the second video is applied to the
+// picture of the first video.
+// Both inputs must have been written by ConvertToAvi
+// with the same format and encoder settings.
+// The splice points must not take the same frames of the second video.
+// Splicing fails if the I-Frames skipped by a splice point
+// take the frames of the next splice point.
+// The output has the same number of frames as the input.
+// If the motion input ends before a splice point ends,
+// the remaining frames are taken from the input.
+// The index and header of the output file are updated
+// to match the written frames, which requires the output
+// writer to be seekable.
+// Progress is sent to the events channel,
+// relative to the number of frames stated in the AVI header.
+// If moshing fails, an EventError is sent as the last event.
+// The events channel is closed when processing is finished.
+func SpliceFrames(ctx context.Context, input io.Reader, motionInput io.Reader,
+	output io.WriteSeeker, splicePoints []SplicePoint, events chan<- Event) {
+	sendEvents(ctx, events, func(r reporter) error {
+		return spliceFrames(ctx, input, motionInput, output, splicePoints, r)
+	})
+}
+
+// SpliceFramesSync is like SpliceFrames, but blocks until moshing
+// has finished, notifying the observer of the events if it is not nil.
+func SpliceFramesSync(ctx context.Context, input io.Reader, motionInput io.Reader,
+	output io.WriteSeeker, splicePoints []SplicePoint, observer Observer) error {
+	return spliceFrames(ctx, input, motionInput, output, splicePoints, newReporter(observer, nil))
+}
+
+func spliceFrames(ctx context.Context, input io.Reader, motionInput io.Reader,
+	output io.WriteSeeker, splicePoints []SplicePoint, r reporter) error {
+	points := make([]SplicePoint, len(splicePoints))
+	copy(points, splicePoints)
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Frame < points[j].Frame
+	})
+	for i, p := range points {
+		if p.Frame == 0 {
+			// there is no picture to apply the motion to
+			return errors.New("the first frame can't be replaced")
+		}
+		if i == 0 {
+			continue
+		}
+		// the number of frames taken by the previous splice point
+		prev := points[i-1]
+		consumed := p.Frame - prev.Frame
+		if prev.Length > 0 && prev.Length < consumed {
+			consumed = prev.Length
+		}
+		if p.Source < prev.Source || p.Source-prev.Source < consumed {
+			return errors.New("splice points must not take the same frames from the second video")
+		}
+	}
+
+	motion := &aviFrameReader{r: NewAviReader(motionInput)}
+	// the splice point currently being applied
+	current := -1
+	motionEnded := false
+	return transformFrames(ctx, input, output, r,
+		func(w *aviWriter, frame *Chunk, i uint64) error {
+			if motion.header == nil {
+				if err := motion.readHeader(); err != nil {
+					return fmt.Errorf("error reading motion input: %s", err.Error())
+				}
+				if w.header == nil || motion.header == nil {
+					return errors.New("AVI header is missing")
+				}
+				if w.header.width != motion.header.width || w.header.height != motion.header.height {
+					return fmt.Errorf("the inputs have different resolutions (%dx%d and %dx%d)",
+						w.header.width, w.header.height, motion.header.width, motion.header.height)
+				}
+				if !sameCodecSettings(w.header.videoStream(), motion.header.videoStream()) {
+					return errors.New("the inputs were encoded with different codec settings")
+				}
+			}
+
+			// find the splice point the frame belongs to
+			if current+1 < len(points) && points[current+1].Frame <= i {
+				current++
+				// skipped I-Frames may have taken
+				// the frames of the next splice point
+				if !motionEnded && motion.index > points[current].Source {
+					return fmt.Errorf("frame %d of the second video was already taken "+
+						"by the previous splice point, as I-Frames were skipped", points[current].Source)
+				}
+				motionEnded = false
+			}
+			if current < 0 || motionEnded {
+				return w.WriteChunk(frame)
+			}
+			p := points[current]
+			if p.Length > 0 && i >= p.Frame+p.Length {
+				return w.WriteChunk(frame)
+			}
+
+			// take the next P-Frame from the motion input,
+			// skipping to the splice point's source frame
+			for {
+				motionFrame, frameType, err := motion.Next()
+				if err == io.EOF {
+					motionEnded = true
+					return w.WriteChunk(frame)
+				}
+				if err != nil {
+					return fmt.Errorf("error reading motion input: %s", err.Error())
+				}
+				if motion.index <= p.Source || frameType == IFrame {
+					continue
+				}
+
+				// write the frame as part of the input's video stream
+				motionFrame.ID = frame.ID
+				return w.WriteChunk(motionFrame)
+			}
+		})
+}
+
+// sameCodecSettings returns whether the frames of both video streams
+// can be decoded with the same codec settings, comparing the compression
+// type and the codec headers following the BITMAPINFOHEADER.
+func sameCodecSettings(a, b *aviStream) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if len(a.format) < bitmapInfoHeaderSize || len(b.format) < bitmapInfoHeaderSize {
+		return bytes.Equal(a.format, b.format)
+	}
+	return bytes.Equal(a.format[16:20], b.format[16:20]) &&
+		bytes.Equal(a.format[bitmapInfoHeaderSize:], b.format[bitmapInfoHeaderSize:])
+}
+
+// aviFrameReader reads the video frames of an AVI file.
+type aviFrameReader struct {
+	r       *AviReader
+	header  *aviHeader
+	parsers map[int]*vopParser
+	// the number of frames read
+	index uint64
+}
+
+// readHeader reads the file until the hdrl list has been parsed.
+func (f *aviFrameReader) readHeader() error {
+	for f.header == nil {
+		chunk, err := f.r.Next()
+		if err == io.EOF {
+			return errors.New("AVI header is missing")
+		}
+		if err != nil {
+			return err
+		}
+		if chunk.ID == fccLIST && chunk.ListType == fccHdrl {
+			if f.header, err = parseHeaderList(chunk.Data); err != nil {
+				return err
+			}
+			f.parsers = f.header.vopParsers()
+		}
+	}
+	return nil
+}
+
+// Next returns the next video frame and its type.
+// At the end of the file, Next returns io.EOF.
+func (f *aviFrameReader) Next() (*Chunk, FrameType, error) {
+	if err := f.readHeader(); err != nil {
+		return nil, Unknown, err
+	}
+	for {
+		chunk, err := f.r.Next()
+		if err != nil {
+			return nil, Unknown, err
+		}
+		if !chunk.IsVideoFrame() {
+			continue
+		}
+
+		stream, _ := chunk.Stream()
+		p, ok := f.parsers[stream]
+		if !ok {
+			p = &vopParser{}
+			f.parsers[stream] = p
+		}
+		f.index++
+		return chunk, p.FrameType(chunk.Data), nil
+	}
+}
+
+// transformFrames copies the AVI data from the input reader
+// to the output writer, passing each video frame and its index
+// to writeFrame instead of writing it to the output.
+// After each processed frame, the progress is reported as the number
+// of processed frames over the number of frames stated in the AVI header.
+// No progress is reported if the header doesn't state the number of frames.
+func transformFrames(ctx context.Context, input io.Reader, output io.WriteSeeker,
+	r reporter, writeFrame func(w *aviWriter, frame *Chunk, i uint64) error) error {
+
+	r.stage("Moshing AVI file")
+
+	reader := NewAviReader(input)
+	w := newAviWriter(output)
+
+	var i uint64
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return ctx.Err()
 		default:
-			if r.Scan() {
-				frame := r.Bytes()
-				if i == 0 {
-					// write the original frames
-					// without incrementing the counter
-					// until the first I-Frame is encountered -
-					// all frames before that are header frames
-					if _, err := output.Write(frame); err != nil {
-						errorChan <- err
-						return
-					}
-
-					if bytes.Compare(frame[5:8], iframePrefix) == 0 {
-						// we found the first I-Frame - increment
-						// the counter to stop the search and begin moshing
-						i++
-					}
+			chunk, err := reader.Next()
+			if err == io.EOF {
+				return w.Close()
+			}
+			if err != nil {
+				return err
+			}
 
-					continue
+			if !chunk.IsVideoFrame() {
+				// copy headers and non-video chunks unchanged
+				if err := w.WriteChunk(chunk); err != nil {
+					return err
 				}
+				continue
+			}
 
-				if contains(framesToRemove, uint64(i)) {
-					duplicate++
-				} else {
-					duplicate++
-					for duplicate > 0 {
-						if _, err := output.Write(frame); err != nil {
-							errorChan <- err
-							return
-						}
-						duplicate--
-					}
-				}
+			if w.header == nil {
+				// the frames can't be written without the
+				// hdrl list preceding the movi list
+				return errors.New("AVI header is missing")
+			}
 
-				if i >= 0 {
-					processedChan <- uint64(i)
-				}
+			if err := writeFrame(w, chunk, i); err != nil {
+				return err
+			}
+			i++
 
-				i++
-			} else {
-				if err := r.Err(); err != nil {
-					errorChan <- err
-				}
-				return
+			if total := w.header.frameCount(); total > 0 {
+				// limit the progress to 1.0 in case
+				// the header understates the number of frames
+				r.progress(math.Min(1, float64(i)/float64(total)))
 			}
 		}
 	}
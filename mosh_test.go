@@ -0,0 +1,352 @@
+package moshpit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// moshTestFrames returns an I-Frame followed by P-Frames,
+// which all differ in size so they can be told apart.
+func moshTestFrames(count int) [][]byte {
+	frames := make([][]byte, count)
+	for i := range frames {
+		codingType := byte(vopCodingTypeP)
+		if i == 0 {
+			codingType = vopCodingTypeI
+		}
+		frames[i] = testVOP(codingType, 10+i)
+	}
+	return frames
+}
+
+// checkMoshedFrames verifies that the written AVI file
+// holds the frames at the given indices of the input frames.
+func checkMoshedFrames(t *testing.T, output []byte, frames [][]byte, indices []int) {
+	t.Helper()
+	a := readWrittenAvi(t, output)
+	if len(a.frames) != len(indices) || a.header.streams[0].length != uint32(len(indices)) {
+		t.Fatalf("got %d frames with a stream length of %d, want %d",
+			len(a.frames), a.header.streams[0].length, len(indices))
+	}
+	for i, frame := range a.frames {
+		if !bytes.Equal(frame.Data, frames[indices[i]]) {
+			t.Fatalf("frame %d is input frame %d, want input frame %d", i, len(frame.Data)-10, indices[i])
+		}
+	}
+}
+
+func TestRemoveFrames(t *testing.T) {
+	frames := moshTestFrames(6)
+	tests := []struct {
+		name    string
+		remove  []uint64
+		indices []int
+	}{
+		{name: "no frames", remove: nil, indices: []int{0, 1, 2, 3, 4, 5}},
+		{name: "single frame", remove: []uint64{2}, indices: []int{0, 1, 3, 3, 4, 5}},
+		{name: "consecutive frames", remove: []uint64{2, 3}, indices: []int{0, 1, 4, 4, 4, 5}},
+		{name: "first frame", remove: []uint64{0, 1}, indices: []int{0, 2, 2, 3, 4, 5}},
+		// there is no following frame to replace the last frame with
+		{name: "last frame", remove: []uint64{5}, indices: []int{0, 1, 2, 3, 4}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := &seekBuffer{}
+			err := RemoveFramesSync(context.Background(), bytes.NewReader(testAviFile(frameChunks(frames...), 0)),
+				output, test.remove, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkMoshedFrames(t, output.data, frames, test.indices)
+		})
+	}
+}
+
+func TestRemoveFramesMissingHeader(t *testing.T) {
+	// the frames are not preceded by the hdrl list
+	input := riffList("RIFF", "AVI ", riffList("LIST", "movi", frameChunks(moshTestFrames(2)...)...))
+	err := RemoveFramesSync(context.Background(), bytes.NewReader(input), &seekBuffer{}, []uint64{1}, nil)
+	if err == nil || err.Error() != "AVI header is missing" {
+		t.Fatalf("got error %v, want AVI header is missing", err)
+	}
+}
+
+func TestDuplicateFrames(t *testing.T) {
+	frames := moshTestFrames(6)
+	tests := []struct {
+		name         string
+		repetitions  map[uint64]uint
+		keepDuration bool
+		indices      []int
+	}{
+		{
+			name:        "inserted repetitions",
+			repetitions: map[uint64]uint{2: 3},
+			indices:     []int{0, 1, 2, 2, 2, 3, 4, 5},
+		},
+		{
+			name:         "replaced frames",
+			repetitions:  map[uint64]uint{2: 3},
+			keepDuration: true,
+			indices:      []int{0, 1, 2, 2, 2, 5},
+		},
+		{
+			name:         "repetitions exceeding the video",
+			repetitions:  map[uint64]uint{4: 5},
+			keepDuration: true,
+			indices:      []int{0, 1, 2, 3, 4, 4},
+		},
+		{
+			name:         "replaced repetitions",
+			repetitions:  map[uint64]uint{1: 3, 2: 2},
+			keepDuration: true,
+			indices:      []int{0, 1, 1, 1, 4, 5},
+		},
+		{
+			name:        "single repetitions",
+			repetitions: map[uint64]uint{1: 0, 2: 1},
+			indices:     []int{0, 1, 2, 3, 4, 5},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := &seekBuffer{}
+			err := DuplicateFramesSync(context.Background(), bytes.NewReader(testAviFile(frameChunks(frames...), 0)),
+				output, test.repetitions, test.keepDuration, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkMoshedFrames(t, output.data, frames, test.indices)
+		})
+	}
+}
+
+func TestSpliceFrames(t *testing.T) {
+	frames := moshTestFrames(8)
+	// the frames of the motion input are referred
+	// to by their index plus 100 in the expected indices
+	motionFrames := make([][]byte, 6)
+	for i := range motionFrames {
+		codingType := byte(vopCodingTypeP)
+		if i%3 == 0 {
+			codingType = vopCodingTypeI
+		}
+		motionFrames[i] = testVOP(codingType, 100+i)
+	}
+
+	tests := []struct {
+		name    string
+		points  []SplicePoint
+		indices []int
+	}{
+		{
+			name:    "single splice point",
+			points:  []SplicePoint{{Frame: 2, Source: 1, Length: 2}},
+			indices: []int{0, 1, 101, 102, 4, 5, 6, 7},
+		},
+		{
+			name:    "skipped I-Frames",
+			points:  []SplicePoint{{Frame: 2, Source: 2, Length: 3}},
+			indices: []int{0, 1, 102, 104, 105, 5, 6, 7},
+		},
+		{
+			name:    "frames until the next splice point",
+			points:  []SplicePoint{{Frame: 1, Source: 1}, {Frame: 4, Source: 5, Length: 1}},
+			indices: []int{0, 101, 102, 104, 105, 5, 6, 7},
+		},
+		{
+			name:    "unsorted splice points",
+			points:  []SplicePoint{{Frame: 4, Source: 3, Length: 1}, {Frame: 1, Source: 1, Length: 1}},
+			indices: []int{0, 101, 2, 3, 104, 5, 6, 7},
+		},
+		{
+			name:    "end of the motion input",
+			points:  []SplicePoint{{Frame: 5, Source: 4}},
+			indices: []int{0, 1, 2, 3, 4, 104, 105, 7},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := &seekBuffer{}
+			err := SpliceFramesSync(context.Background(),
+				bytes.NewReader(testAviFile(frameChunks(frames...), 0)),
+				bytes.NewReader(testAviFile(frameChunks(motionFrames...), 0)),
+				output, test.points, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			a := readWrittenAvi(t, output.data)
+			if len(a.frames) != len(test.indices) {
+				t.Fatalf("got %d frames, want %d", len(a.frames), len(test.indices))
+			}
+			for i, frame := range a.frames {
+				expected := frames
+				index := test.indices[i]
+				if index >= 100 {
+					expected = motionFrames
+					index -= 100
+				}
+				if frame.ID != fourCC("00dc") || !bytes.Equal(frame.Data, expected[index]) {
+					t.Fatalf("frame %d doesn't match the expected frame %d", i, test.indices[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSpliceFramesErrors(t *testing.T) {
+	input := testAviFile(frameChunks(moshTestFrames(4)...), 0)
+	tests := []struct {
+		name   string
+		input  []byte
+		motion []byte
+		points []SplicePoint
+		err    string
+	}{
+		{
+			name:   "first frame",
+			motion: input,
+			points: []SplicePoint{{Frame: 0, Source: 1}},
+			err:    "the first frame can't be replaced",
+		},
+		{
+			name:   "descending sources",
+			motion: input,
+			points: []SplicePoint{{Frame: 1, Source: 2, Length: 1}, {Frame: 3, Source: 1}},
+			err:    "splice points must not take the same frames from the second video",
+		},
+		{
+			name:   "overlapping sources",
+			motion: input,
+			points: []SplicePoint{{Frame: 1, Source: 0}, {Frame: 3, Source: 1}},
+			err:    "splice points must not take the same frames from the second video",
+		},
+		{
+			name:   "overlapping lengths",
+			motion: input,
+			points: []SplicePoint{{Frame: 1, Source: 0, Length: 3}, {Frame: 5, Source: 2}},
+			err:    "splice points must not take the same frames from the second video",
+		},
+		{
+			name: "sources taken by skipped I-Frames",
+			motion: testAviFile(frameChunks(
+				testVOP(vopCodingTypeI, 10), testVOP(vopCodingTypeI, 11), testVOP(vopCodingTypeP, 12),
+				testVOP(vopCodingTypeP, 13)), 0),
+			points: []SplicePoint{{Frame: 1, Source: 0, Length: 1}, {Frame: 2, Source: 1}},
+			err:    "frame 1 of the second video was already taken by the previous splice point, as I-Frames were skipped",
+		},
+		{
+			name: "different resolutions",
+			motion: func() []byte {
+				motion := append([]byte(nil), input...)
+				// the width in the avih chunk
+				binary.LittleEndian.PutUint32(motion[64:], 640)
+				return motion
+			}(),
+			points: []SplicePoint{{Frame: 1, Source: 1}},
+			err:    "the inputs have different resolutions (0x0 and 640x0)",
+		},
+		{
+			name: "different codec settings",
+			motion: func() []byte {
+				motion := append([]byte(nil), input...)
+				// the compression type in the strf chunk
+				copy(motion[bytes.LastIndex(motion, []byte("FMP4")):], "XVID")
+				return motion
+			}(),
+			points: []SplicePoint{{Frame: 1, Source: 1}},
+			err:    "the inputs were encoded with different codec settings",
+		},
+		{
+			name: "different codec headers",
+			motion: func() []byte {
+				// the codec headers following the BITMAPINFOHEADER in the strf chunk
+				strf := make([]byte, bitmapInfoHeaderSize+4)
+				binary.LittleEndian.PutUint32(strf, bitmapInfoHeaderSize)
+				copy(strf[16:], "FMP4")
+				copy(strf[bitmapInfoHeaderSize:], []byte{0x00, 0x00, 0x01, 0xb0})
+				strh := make([]byte, 56)
+				copy(strh, "vidsFMP4")
+				return riffList("RIFF", "AVI ",
+					riffList("LIST", "hdrl", riffChunk("avih", make([]byte, 56)),
+						riffList("LIST", "strl", riffChunk("strh", strh), riffChunk("strf", strf))),
+					riffList("LIST", "movi", frameChunks(moshTestFrames(4)...)...))
+			}(),
+			points: []SplicePoint{{Frame: 1, Source: 1}},
+			err:    "the inputs were encoded with different codec settings",
+		},
+		{
+			name:   "missing header",
+			motion: riffList("RIFF", "AVI "),
+			points: []SplicePoint{{Frame: 1, Source: 1}},
+			err:    "error reading motion input: AVI header is missing",
+		},
+		{
+			name:   "missing input header",
+			input:  riffList("RIFF", "AVI ", riffList("LIST", "movi", frameChunks(moshTestFrames(4)...)...)),
+			motion: input,
+			points: []SplicePoint{{Frame: 1, Source: 1}},
+			err:    "AVI header is missing",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := input
+			if test.input != nil {
+				in = test.input
+			}
+			err := SpliceFramesSync(context.Background(), bytes.NewReader(in), bytes.NewReader(test.motion),
+				&seekBuffer{}, test.points, nil)
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("got error %v, want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestMoshProgress(t *testing.T) {
+	tests := []struct {
+		name        string
+		totalFrames uint32
+		progress    []float64
+	}{
+		{name: "header frame count", totalFrames: 4, progress: []float64{0.25, 0.5, 0.75, 1}},
+		{name: "understated frame count", totalFrames: 2, progress: []float64{0.5, 1, 1, 1}},
+		{name: "unknown frame count", totalFrames: 0, progress: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := testAviFile(frameChunks(moshTestFrames(4)...), 0)
+			// the total number of frames in the avih chunk
+			binary.LittleEndian.PutUint32(input[48:], test.totalFrames)
+
+			var progress []float64
+			err := RemoveFramesSync(context.Background(), bytes.NewReader(input), &seekBuffer{}, nil,
+				ObserverFunc(func(event Event) {
+					if event.Type == EventProgress {
+						progress = append(progress, event.Progress)
+					}
+				}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(progress) != len(test.progress) {
+				t.Fatalf("got progress %v, want %v", progress, test.progress)
+			}
+			for i := range progress {
+				if progress[i] != test.progress[i] {
+					t.Fatalf("got progress %v, want %v", progress, test.progress)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package moshpit
+
+// MPEG-4 Part 2 start codes
+const (
+	mpeg4VOLStartCodeMin = 0x20
+	mpeg4VOLStartCodeMax = 0x2f
+	mpeg4VOPStartCode    = 0xb6
+)
+
+// MPEG-4 Part 2 vop_coding_type values
+const (
+	vopCodingTypeI = 0
+	vopCodingTypeP = 1
+	vopCodingTypeB = 2
+	vopCodingTypeS = 3
+)
+
+// the video_object_layer_shape value of grayscale shapes
+const volShapeGrayscale = 3
+
+// the aspect_ratio_info value signaling a custom pixel aspect ratio
+const volAspectRatioExtended = 0xf
+
+// bitReader reads big-endian values of arbitrary bit length.
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+// read reads n bits, returning false if there is not enough data left.
+func (r *bitReader) read(n int) (uint32, bool) {
+	if r.pos+n > 8*len(r.data) {
+		return 0, false
+	}
+	var v uint32
+	for i := 0; i < n; i++ {
+		bit := r.data[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v, true
+}
+
+// skip skips n bits, returning false if there is not enough data left.
+func (r *bitReader) skip(n int) bool {
+	if r.pos+n > 8*len(r.data) {
+		return false
+	}
+	r.pos += n
+	return true
+}
+
+// vopParser determines the type of MPEG-4 Part 2 frames
+// by parsing their video object plane (VOP) header.
+// Whether a VOP is coded can only be read after a video object
+// layer (VOL) header has been parsed, as it determines
+// the size of the fields preceding the vop_coded flag.
+type vopParser struct {
+	// number of bits of the vop_time_increment field,
+	// or 0 if no VOL header has been parsed yet
+	timeIncrementBits int
+}
+
+// ParseHeaders parses the VOL headers in the given data,
+// like the extradata following the BITMAPINFOHEADER
+// in the strf chunk of an AVI stream.
+func (p *vopParser) ParseHeaders(data []byte) {
+	p.FrameType(data)
+}
+
+// FrameType returns the type of the frame with the given data.
+// VOL headers preceding the VOP header are parsed
+// and used for the following frames.
+func (p *vopParser) FrameType(frame []byte) FrameType {
+	if len(frame) == 0 {
+		// empty chunks are written for frames
+		// dropped by the encoder
+		return DroppedFrame
+	}
+
+	for i := 0; i+4 <= len(frame); i++ {
+		if frame[i] != 0 || frame[i+1] != 0 || frame[i+2] != 1 {
+			continue
+		}
+
+		startCode := frame[i+3]
+		data := frame[i+4:]
+		switch {
+		case startCode >= mpeg4VOLStartCodeMin && startCode <= mpeg4VOLStartCodeMax:
+			if bits, ok := parseVOLTimeIncrementBits(data); ok {
+				p.timeIncrementBits = bits
+			}
+		case startCode == mpeg4VOPStartCode:
+			return p.parseVOP(data)
+		}
+		i += 3
+	}
+
+	return Unknown
+}
+
+// parseVOP returns the frame type described by the VOP header.
+func (p *vopParser) parseVOP(data []byte) FrameType {
+	r := &bitReader{data: data}
+	codingType, ok := r.read(2)
+	if !ok {
+		return Unknown
+	}
+
+	if p.timeIncrementBits > 0 {
+		// skip modulo_time_base, a sequence of ones terminated by a zero
+		for {
+			bit, ok := r.read(1)
+			if !ok {
+				return Unknown
+			}
+			if bit == 0 {
+				break
+			}
+		}
+
+		// skip the marker bits surrounding vop_time_increment
+		if !r.skip(1 + p.timeIncrementBits + 1) {
+			return Unknown
+		}
+
+		coded, ok := r.read(1)
+		if !ok {
+			return Unknown
+		}
+		if coded == 0 {
+			return NotCodedFrame
+		}
+	}
+
+	switch codingType {
+	case vopCodingTypeI:
+		return IFrame
+	case vopCodingTypeP:
+		return PFrame
+	case vopCodingTypeB:
+		return BFrame
+	case vopCodingTypeS:
+		return SFrame
+	}
+	return Unknown
+}
+
+// parseVOLTimeIncrementBits parses a VOL header,
+// returning the number of bits of the vop_time_increment field.
+func parseVOLTimeIncrementBits(data []byte) (int, bool) {
+	r := &bitReader{data: data}
+
+	// random_accessible_vol, video_object_type_indication
+	if !r.skip(1 + 8) {
+		return 0, false
+	}
+
+	verid := uint32(1)
+	isObjectLayerIdentifier, ok := r.read(1)
+	if !ok {
+		return 0, false
+	}
+	if isObjectLayerIdentifier == 1 {
+		if verid, ok = r.read(4); !ok {
+			return 0, false
+		}
+		// video_object_layer_priority
+		if !r.skip(3) {
+			return 0, false
+		}
+	}
+
+	aspectRatioInfo, ok := r.read(4)
+	if !ok {
+		return 0, false
+	}
+	if aspectRatioInfo == volAspectRatioExtended {
+		// par_width, par_height
+		if !r.skip(8 + 8) {
+			return 0, false
+		}
+	}
+
+	volControlParameters, ok := r.read(1)
+	if !ok {
+		return 0, false
+	}
+	if volControlParameters == 1 {
+		// chroma_format, low_delay
+		if !r.skip(2 + 1) {
+			return 0, false
+		}
+		vbvParameters, ok := r.read(1)
+		if !ok {
+			return 0, false
+		}
+		if vbvParameters == 1 {
+			// bit rate, buffer size and occupancy values
+			// separated by marker bits
+			if !r.skip(15 + 1 + 15 + 1 + 15 + 1 + 3 + 11 + 1 + 15 + 1) {
+				return 0, false
+			}
+		}
+	}
+
+	shape, ok := r.read(2)
+	if !ok {
+		return 0, false
+	}
+	if shape == volShapeGrayscale && verid != 1 {
+		// video_object_layer_shape_extension
+		if !r.skip(4) {
+			return 0, false
+		}
+	}
+
+	// marker bit
+	if !r.skip(1) {
+		return 0, false
+	}
+	resolution, ok := r.read(16)
+	if !ok || resolution == 0 {
+		return 0, false
+	}
+
+	// the number of bits required to represent
+	// values up to resolution-1, but at least 1
+	bits := 1
+	for v := resolution - 1; v > 1; v >>= 1 {
+		bits++
+	}
+	return bits, true
+}
@@ -0,0 +1,253 @@
+package moshpit
+
+import "testing"
+
+// bitWriter writes big-endian values of arbitrary bit length.
+type bitWriter struct {
+	data []byte
+	pos  int
+}
+
+// write writes the n lowest bits of the value.
+func (w *bitWriter) write(v uint32, n int) *bitWriter {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			w.data[w.pos/8] |= 1 << (7 - uint(w.pos%8))
+		}
+		w.pos++
+	}
+	return w
+}
+
+// ones writes n set bits, which are used for the fields
+// the parser skips so they don't form start codes.
+func (w *bitWriter) ones(n int) *bitWriter {
+	for ; n > 0; n-- {
+		w.write(1, 1)
+	}
+	return w
+}
+
+// startCode returns the data following the start code with the given value.
+func startCode(code byte, data []byte) []byte {
+	return append([]byte{0, 0, 1, code}, data...)
+}
+
+// volHeader holds the fields of a VOL header
+// affecting the position of the vop_time_increment_resolution.
+type volHeader struct {
+	verid             uint32
+	aspectRatio       uint32
+	controlParameters bool
+	vbvParameters     bool
+	shape             uint32
+	resolution        uint32
+}
+
+func (h volHeader) bytes() []byte {
+	w := &bitWriter{}
+	// random_accessible_vol, video_object_type_indication
+	w.ones(1 + 8)
+	if h.verid > 0 {
+		w.write(1, 1).write(h.verid, 4).ones(3)
+	} else {
+		w.write(0, 1)
+	}
+	w.write(h.aspectRatio, 4)
+	if h.aspectRatio == volAspectRatioExtended {
+		w.ones(8 + 8)
+	}
+	if h.controlParameters {
+		w.write(1, 1).ones(2 + 1)
+		if h.vbvParameters {
+			w.write(1, 1).ones(79)
+		} else {
+			w.write(0, 1)
+		}
+	} else {
+		w.write(0, 1)
+	}
+	w.write(h.shape, 2)
+	if h.shape == volShapeGrayscale && h.verid > 1 {
+		w.ones(4)
+	}
+	// marker bit, vop_time_increment_resolution, marker bit
+	w.ones(1).write(h.resolution, 16).ones(1)
+	return startCode(mpeg4VOLStartCodeMin, w.data)
+}
+
+// vopHeader returns a VOP header with the given coding type, with the
+// vop_time_increment of the given number of bits if it is above 0.
+func vopHeader(codingType uint32, moduloTimeBase int, timeIncrementBits int, coded bool) []byte {
+	w := &bitWriter{}
+	w.write(codingType, 2)
+	if timeIncrementBits > 0 {
+		w.ones(moduloTimeBase).write(0, 1)
+		w.ones(1 + timeIncrementBits + 1)
+		if coded {
+			w.write(1, 1)
+		} else {
+			w.write(0, 1)
+		}
+	}
+	// the remainder of the header
+	w.ones(8)
+	return startCode(mpeg4VOPStartCode, w.data)
+}
+
+func TestBitReader(t *testing.T) {
+	r := &bitReader{data: []byte{0xa5, 0x3c}}
+	tests := []struct {
+		n    int
+		skip bool
+		want uint32
+		ok   bool
+	}{
+		{n: 3, want: 0x5, ok: true},
+		{n: 7, want: 0x14, ok: true},
+		{n: 2, skip: true, ok: true},
+		{n: 4, want: 0xc, ok: true},
+		{n: 1, ok: false},
+		{n: 1, skip: true, ok: false},
+		{n: 0, want: 0, ok: true},
+	}
+	for i, test := range tests {
+		if test.skip {
+			if ok := r.skip(test.n); ok != test.ok {
+				t.Fatalf("step %d: skipping %d bits returned %v, want %v", i, test.n, ok, test.ok)
+			}
+			continue
+		}
+		v, ok := r.read(test.n)
+		if v != test.want || ok != test.ok {
+			t.Fatalf("step %d: reading %d bits returned %#x, %v, want %#x, %v", i, test.n, v, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseVOLTimeIncrementBits(t *testing.T) {
+	tests := []struct {
+		name   string
+		header volHeader
+		bits   int
+	}{
+		{name: "resolution 1", header: volHeader{resolution: 1}, bits: 1},
+		{name: "resolution 2", header: volHeader{resolution: 2}, bits: 1},
+		{name: "resolution 3", header: volHeader{resolution: 3}, bits: 2},
+		{name: "resolution 25", header: volHeader{resolution: 25}, bits: 5},
+		{name: "resolution 30000", header: volHeader{resolution: 30000}, bits: 15},
+		{name: "resolution 65535", header: volHeader{resolution: 65535}, bits: 16},
+		{name: "object layer identifier", header: volHeader{verid: 1, resolution: 30}, bits: 5},
+		{name: "extended aspect ratio", header: volHeader{aspectRatio: volAspectRatioExtended, resolution: 30}, bits: 5},
+		{name: "control parameters", header: volHeader{controlParameters: true, resolution: 30}, bits: 5},
+		{name: "VBV parameters", header: volHeader{controlParameters: true, vbvParameters: true, resolution: 30}, bits: 5},
+		{name: "grayscale shape", header: volHeader{shape: volShapeGrayscale, resolution: 30}, bits: 5},
+		{name: "grayscale shape extension", header: volHeader{verid: 2, shape: volShapeGrayscale, resolution: 30}, bits: 5},
+		{
+			name: "all fields",
+			header: volHeader{
+				verid:             2,
+				aspectRatio:       volAspectRatioExtended,
+				controlParameters: true,
+				vbvParameters:     true,
+				shape:             volShapeGrayscale,
+				resolution:        1000,
+			},
+			bits: 10,
+		},
+		{name: "zero resolution", header: volHeader{resolution: 0}, bits: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := test.header.bytes()[4:]
+			bits, ok := parseVOLTimeIncrementBits(data)
+			if bits != test.bits || ok != (test.bits > 0) {
+				t.Fatalf("got %d bits, %v, want %d bits", bits, ok, test.bits)
+			}
+
+			// truncated headers can't be parsed
+			if test.bits > 0 {
+				if _, ok := parseVOLTimeIncrementBits(data[:len(data)-2]); ok {
+					t.Fatal("truncated header was parsed")
+				}
+			}
+		})
+	}
+}
+
+func TestVopParserFrameType(t *testing.T) {
+	vol := volHeader{resolution: 30}.bytes()
+	tests := []struct {
+		name string
+		// the stream headers parsed before the frames
+		headers []byte
+		frames  [][]byte
+		want    []FrameType
+	}{
+		{
+			name:   "empty frame",
+			frames: [][]byte{{}},
+			want:   []FrameType{DroppedFrame},
+		},
+		{
+			name:   "no VOP header",
+			frames: [][]byte{{0xff, 0, 0, 1}, startCode(0xb3, []byte{0xff, 0xff})},
+			want:   []FrameType{Unknown, Unknown},
+		},
+		{
+			name: "coding types without VOL header",
+			frames: [][]byte{
+				vopHeader(vopCodingTypeI, 0, 0, true),
+				vopHeader(vopCodingTypeP, 0, 0, true),
+				vopHeader(vopCodingTypeB, 0, 0, true),
+				vopHeader(vopCodingTypeS, 0, 0, true),
+			},
+			want: []FrameType{IFrame, PFrame, BFrame, SFrame},
+		},
+		{
+			name: "VOL header in frame",
+			frames: [][]byte{
+				append(vol, vopHeader(vopCodingTypeI, 0, 5, true)...),
+				vopHeader(vopCodingTypeP, 0, 5, true),
+				vopHeader(vopCodingTypeP, 0, 5, false),
+				vopHeader(vopCodingTypeB, 2, 5, true),
+			},
+			want: []FrameType{IFrame, PFrame, NotCodedFrame, BFrame},
+		},
+		{
+			name:    "VOL header in stream headers",
+			headers: startCode(0xb0, append([]byte{0xf5}, vol...)),
+			frames: [][]byte{
+				vopHeader(vopCodingTypeI, 1, 5, true),
+				vopHeader(vopCodingTypeS, 0, 5, false),
+			},
+			want: []FrameType{IFrame, NotCodedFrame},
+		},
+		{
+			name:    "truncated VOP header",
+			headers: vol,
+			frames: [][]byte{
+				startCode(mpeg4VOPStartCode, nil),
+				startCode(mpeg4VOPStartCode, []byte{0x3f}),
+				vopHeader(vopCodingTypeP, 0, 5, true)[:5],
+			},
+			want: []FrameType{Unknown, Unknown, Unknown},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &vopParser{}
+			p.ParseHeaders(test.headers)
+			for i, frame := range test.frames {
+				if got := p.FrameType(frame); got != test.want[i] {
+					t.Fatalf("frame %d: got %v, want %v", i, got, test.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,429 @@
+package moshpit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// MoshFunc applies a datamoshing effect to the AVI data read from
+// the input, writing it to the output. It has the signature of the
+// blocking moshing functions like RemoveFramesSync
+// with the effect parameters bound.
+// The frame indices of the effect are relative to the start of the
+// input file, while the AVI data may start at a later frame,
+// whose index is given as firstFrame.
+type MoshFunc func(ctx context.Context, input io.Reader, output io.WriteSeeker, firstFrame uint64, observer Observer) error
+
+// RemoveFramesMosh returns a MoshFunc removing the frames
+// at the given indices using RemoveFramesSync.
+func RemoveFramesMosh(framesToRemove []uint64) MoshFunc {
+	return func(ctx context.Context, input io.Reader, output io.WriteSeeker, firstFrame uint64, observer Observer) error {
+		return RemoveFramesSync(ctx, input, output, shiftFrames(framesToRemove, firstFrame), observer)
+	}
+}
+
+// DuplicateFramesMosh returns a MoshFunc repeating the frames
+// at the given indices using DuplicateFramesSync.
+func DuplicateFramesMosh(repetitions map[uint64]uint, keepDuration bool) MoshFunc {
+	return func(ctx context.Context, input io.Reader, output io.WriteSeeker, firstFrame uint64, observer Observer) error {
+		shifted := make(map[uint64]uint, len(repetitions))
+		for frame, count := range repetitions {
+			if frame >= firstFrame {
+				shifted[frame-firstFrame] = count
+			}
+		}
+		return DuplicateFramesSync(ctx, input, output, shifted, keepDuration, observer)
+	}
+}
+
+// SpliceFramesMosh returns a MoshFunc splicing in the frames of the
+// AVI file with the given name at the splice points using SpliceFramesSync.
+// The motion file must have been written by ConvertToAvi.
+// The source frame indices are relative to the start of the motion file.
+func SpliceFramesMosh(motionAviFile string, splicePoints []SplicePoint) MoshFunc {
+	return func(ctx context.Context, input io.Reader, output io.WriteSeeker, firstFrame uint64, observer Observer) error {
+		motionFile, err := os.Open(motionAviFile)
+		if err != nil {
+			return fmt.Errorf("could not open motion AVI file: %s", err.Error())
+		}
+		defer motionFile.Close()
+
+		return SpliceFramesSync(ctx, input, motionFile, output, shiftSplicePoints(splicePoints, firstFrame), observer)
+	}
+}
+
+// shiftSplicePoints returns the splice points relative to the first frame.
+// Splice points starting at or before the first frame are cut off
+// to start at the frame after it, as the first frame can't be replaced.
+func shiftSplicePoints(splicePoints []SplicePoint, firstFrame uint64) []SplicePoint {
+	if firstFrame == 0 {
+		return splicePoints
+	}
+
+	points := make([]SplicePoint, len(splicePoints))
+	copy(points, splicePoints)
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Frame < points[j].Frame
+	})
+
+	var shifted []SplicePoint
+	for i, p := range points {
+		if p.Frame <= firstFrame {
+			// splice points without a length end at the next splice point
+			end := p.Frame + p.Length
+			if p.Length == 0 && i+1 < len(points) {
+				end = points[i+1].Frame
+			}
+			if (p.Length > 0 || i+1 < len(points)) && end <= firstFrame+1 {
+				continue
+			}
+
+			skip := firstFrame + 1 - p.Frame
+			p.Frame += skip
+			p.Source += skip
+			if p.Length > 0 {
+				p.Length -= skip
+			}
+		}
+		p.Frame -= firstFrame
+		shifted = append(shifted, p)
+	}
+	return shifted
+}
+
+// PipelineStage is a stage of a Pipeline.
+type PipelineStage uint
+
+const (
+	// StageConvert converts the input file into a moshable AVI file.
+	StageConvert PipelineStage = iota
+	// StageMosh applies the datamoshing effect to the AVI file.
+	StageMosh
+	// StageBake writes the moshed AVI file to the output file.
+	StageBake
+)
+
+// String returns the name of the stage, e.g. "convert".
+func (s PipelineStage) String() string {
+	switch s {
+	case StageConvert:
+		return "convert"
+	case StageMosh:
+		return "mosh"
+	case StageBake:
+		return "bake"
+	default:
+		return "unknown"
+	}
+}
+
+// CachedAviStage is the description of the EventStage reported
+// by the convert stage if the AVI file is taken from the cache.
+const CachedAviStage = "Loading cached AVI file"
+
+// Pipeline converts the input file into a moshable AVI file,
+// applies a datamoshing effect to it and bakes the result
+// into the output file.
+// Pipelines should be created using NewPipeline,
+// which sets the default options.
+type Pipeline struct {
+	FFmpegPath  string
+	FFprobePath string
+	// FFmpegLogPath is the path of the file ffmpeg output is
+	// appended to, or an empty string to disable logging.
+	FFmpegLogPath string
+
+	InputFile string
+	// VideoStream is the index of the video stream to mosh
+	// among the video streams of the input file.
+	VideoStream int
+	OutputFile  string
+	// Profile is the output profile the output file is encoded with.
+	// If it is nil, the default profile for the extension
+	// of the output file is used.
+	Profile *OutputProfile
+	// AudioFile is the file the audio stream of the output file
+	// is taken from, or an empty string for a mute output file.
+	// Only the segment of the audio file is used.
+	// It is ignored by profiles without audio.
+	AudioFile string
+	// Segment is the segment of the input file to mosh.
+	// The frame indices of IFrames and the moshing effect
+	// are still relative to the start of the input file.
+	Segment Segment
+	// Stitch specifies whether the moshed segment is stitched
+	// back into the input file, keeping the rest of the input file
+	// and its audio stream, instead of only writing the segment.
+	Stitch bool
+
+	// Mosh applies the datamoshing effect.
+	Mosh MoshFunc
+	// IFrames are the indices of the frames to encode as I-Frames
+	// when converting the input file, or nil to place them automatically.
+	IFrames []uint64
+	// Format is the format the input file is converted to.
+	// The frame indices of IFrames and the moshing effect count
+	// the frames at the frame rate of the format.
+	Format AviFormat
+	// Encoding are the encoder settings the moshable AVI file
+	// is written with, which shape the look of the moshing effect.
+	Encoding AviEncodeOptions
+
+	// TempDir is the directory the intermediate AVI files are written to.
+	TempDir string
+	// Project is the name the intermediate AVI files are named after,
+	// like <project>-moshed-*.avi, so they can be found afterwards.
+	Project string
+	// KeepIntermediates specifies whether the intermediate AVI files
+	// are kept after running the pipeline instead of being removed.
+	KeepIntermediates bool
+	// Cache stores the moshable AVI files the input file is converted to,
+	// reusing them if the input file is converted with the same
+	// parameters again. If it is nil, the input file is always converted.
+	Cache *AviCache
+
+	// StageStarted is called before each stage if it is not nil.
+	StageStarted func(stage PipelineStage)
+	// StageFinished is called after each stage if it is not nil,
+	// with the error the stage failed with.
+	StageFinished func(stage PipelineStage, err error)
+	// Observer is notified of the events of each stage if it is not nil.
+	Observer Observer
+}
+
+// PipelineResult holds the intermediate files
+// kept after running a Pipeline.
+type PipelineResult struct {
+	// AviFile is the moshable AVI file the input file was converted to.
+	// It is always kept if it is stored in the pipeline's cache.
+	AviFile string
+	// AviCached specifies whether AviFile is stored in the cache,
+	// in which case it must not be removed.
+	AviCached bool
+	// MoshedFile is the AVI file the datamoshing effect was applied to.
+	MoshedFile string
+	// FirstFrame is the index of the first frame of the AVI files
+	// in the input file, which is 0 unless a segment is moshed.
+	FirstFrame uint64
+}
+
+// NewPipeline returns a Pipeline applying the datamoshing effect to the
+// input file, using the ffmpeg and ffprobe executables in the PATH,
+// the highest quality and the audio of the input file.
+// The project is named after the input file.
+func NewPipeline(inputFile string, outputFile string, mosh MoshFunc) *Pipeline {
+	return &Pipeline{
+		FFmpegPath:  "ffmpeg",
+		FFprobePath: "ffprobe",
+		InputFile:   inputFile,
+		OutputFile:  outputFile,
+		AudioFile:   inputFile,
+		Mosh:        mosh,
+		Encoding:    AviEncodeOptions{Quality: 1},
+		TempDir:     os.TempDir(),
+		Project:     ProjectName(inputFile),
+	}
+}
+
+// Run runs the stages of the pipeline, returning the intermediate files
+// that were written if KeepIntermediates is set, even if a stage failed.
+// Otherwise, the intermediate files are removed and the returned result is empty.
+func (p *Pipeline) Run(ctx context.Context) (*PipelineResult, error) {
+	result := &PipelineResult{}
+	if p.Mosh == nil {
+		return result, errors.New("pipeline has no moshing effect")
+	}
+
+	profile := p.Profile
+	if profile == nil {
+		var err error
+		if profile, err = OutputProfileForFile(p.OutputFile); err != nil {
+			return result, err
+		}
+	}
+	// fail before converting the input file
+	// if the output file can't be written
+	if err := profile.checkOutputFile(p.OutputFile); err != nil {
+		return result, err
+	}
+	if err := p.Segment.validate(); err != nil {
+		return result, err
+	}
+	stitch := p.Stitch && !p.Segment.IsZero()
+	if stitch && profile.Copy {
+		return result, fmt.Errorf("the %s profile can't be used to stitch files", profile.Name)
+	}
+
+	defer func() {
+		if !p.KeepIntermediates {
+			if result.AviFile != "" && !result.AviCached {
+				os.Remove(result.AviFile)
+			}
+			if result.MoshedFile != "" {
+				os.Remove(result.MoshedFile)
+			}
+			*result = PipelineResult{}
+		}
+	}()
+
+	err := p.runStage(StageConvert, "error writing AVI file", func() error {
+		return p.convert(ctx, result)
+	})
+	if err != nil {
+		return result, err
+	}
+
+	err = p.runStage(StageMosh, "error moshing AVI file", func() error {
+		var err error
+		if result.MoshedFile, err = tempAviFile(p.TempDir, p.Project, "moshed"); err != nil {
+			return err
+		}
+		return p.mosh(ctx, result.AviFile, result.MoshedFile, result.FirstFrame)
+	})
+	if err != nil {
+		return result, err
+	}
+
+	err = p.runStage(StageBake, "error writing output file", func() error {
+		if stitch {
+			return StitchSync(ctx, p.FFmpegPath, p.FFprobePath, p.FFmpegLogPath,
+				p.InputFile, p.VideoStream, p.Segment, p.Format, result.MoshedFile, p.OutputFile, profile, p.Observer)
+		}
+		return BakeSync(ctx, p.FFmpegPath, p.FFprobePath, p.FFmpegLogPath,
+			result.MoshedFile, 0, p.AudioFile, p.Segment, p.OutputFile, profile, p.Observer)
+	})
+	return result, err
+}
+
+// runStage runs a stage of the pipeline, calling the stage hooks.
+// Errors are prefixed with the given message, while keeping
+// the original error accessible using errors.As.
+func (p *Pipeline) runStage(stage PipelineStage, errorPrefix string, run func() error) error {
+	if p.StageStarted != nil {
+		p.StageStarted(stage)
+	}
+	err := run()
+	if err != nil {
+		err = fmt.Errorf("%s: %w", errorPrefix, err)
+	}
+	if p.StageFinished != nil {
+		p.StageFinished(stage, err)
+	}
+	return err
+}
+
+// convert converts the input file into a moshable AVI file,
+// or takes it from the cache if it has been converted before.
+func (p *Pipeline) convert(ctx context.Context, result *PipelineResult) error {
+	// the input file is only probed here if the first frame
+	// of the segment is required, and otherwise while converting
+	var video *StreamInfo
+	var duration time.Duration
+	if !p.Segment.IsZero() {
+		// find the first frame of the segment
+		// to place the I-Frames relative to it
+		var err error
+		if video, duration, err = probeVideo(ctx, p.FFprobePath, p.InputFile, p.VideoStream); err != nil {
+			return err
+		}
+		if result.FirstFrame, err = p.Segment.FirstFrame(p.Format.VideoFrameRate(video)); err != nil {
+			return err
+		}
+	}
+	iFrames := shiftIFrames(p.IFrames, result.FirstFrame)
+
+	if p.Cache != nil {
+		var err error
+		result.AviFile, err = p.Cache.convertToAvi(ctx, p.FFmpegPath, p.FFprobePath, p.FFmpegLogPath,
+			p.InputFile, p.VideoStream, video, duration, p.Segment, p.Format, p.TempDir, p.Project,
+			p.Encoding, iFrames, p.Observer)
+		result.AviCached = result.AviFile != ""
+		return err
+	}
+
+	var err error
+	if result.AviFile, err = tempAviFile(p.TempDir, p.Project, "converted"); err != nil {
+		return err
+	}
+	return convertToAvi(ctx, p.FFmpegPath, p.FFprobePath, p.FFmpegLogPath, p.InputFile, p.VideoStream, video, duration,
+		p.Segment, p.Format, result.AviFile, p.Encoding, iFrames, newReporter(p.Observer, nil))
+}
+
+// mosh applies the datamoshing effect to the AVI file.
+func (p *Pipeline) mosh(ctx context.Context, aviFileName string, moshedFileName string, firstFrame uint64) error {
+	aviFile, err := os.Open(aviFileName)
+	if err != nil {
+		return fmt.Errorf("could not open AVI file for datamoshing: %s", err.Error())
+	}
+	defer aviFile.Close()
+
+	moshedFile, err := os.Create(moshedFileName)
+	if err != nil {
+		return fmt.Errorf("could not create AVI file for datamoshing: %s", err.Error())
+	}
+	defer moshedFile.Close()
+
+	return p.Mosh(ctx, aviFile, moshedFile, firstFrame, p.Observer)
+}
+
+// ProjectName returns the name of the project moshing the file,
+// which is the name of the file without its extension.
+func ProjectName(fileName string) string {
+	name := filepath.Base(fileName)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if name == "" || name == "." || name == string(filepath.Separator) {
+		return "moshpit"
+	}
+	return name
+}
+
+// tempAviFile creates an empty AVI file in the directory named
+// after the project and the kind of the file, returning its name.
+func tempAviFile(dir string, project string, kind string) (string, error) {
+	f, err := ioutil.TempFile(dir, project+"-"+kind+"-*.avi")
+	if err != nil {
+		return "", fmt.Errorf("could not create temp file: %s", err.Error())
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+// ExportAvi copies the AVI file, like an intermediate file
+// kept by the Pipeline, to the output file.
+// If copying fails, the partially written output file is removed.
+func ExportAvi(aviFile string, outputFile string) error {
+	return copyFile(aviFile, outputFile)
+}
+
+// copyFile copies the contents of the source file to the destination file,
+// removing the destination file if copying fails.
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
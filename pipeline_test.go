@@ -0,0 +1,441 @@
+package moshpit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// pipelineTest holds the temporary files of a pipeline test.
+type pipelineTest struct {
+	dir      string
+	aviFile  string
+	aviData  []byte
+	frames   [][]byte
+	removers []func()
+}
+
+// newPipelineTest returns a pipelineTest with an AVI file,
+// which the ffmpeg script writes in place of the conversions.
+func newPipelineTest(t *testing.T) *pipelineTest {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "moshpit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &pipelineTest{dir: dir, removers: []func(){func() { os.RemoveAll(dir) }}}
+	p.frames = moshTestFrames(6)
+	p.aviData = testAviFile(frameChunks(p.frames...), 0)
+	p.aviFile = filepath.Join(dir, "converted.avi")
+	if err := ioutil.WriteFile(p.aviFile, p.aviData, 0644); err != nil {
+		p.remove()
+		t.Fatal(err)
+	}
+	return p
+}
+
+// script writes a shell script, removing it along with the other files.
+func (p *pipelineTest) script(t *testing.T, script string) string {
+	t.Helper()
+	path, remove := writeScript(t, script)
+	p.removers = append(p.removers, remove)
+	return path
+}
+
+// ffmpeg returns an ffmpeg script copying the AVI file to the output file,
+// or failing with the given message if it is not empty.
+func (p *pipelineTest) ffmpeg(t *testing.T, failure string) string {
+	if failure != "" {
+		return p.script(t, "echo '"+failure+"' >&2\nexit 1\n")
+	}
+	return p.script(t, "for last; do :; done\ncp '"+p.aviFile+"' \"$last\"\n")
+}
+
+// ffprobe returns an ffprobe script reporting a single video stream,
+// which counts its runs in the probes file.
+func (p *pipelineTest) ffprobe(t *testing.T) string {
+	return p.script(t, "echo >> '"+p.probesFile()+"'\n"+
+		`echo '{"streams": [{"index": 0, "codec_type": "video", "r_frame_rate": "25/1", "duration": "1.0", "nb_frames": "25"}]}'`+"\n")
+}
+
+// probes returns the number of times the ffprobe script was run.
+func (p *pipelineTest) probes(t *testing.T) int {
+	t.Helper()
+	data, err := ioutil.ReadFile(p.probesFile())
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(data)
+}
+
+func (p *pipelineTest) probesFile() string {
+	return filepath.Join(p.dir, "probes")
+}
+
+func (p *pipelineTest) remove() {
+	for _, remove := range p.removers {
+		remove()
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	tests := []struct {
+		name       string
+		outputFile string
+		profile    string
+		segment    Segment
+		stitch     bool
+		firstFrame uint64
+		keep       bool
+		failure    string
+		stages     []PipelineStage
+		err        string
+	}{
+		{
+			name:       "AVI output",
+			outputFile: "output.avi",
+			stages:     []PipelineStage{StageConvert, StageMosh, StageBake},
+		},
+		{
+			name:       "MP4 output",
+			outputFile: "output.mp4",
+			stages:     []PipelineStage{StageConvert, StageMosh, StageBake},
+		},
+		{
+			name:       "kept intermediates",
+			outputFile: "output.avi",
+			keep:       true,
+			stages:     []PipelineStage{StageConvert, StageMosh, StageBake},
+		},
+		{
+			name:       "segment",
+			outputFile: "output.avi",
+			segment:    Segment{Start: 200 * time.Millisecond},
+			firstFrame: 5,
+			keep:       true,
+			stages:     []PipelineStage{StageConvert, StageMosh, StageBake},
+		},
+		{
+			name:       "stitched segment",
+			outputFile: "output.mp4",
+			segment:    Segment{Start: 200 * time.Millisecond, End: 400 * time.Millisecond},
+			stitch:     true,
+			stages:     []PipelineStage{StageConvert, StageMosh, StageBake},
+		},
+		{
+			name:       "stitched AVI output",
+			outputFile: "output.avi",
+			segment:    Segment{Start: 200 * time.Millisecond},
+			stitch:     true,
+			err:        "the avi profile can't be used to stitch files",
+		},
+		{
+			name:       "failing conversion",
+			outputFile: "output.avi",
+			failure:    "invalid input",
+			stages:     []PipelineStage{StageConvert},
+			err:        "error writing AVI file: ",
+		},
+		{
+			name:       "failing conversion with kept intermediates",
+			outputFile: "output.avi",
+			keep:       true,
+			failure:    "invalid input",
+			stages:     []PipelineStage{StageConvert},
+			err:        "error writing AVI file: ",
+		},
+		{
+			name:       "unsupported output file extension",
+			outputFile: "output.flv",
+			err:        `unsupported output file extension ".flv", must be one of `,
+		},
+		{
+			name:       "unsupported output file of the profile",
+			outputFile: "output.mp4",
+			profile:    "avi",
+			err:        "output file of the avi profile must have the .avi extension",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pt := newPipelineTest(t)
+			defer pt.remove()
+			tempDir := filepath.Join(pt.dir, "temp")
+			if err := os.Mkdir(tempDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			outputFile := filepath.Join(pt.dir, test.outputFile)
+			p := NewPipeline(filepath.Join(pt.dir, "input.mp4"), outputFile, RemoveFramesMosh([]uint64{test.firstFrame + 2}))
+			p.FFmpegPath = pt.ffmpeg(t, test.failure)
+			p.FFprobePath = pt.ffprobe(t)
+			p.TempDir = tempDir
+			p.KeepIntermediates = test.keep
+			p.Segment = test.segment
+			p.Stitch = test.stitch
+			if test.profile != "" {
+				var err error
+				if p.Profile, err = OutputProfileByName(test.profile); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var started, finished []PipelineStage
+			p.StageStarted = func(stage PipelineStage) {
+				started = append(started, stage)
+			}
+			p.StageFinished = func(stage PipelineStage, err error) {
+				if (err != nil) != (test.err != "" && stage == test.stages[len(test.stages)-1]) {
+					t.Errorf("stage %s finished with error %v", stage, err)
+				}
+				// the input file is probed once for the segment and the conversion
+				if probes := pt.probes(t); stage == StageConvert && probes != 1 {
+					t.Errorf("probed the input file %d times while converting, want once", probes)
+				}
+				finished = append(finished, stage)
+			}
+
+			result, err := p.Run(context.Background())
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(started) != len(test.stages) || len(finished) != len(test.stages) {
+				t.Fatalf("started stages %v and finished stages %v, want %v", started, finished, test.stages)
+			}
+			for i, stage := range test.stages {
+				if started[i] != stage || finished[i] != stage {
+					t.Fatalf("started stages %v and finished stages %v, want %v", started, finished, test.stages)
+				}
+			}
+
+			// only kept intermediate files may remain in the temp directory
+			tempFiles, err := ioutil.ReadDir(tempDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var intermediates []string
+			for _, fileName := range []string{result.AviFile, result.MoshedFile} {
+				if fileName != "" {
+					intermediates = append(intermediates, fileName)
+				}
+			}
+			if !test.keep && len(intermediates) > 0 {
+				t.Fatalf("got intermediate files %v, want none", intermediates)
+			}
+			if len(tempFiles) != len(intermediates) {
+				t.Fatalf("got %d files in the temp directory, want the %d kept intermediate files",
+					len(tempFiles), len(intermediates))
+			}
+			for i, fileName := range intermediates {
+				if filepath.Dir(fileName) != tempDir {
+					t.Fatalf("intermediate file %s is not in the temp directory", fileName)
+				}
+				// the intermediate files are named after the input file
+				prefix := []string{"input-converted-", "input-moshed-"}[i]
+				if !strings.HasPrefix(filepath.Base(fileName), prefix) {
+					t.Fatalf("intermediate file %s is not named %s*.avi", fileName, prefix)
+				}
+			}
+
+			// the result is only kept along with the intermediate files
+			if test.keep && result.FirstFrame != test.firstFrame {
+				t.Fatalf("got first frame %d, want %d", result.FirstFrame, test.firstFrame)
+			}
+
+			if test.err != "" {
+				if _, err := os.Stat(outputFile); !os.IsNotExist(err) {
+					t.Fatalf("output file exists after failing")
+				}
+				return
+			}
+
+			output, err := ioutil.ReadFile(outputFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filepath.Ext(outputFile) == ".avi" {
+				checkMoshedFrames(t, output, pt.frames, []int{0, 1, 3, 3, 4, 5})
+			} else if !bytes.Equal(output, pt.aviData) {
+				t.Fatal("output file wasn't written by ffmpeg")
+			}
+			if test.keep {
+				converted, err := ioutil.ReadFile(result.AviFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				moshed, err := ioutil.ReadFile(result.MoshedFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(converted, pt.aviData) {
+					t.Fatal("kept AVI file doesn't match the converted file")
+				}
+				checkMoshedFrames(t, moshed, pt.frames, []int{0, 1, 3, 3, 4, 5})
+			}
+		})
+	}
+}
+
+func TestPipelineWithoutMosh(t *testing.T) {
+	p := NewPipeline("input.mp4", "output.mp4", nil)
+	if _, err := p.Run(context.Background()); err == nil || err.Error() != "pipeline has no moshing effect" {
+		t.Fatalf("got error %v, want pipeline has no moshing effect", err)
+	}
+}
+
+func TestShiftSplicePoints(t *testing.T) {
+	tests := []struct {
+		name       string
+		points     []SplicePoint
+		firstFrame uint64
+		shifted    []SplicePoint
+	}{
+		{
+			name:       "start of video",
+			points:     []SplicePoint{{Frame: 5, Source: 0}, {Frame: 2, Source: 10}},
+			firstFrame: 0,
+			shifted:    []SplicePoint{{Frame: 5, Source: 0}, {Frame: 2, Source: 10}},
+		},
+		{
+			name:       "points after the first frame",
+			points:     []SplicePoint{{Frame: 20, Source: 3}, {Frame: 12, Source: 0, Length: 4}},
+			firstFrame: 10,
+			shifted:    []SplicePoint{{Frame: 2, Source: 0, Length: 4}, {Frame: 10, Source: 3}},
+		},
+		{
+			name:       "point until the end of the video",
+			points:     []SplicePoint{{Frame: 2, Source: 0}},
+			firstFrame: 10,
+			shifted:    []SplicePoint{{Frame: 1, Source: 9}},
+		},
+		{
+			name:       "point with length ending before the first frame",
+			points:     []SplicePoint{{Frame: 2, Source: 0, Length: 5}},
+			firstFrame: 10,
+			shifted:    nil,
+		},
+		{
+			name:       "point with length ending after the first frame",
+			points:     []SplicePoint{{Frame: 5, Source: 0, Length: 10}},
+			firstFrame: 10,
+			shifted:    []SplicePoint{{Frame: 1, Source: 6, Length: 4}},
+		},
+		{
+			name:       "point ending at the next point",
+			points:     []SplicePoint{{Frame: 5, Source: 0}, {Frame: 8, Source: 20}},
+			firstFrame: 10,
+			shifted:    []SplicePoint{{Frame: 1, Source: 23}},
+		},
+		{
+			name:       "point at the first frame",
+			points:     []SplicePoint{{Frame: 10, Source: 0}, {Frame: 15, Source: 20}},
+			firstFrame: 10,
+			shifted:    []SplicePoint{{Frame: 1, Source: 1}, {Frame: 5, Source: 20}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shifted := shiftSplicePoints(test.points, test.firstFrame)
+			if len(shifted) != len(test.shifted) {
+				t.Fatalf("got splice points %+v, want %+v", shifted, test.shifted)
+			}
+			for i := range shifted {
+				if shifted[i] != test.shifted[i] {
+					t.Fatalf("got splice points %+v, want %+v", shifted, test.shifted)
+				}
+			}
+		})
+	}
+}
+
+func TestProjectName(t *testing.T) {
+	tests := []struct {
+		fileName string
+		project  string
+	}{
+		{fileName: "input.mp4", project: "input"},
+		{fileName: filepath.Join("dir.d", "clip.final.mov"), project: "clip.final"},
+		{fileName: "input", project: "input"},
+		{fileName: ".mp4", project: "moshpit"},
+		{fileName: "", project: "moshpit"},
+	}
+
+	for _, test := range tests {
+		if project := ProjectName(test.fileName); project != test.project {
+			t.Errorf("ProjectName(%s) = %s, want %s", test.fileName, project, test.project)
+		}
+	}
+}
+
+func TestExportAvi(t *testing.T) {
+	pt := newPipelineTest(t)
+	defer pt.remove()
+
+	tests := []struct {
+		name    string
+		aviFile string
+		err     bool
+	}{
+		{name: "AVI file", aviFile: pt.aviFile},
+		{name: "missing AVI file", aviFile: filepath.Join(pt.dir, "missing.avi"), err: true},
+		// the output file is created before reading fails
+		{name: "unreadable AVI file", aviFile: pt.dir, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outputFile := filepath.Join(pt.dir, "exported.avi")
+			defer os.Remove(outputFile)
+			err := ExportAvi(test.aviFile, outputFile)
+			if test.err {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				if _, err := os.Stat(outputFile); !os.IsNotExist(err) {
+					t.Fatal("the partially written output file exists")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, err := ioutil.ReadFile(outputFile); err != nil || !bytes.Equal(data, pt.aviData) {
+				t.Fatalf("exported file doesn't match the AVI file: %v", err)
+			}
+		})
+	}
+}
+
+func TestPipelineStageString(t *testing.T) {
+	tests := []struct {
+		stage PipelineStage
+		want  string
+	}{
+		{StageConvert, "convert"},
+		{StageMosh, "mosh"},
+		{StageBake, "bake"},
+		{PipelineStage(99), "unknown"},
+	}
+
+	for _, test := range tests {
+		if got := test.stage.String(); got != test.want {
+			t.Errorf("got %s for stage %d, want %s", got, test.stage, test.want)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package moshpit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Rational is a rational number like the frame rates reported by ffprobe.
+type Rational struct {
+	Num int64
+	Den int64
+}
+
+// parseRational parses a rational number in the format num/den.
+func parseRational(s string) (Rational, error) {
+	spl := strings.SplitN(s, "/", 2)
+	num, err := strconv.ParseInt(spl[0], 10, 64)
+	if err != nil {
+		return Rational{}, fmt.Errorf(`"%s" is not a valid rational number`, s)
+	}
+	den := int64(1)
+	if len(spl) == 2 {
+		den, err = strconv.ParseInt(spl[1], 10, 64)
+		if err != nil {
+			return Rational{}, fmt.Errorf(`"%s" is not a valid rational number`, s)
+		}
+	}
+	return Rational{Num: num, Den: den}, nil
+}
+
+// Float64 returns the value of the rational number,
+// or 0 if its denominator is 0.
+func (r Rational) Float64() float64 {
+	if r.Den == 0 {
+		return 0
+	}
+	return float64(r.Num) / float64(r.Den)
+}
+
+// reduce returns the rational number with the greatest
+// common divisor removed from its numerator and denominator.
+func (r Rational) reduce() Rational {
+	a, b := r.Num, r.Den
+	for b != 0 {
+		a, b = b, a%b
+	}
+	if a < 0 {
+		a = -a
+	}
+	if a == 0 {
+		return r
+	}
+	return Rational{Num: r.Num / a, Den: r.Den / a}
+}
+
+func (r Rational) String() string {
+	return fmt.Sprintf("%d/%d", r.Num, r.Den)
+}
+
+// MediaInfo describes the container and streams of a media file.
+type MediaInfo struct {
+	// FormatName is the name of the container format, like "mov,mp4,m4a,3gp,3g2,mj2"
+	FormatName string
+	Duration   time.Duration
+	Streams    []StreamInfo
+}
+
+// StreamInfo describes a single stream of a media file.
+type StreamInfo struct {
+	// Index is the index of the stream in the file
+	Index int
+	// TypeIndex is the index of the stream among
+	// the streams of the same type
+	TypeIndex int
+	// Type is the type of the stream, like "video", "audio" or "subtitle"
+	Type      string
+	CodecName string
+	Duration  time.Duration
+	// FrameCount is the number of frames or packets of the stream
+	FrameCount uint64
+
+	// the properties of video streams
+	Width        int
+	Height       int
+	PixelFormat  string
+	RFrameRate   Rational
+	AvgFrameRate Rational
+
+	// the properties of audio streams
+	SampleRate int
+	Channels   int
+}
+
+// FrameRate returns the average frame rate of a video stream,
+// falling back to its base frame rate if the average is unknown.
+func (s *StreamInfo) FrameRate() float64 {
+	if fps := s.AvgFrameRate.Float64(); fps > 0 {
+		return fps
+	}
+	return s.RFrameRate.Float64()
+}
+
+// VideoStream returns the video stream with the given index among
+// the video streams, like the stream selected by the ffmpeg stream
+// specifier v:1 for index 1. It returns nil if there is no such stream.
+func (m *MediaInfo) VideoStream(index int) *StreamInfo {
+	for i := range m.Streams {
+		if m.Streams[i].Type == "video" && m.Streams[i].TypeIndex == index {
+			return &m.Streams[i]
+		}
+	}
+	return nil
+}
+
+// ffprobeOutput is the JSON output of ffprobe.
+type ffprobeOutput struct {
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+	} `json:"format"`
+	Streams []struct {
+		Index         int    `json:"index"`
+		CodecType     string `json:"codec_type"`
+		CodecName     string `json:"codec_name"`
+		Duration      string `json:"duration"`
+		NbFrames      string `json:"nb_frames"`
+		NbReadPackets string `json:"nb_read_packets"`
+		Width         int    `json:"width"`
+		Height        int    `json:"height"`
+		PixFmt        string `json:"pix_fmt"`
+		RFrameRate    string `json:"r_frame_rate"`
+		AvgFrameRate  string `json:"avg_frame_rate"`
+		SampleRate    string `json:"sample_rate"`
+		Channels      int    `json:"channels"`
+	} `json:"streams"`
+}
+
+// Probe uses ffprobe to read the container and stream information
+// of the input file. If the container doesn't store the number of frames
+// of a video stream, its packets are counted to determine the number
+// of frames, which requires the whole file to be read.
+func Probe(ctx context.Context, ffprobePath string, inputFile string) (*MediaInfo, error) {
+	out, err := runFFprobe(ctx, ffprobePath, "-show_format", "-show_streams", inputFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// count the packets of the video streams
+	// whose number of frames is unknown
+	var packets map[int]string
+	for _, s := range out.Streams {
+		if s.CodecType == "video" && (s.NbFrames == "" || s.NbFrames == "0") {
+			counted, err := runFFprobe(ctx, ffprobePath, "-select_streams", "v",
+				"-count_packets", "-show_entries", "stream=index,nb_read_packets", inputFile)
+			if err != nil {
+				return nil, err
+			}
+			packets = make(map[int]string)
+			for _, c := range counted.Streams {
+				packets[c.Index] = c.NbReadPackets
+			}
+			break
+		}
+	}
+
+	info := &MediaInfo{
+		FormatName: out.Format.FormatName,
+		Duration:   parseSeconds(out.Format.Duration),
+	}
+
+	typeCounts := make(map[string]int)
+	for _, s := range out.Streams {
+		stream := StreamInfo{
+			Index:       s.Index,
+			TypeIndex:   typeCounts[s.CodecType],
+			Type:        s.CodecType,
+			CodecName:   s.CodecName,
+			Duration:    parseSeconds(s.Duration),
+			Width:       s.Width,
+			Height:      s.Height,
+			PixelFormat: s.PixFmt,
+			Channels:    s.Channels,
+		}
+		typeCounts[s.CodecType]++
+
+		// not all containers store the number of frames,
+		// in which case the counted packets are used
+		stream.FrameCount, _ = strconv.ParseUint(s.NbFrames, 10, 64)
+		if stream.FrameCount == 0 {
+			stream.FrameCount, _ = strconv.ParseUint(packets[s.Index], 10, 64)
+		}
+
+		if s.RFrameRate != "" {
+			if stream.RFrameRate, err = parseRational(s.RFrameRate); err != nil {
+				return nil, err
+			}
+		}
+		if s.AvgFrameRate != "" {
+			if stream.AvgFrameRate, err = parseRational(s.AvgFrameRate); err != nil {
+				return nil, err
+			}
+		}
+		if s.SampleRate != "" {
+			if stream.SampleRate, err = strconv.Atoi(s.SampleRate); err != nil {
+				return nil, fmt.Errorf(`"%s" is not a valid sample rate`, s.SampleRate)
+			}
+		}
+
+		info.Streams = append(info.Streams, stream)
+	}
+
+	if info.Duration == 0 {
+		// use the duration of the longest stream
+		// if the container doesn't specify it
+		for _, stream := range info.Streams {
+			if stream.Duration > info.Duration {
+				info.Duration = stream.Duration
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// runFFprobe runs ffprobe with the given arguments,
+// parsing its JSON output.
+func runFFprobe(ctx context.Context, ffprobePath string, args ...string) (*ffprobeOutput, error) {
+	cmd := exec.CommandContext(ctx, ffprobePath,
+		append([]string{"-v", "error", "-print_format", "json"}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("ffprobe: %s", msg)
+		}
+		return nil, err
+	}
+
+	var out ffprobeOutput
+	if err := json.Unmarshal(output, &out); err != nil {
+		return nil, fmt.Errorf("error parsing ffprobe output: %s", err.Error())
+	}
+	return &out, nil
+}
+
+// probeVideo probes the input file, returning the video stream with the
+// given index among the video streams and the duration to report the
+// progress of processing it against.
+func probeVideo(ctx context.Context, ffprobePath string, inputFile string, videoStream int) (*StreamInfo, time.Duration, error) {
+	info, err := Probe(ctx, ffprobePath, inputFile)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error probing input file: %s", err.Error())
+	}
+	video := info.VideoStream(videoStream)
+	if video == nil {
+		return nil, 0, fmt.Errorf("input file does not have a video stream v:%d", videoStream)
+	}
+
+	duration := video.Duration
+	if duration == 0 {
+		duration = info.Duration
+	}
+	return video, duration, nil
+}
+
+// StreamSpecifier returns the ffmpeg stream specifier
+// selecting the stream, like v:1 or a:0.
+func (s *StreamInfo) StreamSpecifier() string {
+	t := "d"
+	switch s.Type {
+	case "video":
+		t = "v"
+	case "audio":
+		t = "a"
+	case "subtitle":
+		t = "s"
+	case "attachment":
+		t = "t"
+	}
+	return fmt.Sprintf("%s:%d", t, s.TypeIndex)
+}
+
+// parseSeconds parses a duration in seconds as written by ffprobe,
+// returning 0 if the duration is unknown.
+func parseSeconds(s string) time.Duration {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(seconds) || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
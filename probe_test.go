@@ -0,0 +1,393 @@
+package moshpit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// writeScript writes an executable shell script to a temporary directory,
+// which is used in place of ffmpeg and ffprobe.
+// It returns the path of the script and a function removing it.
+func writeScript(t *testing.T, script string) (string, func()) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts are not supported on windows")
+	}
+	dir, err := ioutil.TempDir("", "moshpit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "script")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// probeScript returns an ffprobe script printing the output,
+// or the counted output if the packets are counted.
+// If counted is empty, counting the packets fails.
+func probeScript(output string, counted string) string {
+	countScript := "echo 'packets were counted' >&2\nexit 1\n"
+	if counted != "" {
+		countScript = "cat <<'EOF'\n" + counted + "\nEOF\n"
+	}
+	return "case \" $* \" in\n*\" -count_packets \"*)\n" + countScript + ";;\n" +
+		"*)\ncat <<'EOF'\n" + output + "\nEOF\n;;\nesac\n"
+}
+
+// testProbeOutput is the ffprobe output of an MP4 file
+// with an audio stream and two video streams,
+// the first of which doesn't store its number of frames.
+const testProbeOutput = `{
+  "streams": [
+    {
+      "index": 0,
+      "codec_name": "aac",
+      "codec_type": "audio",
+      "sample_rate": "48000",
+      "channels": 2,
+      "r_frame_rate": "0/0",
+      "avg_frame_rate": "0/0",
+      "duration": "10.005333",
+      "nb_frames": "469"
+    },
+    {
+      "index": 1,
+      "codec_name": "h264",
+      "codec_type": "video",
+      "width": 1920,
+      "height": 1080,
+      "pix_fmt": "yuv420p",
+      "r_frame_rate": "30000/1001",
+      "avg_frame_rate": "30000/1001",
+      "duration": "10.010000"
+    },
+    {
+      "index": 2,
+      "codec_name": "mjpeg",
+      "codec_type": "video",
+      "width": 320,
+      "height": 180,
+      "pix_fmt": "yuvj420p",
+      "r_frame_rate": "90000/1",
+      "avg_frame_rate": "0/0",
+      "nb_frames": "1"
+    }
+  ],
+  "format": {
+    "format_name": "mov,mp4,m4a,3gp,3g2,mj2",
+    "duration": "10.010000"
+  }
+}`
+
+// testCountedOutput is the ffprobe output of the packets
+// counted in the video streams of the MP4 file.
+const testCountedOutput = `{
+  "streams": [
+    {"index": 1, "nb_read_packets": "300"},
+    {"index": 2, "nb_read_packets": "1"}
+  ]
+}`
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		counted string
+		info    *MediaInfo
+		err     string
+	}{
+		{
+			name:    "streams",
+			output:  testProbeOutput,
+			counted: testCountedOutput,
+			info: &MediaInfo{
+				FormatName: "mov,mp4,m4a,3gp,3g2,mj2",
+				Duration:   10010 * time.Millisecond,
+				Streams: []StreamInfo{
+					{
+						Index:        0,
+						TypeIndex:    0,
+						Type:         "audio",
+						CodecName:    "aac",
+						Duration:     10005333 * time.Microsecond,
+						FrameCount:   469,
+						RFrameRate:   Rational{0, 0},
+						AvgFrameRate: Rational{0, 0},
+						SampleRate:   48000,
+						Channels:     2,
+					},
+					{
+						Index:        1,
+						TypeIndex:    0,
+						Type:         "video",
+						CodecName:    "h264",
+						Duration:     10010 * time.Millisecond,
+						FrameCount:   300,
+						Width:        1920,
+						Height:       1080,
+						PixelFormat:  "yuv420p",
+						RFrameRate:   Rational{30000, 1001},
+						AvgFrameRate: Rational{30000, 1001},
+					},
+					{
+						Index:        2,
+						TypeIndex:    1,
+						Type:         "video",
+						CodecName:    "mjpeg",
+						FrameCount:   1,
+						Width:        320,
+						Height:       180,
+						PixelFormat:  "yuvj420p",
+						RFrameRate:   Rational{90000, 1},
+						AvgFrameRate: Rational{0, 0},
+					},
+				},
+			},
+		},
+		{
+			name: "duration of the longest stream",
+			output: `{"streams": [
+				{"index": 0, "codec_type": "video", "duration": "4.5"},
+				{"index": 1, "codec_type": "audio", "duration": "5.25"}
+			], "format": {"format_name": "avi", "duration": "N/A"}}`,
+			counted: `{"streams": [{"index": 0, "nb_read_packets": "112"}]}`,
+			info: &MediaInfo{
+				FormatName: "avi",
+				Duration:   5250 * time.Millisecond,
+				Streams: []StreamInfo{
+					{Index: 0, Type: "video", Duration: 4500 * time.Millisecond, FrameCount: 112},
+					{Index: 1, Type: "audio", Duration: 5250 * time.Millisecond},
+				},
+			},
+		},
+		{
+			// the packets aren't counted if the number of frames is stored
+			name:   "stored frame counts",
+			output: `{"streams": [{"index": 0, "codec_type": "video", "nb_frames": "250"}]}`,
+			info: &MediaInfo{
+				Streams: []StreamInfo{
+					{Index: 0, Type: "video", FrameCount: 250},
+				},
+			},
+		},
+		{
+			name:   "failing packet count",
+			output: `{"streams": [{"index": 0, "codec_type": "video", "nb_frames": "0"}]}`,
+			err:    "ffprobe: packets were counted",
+		},
+		{
+			name:   "invalid frame rate",
+			output: `{"streams": [{"index": 0, "codec_type": "video", "nb_frames": "1", "r_frame_rate": "30/x"}]}`,
+			err:    `"30/x" is not a valid rational number`,
+		},
+		{
+			name:   "invalid sample rate",
+			output: `{"streams": [{"index": 0, "codec_type": "audio", "sample_rate": "high"}]}`,
+			err:    `"high" is not a valid sample rate`,
+		},
+		{
+			name:   "invalid output",
+			output: `{"streams": {}}`,
+			err:    "error parsing ffprobe output: ",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ffprobePath, remove := writeScript(t, probeScript(test.output, test.counted))
+			defer remove()
+
+			info, err := Probe(context.Background(), ffprobePath, "input.mp4")
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.FormatName != test.info.FormatName || info.Duration != test.info.Duration {
+				t.Fatalf("got format %s with duration %s, want format %s with duration %s",
+					info.FormatName, info.Duration, test.info.FormatName, test.info.Duration)
+			}
+			if len(info.Streams) != len(test.info.Streams) {
+				t.Fatalf("got %d streams, want %d", len(info.Streams), len(test.info.Streams))
+			}
+			for i, stream := range info.Streams {
+				if stream != test.info.Streams[i] {
+					t.Fatalf("stream %d: got %+v, want %+v", i, stream, test.info.Streams[i])
+				}
+			}
+		})
+	}
+}
+
+func TestProbeError(t *testing.T) {
+	ffprobePath, remove := writeScript(t, "echo 'input.mp4: No such file or directory' >&2\nexit 1\n")
+	defer remove()
+
+	_, err := Probe(context.Background(), ffprobePath, "input.mp4")
+	if expected := "ffprobe: input.mp4: No such file or directory"; err == nil || err.Error() != expected {
+		t.Fatalf("got error %v, want %s", err, expected)
+	}
+}
+
+func TestMediaInfoVideoStream(t *testing.T) {
+	info := &MediaInfo{Streams: []StreamInfo{
+		{Index: 0, Type: "audio", TypeIndex: 0},
+		{Index: 1, Type: "video", TypeIndex: 0},
+		{Index: 2, Type: "audio", TypeIndex: 1},
+		{Index: 3, Type: "video", TypeIndex: 1},
+	}}
+	tests := []struct {
+		index  int
+		stream int
+	}{
+		{index: 0, stream: 1},
+		{index: 1, stream: 3},
+		{index: 2, stream: -1},
+	}
+
+	for _, test := range tests {
+		video := info.VideoStream(test.index)
+		if (video == nil) != (test.stream < 0) || (video != nil && video.Index != test.stream) {
+			t.Errorf("got stream %+v for video stream %d, want stream %d", video, test.index, test.stream)
+		}
+	}
+}
+
+func TestStreamSpecifier(t *testing.T) {
+	tests := []struct {
+		stream    StreamInfo
+		specifier string
+	}{
+		{stream: StreamInfo{Type: "video", TypeIndex: 0}, specifier: "v:0"},
+		{stream: StreamInfo{Type: "video", TypeIndex: 2}, specifier: "v:2"},
+		{stream: StreamInfo{Type: "audio", TypeIndex: 1}, specifier: "a:1"},
+		{stream: StreamInfo{Type: "subtitle", TypeIndex: 0}, specifier: "s:0"},
+		{stream: StreamInfo{Type: "attachment", TypeIndex: 0}, specifier: "t:0"},
+		{stream: StreamInfo{Type: "data", TypeIndex: 3}, specifier: "d:3"},
+	}
+
+	for _, test := range tests {
+		if specifier := test.stream.StreamSpecifier(); specifier != test.specifier {
+			t.Errorf("got stream specifier %s for %+v, want %s", specifier, test.stream, test.specifier)
+		}
+	}
+}
+
+func TestProbeVideo(t *testing.T) {
+	ffprobePath, remove := writeScript(t, probeScript(testProbeOutput, testCountedOutput))
+	defer remove()
+
+	tests := []struct {
+		videoStream int
+		stream      int
+		duration    time.Duration
+		err         string
+	}{
+		{videoStream: 0, stream: 1, duration: 10010 * time.Millisecond},
+		// the stream has no duration, so the duration of the file is used
+		{videoStream: 1, stream: 2, duration: 10010 * time.Millisecond},
+		{videoStream: 2, err: "input file does not have a video stream v:2"},
+	}
+
+	for _, test := range tests {
+		video, duration, err := probeVideo(context.Background(), ffprobePath, "input.mp4", test.videoStream)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("video stream %d: got error %v, want %s", test.videoStream, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("video stream %d: %v", test.videoStream, err)
+		} else if video.Index != test.stream || duration != test.duration {
+			t.Errorf("video stream %d: got stream %d with duration %s, want stream %d with duration %s",
+				test.videoStream, video.Index, duration, test.stream, test.duration)
+		}
+	}
+}
+
+func TestRational(t *testing.T) {
+	tests := []struct {
+		s        string
+		rational Rational
+		value    float64
+		err      bool
+	}{
+		{s: "25", rational: Rational{25, 1}, value: 25},
+		{s: "25/1", rational: Rational{25, 1}, value: 25},
+		{s: "30000/1001", rational: Rational{30000, 1001}, value: 30000.0 / 1001},
+		{s: "0/0", rational: Rational{0, 0}, value: 0},
+		{s: "", err: true},
+		{s: "1/", err: true},
+		{s: "1.5/2", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.s, func(t *testing.T) {
+			rational, err := parseRational(test.s)
+			if test.err {
+				if err == nil {
+					t.Fatalf("got %v, want an error", rational)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rational != test.rational || rational.Float64() != test.value {
+				t.Fatalf("got %v with value %v, want %v with value %v",
+					rational, rational.Float64(), test.rational, test.value)
+			}
+		})
+	}
+}
+
+func TestRationalReduce(t *testing.T) {
+	tests := []struct {
+		rational Rational
+		reduced  Rational
+	}{
+		{rational: Rational{50, 2}, reduced: Rational{25, 1}},
+		{rational: Rational{30000, 1001}, reduced: Rational{30000, 1001}},
+		{rational: Rational{2997, 100}, reduced: Rational{2997, 100}},
+		{rational: Rational{0, 0}, reduced: Rational{0, 0}},
+		{rational: Rational{0, 5}, reduced: Rational{0, 1}},
+	}
+
+	for _, test := range tests {
+		if reduced := test.rational.reduce(); reduced != test.reduced {
+			t.Errorf("got %s for %s, want %s", reduced, test.rational, test.reduced)
+		}
+	}
+}
+
+func TestStreamInfoFrameRate(t *testing.T) {
+	tests := []struct {
+		stream StreamInfo
+		fps    float64
+	}{
+		{stream: StreamInfo{RFrameRate: Rational{30, 1}, AvgFrameRate: Rational{25, 1}}, fps: 25},
+		{stream: StreamInfo{RFrameRate: Rational{30, 1}, AvgFrameRate: Rational{0, 0}}, fps: 30},
+		{stream: StreamInfo{}, fps: 0},
+	}
+
+	for _, test := range tests {
+		if fps := test.stream.FrameRate(); fps != test.fps {
+			t.Errorf("got frame rate %v for %+v, want %v", fps, test.stream, test.fps)
+		}
+	}
+}
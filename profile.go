@@ -0,0 +1,494 @@
+package moshpit
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// OutputProfile describes how a moshed AVI file
+// is encoded into an output file by Bake.
+type OutputProfile struct {
+	// Name is the name the profile is selected by, like "h264".
+	Name        string
+	Description string
+	// Extensions are the file extensions of the output files
+	// of the profile, like ".mp4", with the default extension first.
+	Extensions []string
+	// Copy specifies that the moshed AVI file is written as it is,
+	// to be edited or encoded by other tools.
+	// The options of the profile are ignored.
+	Copy bool
+	// Audio specifies whether the output file can have an audio stream.
+	Audio bool
+	// Options are the ffmpeg output options used to encode the output file,
+	// keyed by their name without the leading dash, like "c:v" or "crf".
+	// Options with an empty value are passed without a value.
+	Options map[string]string
+}
+
+// the output profiles that can be selected by name
+var outputProfiles = []*OutputProfile{
+	{
+		Name:        "h264",
+		Description: "H.264 with constant quality in an MP4 file",
+		Extensions:  []string{".mp4"},
+		Audio:       true,
+		Options: map[string]string{
+			"c:v": "libx264", "crf": "18", "preset": "medium", "pix_fmt": "yuv420p",
+			"movflags": "+faststart", "c:a": "aac", "b:a": "320k",
+		},
+	},
+	{
+		Name:        "h265",
+		Description: "H.265 with constant quality in an MP4 file",
+		Extensions:  []string{".mp4"},
+		Audio:       true,
+		Options: map[string]string{
+			"c:v": "libx265", "crf": "20", "preset": "medium", "pix_fmt": "yuv420p",
+			// make the file playable by Apple devices
+			"tag:v":    "hvc1",
+			"movflags": "+faststart", "c:a": "aac", "b:a": "320k",
+		},
+	},
+	{
+		Name:        "prores",
+		Description: "ProRes 422 HQ in a QuickTime file for editing",
+		Extensions:  []string{".mov"},
+		Audio:       true,
+		Options: map[string]string{
+			"c:v": "prores_ks", "profile:v": "3", "pix_fmt": "yuv422p10le", "c:a": "pcm_s16le",
+		},
+	},
+	{
+		Name:        "prores4444",
+		Description: "ProRes 4444 in a QuickTime file for editing and compositing",
+		Extensions:  []string{".mov"},
+		Audio:       true,
+		Options: map[string]string{
+			"c:v": "prores_ks", "profile:v": "4", "pix_fmt": "yuva444p10le", "c:a": "pcm_s16le",
+		},
+	},
+	{
+		Name:        "vp9",
+		Description: "VP9 with constant quality in a WebM file",
+		Extensions:  []string{".webm"},
+		Audio:       true,
+		Options: map[string]string{
+			"c:v": "libvpx-vp9", "crf": "31", "b:v": "0", "row-mt": "1", "c:a": "libopus", "b:a": "192k",
+		},
+	},
+	{
+		Name:        "av1",
+		Description: "AV1 with constant quality in a WebM file",
+		Extensions:  []string{".webm"},
+		Audio:       true,
+		Options: map[string]string{
+			"c:v": "libaom-av1", "crf": "30", "b:v": "0", "cpu-used": "4", "row-mt": "1",
+			"c:a": "libopus", "b:a": "192k",
+		},
+	},
+	{
+		Name:        "ffv1",
+		Description: "Lossless FFV1 in a Matroska file for archiving",
+		Extensions:  []string{".mkv"},
+		Audio:       true,
+		Options: map[string]string{
+			"c:v": "ffv1", "level": "3", "g": "1", "slicecrc": "1", "c:a": "flac",
+		},
+	},
+	{
+		Name:        "gif",
+		Description: "Animated GIF with an optimized palette",
+		Extensions:  []string{".gif"},
+		Options: map[string]string{
+			// generate a palette from the frames of the video
+			// instead of using the default web-safe palette
+			"vf":   "fps=15,split[a][b];[a]palettegen[p];[b][p]paletteuse",
+			"loop": "0",
+		},
+	},
+	{
+		Name:        "apng",
+		Description: "Animated PNG",
+		Extensions:  []string{".apng", ".png"},
+		Options: map[string]string{
+			"c:v": "apng", "f": "apng", "plays": "0", "pix_fmt": "rgb24",
+		},
+	},
+	{
+		Name:        "avi",
+		Description: "The moshed AVI file without re-encoding",
+		Extensions:  []string{".avi"},
+		Copy:        true,
+	},
+}
+
+// the profiles used for output files of each extension
+var defaultOutputProfiles = map[string]string{
+	".mp4":  "h264",
+	".mov":  "prores",
+	".webm": "vp9",
+	".mkv":  "ffv1",
+	".gif":  "gif",
+	".apng": "apng",
+	".png":  "apng",
+	".avi":  "avi",
+}
+
+// OutputProfiles returns the output profiles
+// that can be selected using OutputProfileByName.
+func OutputProfiles() []*OutputProfile {
+	profiles := make([]*OutputProfile, len(outputProfiles))
+	for i, profile := range outputProfiles {
+		profiles[i] = profile.WithOptions(nil)
+	}
+	return profiles
+}
+
+// OutputProfileByName returns a copy of the output profile with the given name.
+func OutputProfileByName(name string) (*OutputProfile, error) {
+	for _, profile := range outputProfiles {
+		if strings.EqualFold(profile.Name, name) {
+			return profile.WithOptions(nil), nil
+		}
+	}
+	names := make([]string, len(outputProfiles))
+	for i, profile := range outputProfiles {
+		names[i] = profile.Name
+	}
+	return nil, fmt.Errorf(`unknown output profile "%s", must be one of %s`, name, strings.Join(names, ", "))
+}
+
+// OutputProfileForFile returns a copy of the default output profile
+// for files with the extension of the file name.
+func OutputProfileForFile(fileName string) (*OutputProfile, error) {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	name, ok := defaultOutputProfiles[ext]
+	if !ok {
+		exts := make([]string, 0, len(defaultOutputProfiles))
+		for ext := range defaultOutputProfiles {
+			exts = append(exts, ext)
+		}
+		sort.Strings(exts)
+		return nil, fmt.Errorf(`unsupported output file extension "%s", must be one of %s`,
+			filepath.Ext(fileName), strings.Join(exts, ", "))
+	}
+	return OutputProfileByName(name)
+}
+
+// ParseOutputOptions parses a comma-separated list of ffmpeg output options
+// in the format <name>=<value> or <name>, like "crf=23,preset=slow",
+// to override the options of an OutputProfile.
+func ParseOutputOptions(list string) (map[string]string, error) {
+	options := make(map[string]string)
+	for _, option := range strings.Split(list, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		spl := strings.SplitN(option, "=", 2)
+		name := strings.TrimPrefix(strings.TrimSpace(spl[0]), "-")
+		if name == "" {
+			return nil, fmt.Errorf(`"%s" is not a valid output option`, option)
+		}
+		options[name] = ""
+		if len(spl) == 2 {
+			options[name] = strings.TrimSpace(spl[1])
+		}
+	}
+	return options, nil
+}
+
+// WithOptions returns a copy of the profile with the given options
+// added to its options, replacing options of the same name.
+func (p *OutputProfile) WithOptions(options map[string]string) *OutputProfile {
+	profile := *p
+	profile.Extensions = append([]string(nil), p.Extensions...)
+	profile.Options = make(map[string]string, len(p.Options)+len(options))
+	for name, value := range p.Options {
+		profile.Options[name] = value
+	}
+	for name, value := range options {
+		profile.Options[name] = value
+	}
+	return &profile
+}
+
+// Supports returns whether the profile can write
+// output files with the extension of the file name.
+func (p *OutputProfile) Supports(fileName string) bool {
+	ext := filepath.Ext(fileName)
+	for _, e := range p.Extensions {
+		if strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOutputFile returns an error if the profile
+// can't write output files with the extension of the file name.
+func (p *OutputProfile) checkOutputFile(fileName string) error {
+	if !p.Supports(fileName) {
+		return fmt.Errorf("output file of the %s profile must have the %s extension",
+			p.Name, strings.Join(p.Extensions, " or "))
+	}
+	return nil
+}
+
+// args returns the options of the profile as ffmpeg arguments,
+// sorted by name so the arguments are always the same.
+func (p *OutputProfile) args() []string {
+	names := make([]string, 0, len(p.Options))
+	for name := range p.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var args []string
+	for _, name := range names {
+		args = append(args, "-"+name)
+		if value := p.Options[name]; value != "" {
+			args = append(args, value)
+		}
+	}
+	return args
+}
+
+// Bake uses ffmpeg to encode the AVI file into the output file
+// using the given output profile, taking the audio stream from another file.
+// Only the video stream with the given index among the video streams
+// of the AVI file is encoded, which is 0 for files written by ConvertToAvi.
+// The audio is taken from the given segment of the sound file.
+// If the sound file path is empty or the profile doesn't support audio,
+// no audio is added to the output file.
+// Profiles with Copy set copy the AVI file to the output file instead.
+// The AVI file is probed using ffprobe to determine its duration.
+// The encoding progress and the lines of ffmpeg output
+// are sent to the events channel.
+// If encoding fails, an EventError is sent as the last event.
+// The events channel is closed when processing is finished.
+func Bake(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, aviFile string, videoStream int, soundFile string,
+	soundSegment Segment, outputFile string, profile *OutputProfile, events chan<- Event) {
+	sendEvents(ctx, events, func(r reporter) error {
+		return bake(ctx, ffmpegPath, ffprobePath, ffmpegLogPath,
+			aviFile, videoStream, soundFile, soundSegment, outputFile, profile, r)
+	})
+}
+
+// BakeSync is like Bake, but blocks until encoding has finished,
+// notifying the observer of the events if it is not nil.
+func BakeSync(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, aviFile string, videoStream int, soundFile string,
+	soundSegment Segment, outputFile string, profile *OutputProfile, observer Observer) error {
+	return bake(ctx, ffmpegPath, ffprobePath, ffmpegLogPath,
+		aviFile, videoStream, soundFile, soundSegment, outputFile, profile, newReporter(observer, nil))
+}
+
+func bake(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, aviFile string, videoStream int, soundFile string,
+	soundSegment Segment, outputFile string, profile *OutputProfile, r reporter) error {
+
+	if profile == nil {
+		return errors.New("no output profile was specified")
+	}
+	if err := profile.checkOutputFile(outputFile); err != nil {
+		return err
+	}
+
+	if profile.Copy {
+		r.stage("Copying AVI file")
+		if err := copyFile(aviFile, outputFile); err != nil {
+			return err
+		}
+		r.progress(1)
+		return nil
+	}
+
+	// probe the duration of the AVI file to report the progress
+	r.stage("Probing AVI file")
+	_, duration, err := probeVideo(ctx, ffprobePath, aviFile, videoStream)
+	if err != nil {
+		return err
+	}
+
+	// construct ffmpeg arguments
+	args := []string{
+		"-i", aviFile,
+		// only convert the selected video stream
+		"-map", fmt.Sprintf("0:v:%d", videoStream),
+	}
+
+	if soundFile != "" && profile.Audio {
+		// only read the segment of the sound file
+		args = append(args, soundSegment.inputArgs()...)
+		args = append(args, "-i", soundFile)
+
+		// take the audio stream from the sound file
+
+		// makeworld: Question mark was added to support videos with
+		// no audio stream. See this issue: https://github.com/CrushedPixel/moshpit/issues/1
+
+		args = append(args, "-map", "1:a:0?")
+	}
+
+	args = append(args, profile.args()...)
+
+	// force overwrite the output file
+	// to avoid the command line prompt before execution
+	args = append(args, "-y")
+
+	// append output file as last argument
+	args = append(args, outputFile)
+
+	r.stage(fmt.Sprintf("Encoding %s output file", profile.Name))
+	return runFFmpeg(ctx, ffmpegPath, args, ffmpegLogPath, duration, r, nil)
+}
+
+// Stitch uses ffmpeg to encode the input file into the output file
+// using the given output profile, replacing the segment of the video stream
+// with the given index among the video streams of the input file with the
+// AVI file, like a moshed segment converted using ConvertToAvi.
+// The AVI file must have been converted using the given format,
+// which the rest of the input file is converted to as well.
+// The audio stream of the input file is kept as it is.
+// The parts are joined using the concat filter of ffmpeg's filter_complex,
+// so the whole video stream is always encoded again, including the parts
+// before and after the segment, which takes about as long as encoding
+// the whole input file.
+// Profiles with Copy set can't be used to stitch files.
+// The input file is probed using ffprobe to determine its duration.
+// The encoding progress and the lines of ffmpeg output
+// are sent to the events channel.
+// If encoding fails, an EventError is sent as the last event.
+// The events channel is closed when processing is finished.
+func Stitch(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, inputFile string, videoStream int, segment Segment, format AviFormat,
+	aviFile string, outputFile string, profile *OutputProfile, events chan<- Event) {
+	sendEvents(ctx, events, func(r reporter) error {
+		return stitch(ctx, ffmpegPath, ffprobePath, ffmpegLogPath,
+			inputFile, videoStream, segment, format, aviFile, outputFile, profile, r)
+	})
+}
+
+// StitchSync is like Stitch, but blocks until encoding has finished,
+// notifying the observer of the events if it is not nil.
+func StitchSync(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, inputFile string, videoStream int, segment Segment, format AviFormat,
+	aviFile string, outputFile string, profile *OutputProfile, observer Observer) error {
+	return stitch(ctx, ffmpegPath, ffprobePath, ffmpegLogPath,
+		inputFile, videoStream, segment, format, aviFile, outputFile, profile, newReporter(observer, nil))
+}
+
+func stitch(ctx context.Context, ffmpegPath string, ffprobePath string,
+	ffmpegLogPath string, inputFile string, videoStream int, segment Segment, format AviFormat,
+	aviFile string, outputFile string, profile *OutputProfile, r reporter) error {
+
+	if profile == nil {
+		return errors.New("no output profile was specified")
+	}
+	if profile.Copy {
+		return fmt.Errorf("the %s profile can't be used to stitch files", profile.Name)
+	}
+	if err := profile.checkOutputFile(outputFile); err != nil {
+		return err
+	}
+	if err := segment.validate(); err != nil {
+		return err
+	}
+	if err := format.validate(); err != nil {
+		return err
+	}
+	if segment.IsZero() {
+		// the AVI file replaces the whole video
+		return bake(ctx, ffmpegPath, ffprobePath, ffmpegLogPath,
+			aviFile, 0, inputFile, segment, outputFile, profile, r)
+	}
+
+	// probe the duration of the input file to report the progress,
+	// and its frame rate to convert its parts to the format
+	r.stage("Probing input file")
+	video, duration, err := probeVideo(ctx, ffprobePath, inputFile, videoStream)
+	if err != nil {
+		return err
+	}
+
+	// the parts of the input file before and after the segment
+	var trims []string
+	if segment.Start > 0 {
+		trims = append(trims, "trim=end="+formatSeconds(segment.Start))
+	}
+	if segment.End > 0 {
+		trims = append(trims, "trim=start="+formatSeconds(segment.End))
+	}
+
+	// convert the parts to the frame rate and resolution of the AVI file
+	f, err := format.filters(video)
+	if err != nil {
+		return err
+	}
+	var filters string
+	if len(f) > 0 {
+		filters = "," + strings.Join(f, ",")
+	}
+
+	// construct the filter graph splitting the video stream of the
+	// input file into its parts and concatenating them with the frames
+	// of the AVI file, starting the timestamps of each part at 0
+	graph := fmt.Sprintf("[0:v:%d]split=%d", videoStream, len(trims))
+	for i := range trims {
+		graph += fmt.Sprintf("[in%d]", i)
+	}
+	graph += ";"
+	for i, trim := range trims {
+		graph += fmt.Sprintf("[in%d]%s,setpts=PTS-STARTPTS%s[part%d];", i, trim, filters, i)
+	}
+	graph += "[1:v:0]setpts=PTS-STARTPTS[segment];"
+	if segment.Start > 0 {
+		graph += "[part0]"
+	}
+	graph += "[segment]"
+	if segment.End > 0 {
+		graph += fmt.Sprintf("[part%d]", len(trims)-1)
+	}
+	graph += fmt.Sprintf("concat=n=%d:v=1:a=0", len(trims)+1)
+
+	// filters of the profile can't be applied to the output of a filter graph
+	// using -vf, so they are appended to the graph instead
+	options := profile.WithOptions(nil)
+	if vf := options.Options["vf"]; vf != "" {
+		graph += "[stitched];[stitched]" + vf
+		delete(options.Options, "vf")
+	}
+	graph += "[out]"
+
+	// construct ffmpeg arguments
+	args := []string{
+		"-i", inputFile,
+		"-i", aviFile,
+		"-filter_complex", graph,
+		"-map", "[out]",
+	}
+	if profile.Audio {
+		// keep the audio stream of the input file, if it has one
+		args = append(args, "-map", "0:a:0?")
+	}
+
+	args = append(args, options.args()...)
+
+	// force overwrite the output file
+	// to avoid the command line prompt before execution
+	args = append(args, "-y")
+
+	// append output file as last argument
+	args = append(args, outputFile)
+
+	r.stage(fmt.Sprintf("Stitching %s output file", profile.Name))
+	return runFFmpeg(ctx, ffmpegPath, args, ffmpegLogPath, duration, r, nil)
+}
@@ -0,0 +1,427 @@
+package moshpit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestOutputProfileByName(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		err     string
+	}{
+		{name: "h264", profile: "h264"},
+		{name: "ProRes4444", profile: "prores4444"},
+		{name: "avi", profile: "avi"},
+		{
+			name: "mpeg2",
+			err: `unknown output profile "mpeg2", must be one of ` +
+				"h264, h265, prores, prores4444, vp9, av1, ffv1, gif, apng, avi",
+		},
+	}
+
+	for _, test := range tests {
+		profile, err := OutputProfileByName(test.name)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if profile.Name != test.profile {
+			t.Errorf("%s: got profile %s, want %s", test.name, profile.Name, test.profile)
+		}
+	}
+
+	// the returned profile is a copy
+	profile, err := OutputProfileByName("h264")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile.Options["crf"] = "30"
+	profile.Extensions[0] = ".mkv"
+	if profile, _ := OutputProfileByName("h264"); profile.Options["crf"] != "18" || profile.Extensions[0] != ".mp4" {
+		t.Fatal("modifying the returned profile changed the h264 profile")
+	}
+}
+
+func TestOutputProfileForFile(t *testing.T) {
+	tests := []struct {
+		fileName string
+		profile  string
+		err      string
+	}{
+		{fileName: "output.mp4", profile: "h264"},
+		{fileName: "output.MOV", profile: "prores"},
+		{fileName: "output.webm", profile: "vp9"},
+		{fileName: "output.mkv", profile: "ffv1"},
+		{fileName: "output.gif", profile: "gif"},
+		{fileName: "output.png", profile: "apng"},
+		{fileName: "output.avi", profile: "avi"},
+		{
+			fileName: "output.flv",
+			err: `unsupported output file extension ".flv", must be one of ` +
+				".apng, .avi, .gif, .mkv, .mov, .mp4, .png, .webm",
+		},
+	}
+
+	for _, test := range tests {
+		profile, err := OutputProfileForFile(test.fileName)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %s", test.fileName, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.fileName, err)
+		} else if profile.Name != test.profile || !profile.Supports(test.fileName) {
+			t.Errorf("%s: got profile %s, want %s supporting the file", test.fileName, profile.Name, test.profile)
+		}
+	}
+}
+
+func TestParseOutputOptions(t *testing.T) {
+	tests := []struct {
+		list    string
+		options map[string]string
+		err     bool
+	}{
+		{list: "", options: map[string]string{}},
+		{list: "crf=23", options: map[string]string{"crf": "23"}},
+		{list: " -crf = 23 , preset=slow,,", options: map[string]string{"crf": "23", "preset": "slow"}},
+		{list: "an", options: map[string]string{"an": ""}},
+		{list: "vf=scale=640:-2", options: map[string]string{"vf": "scale=640:-2"}},
+		{list: "crf=23,=slow", err: true},
+		{list: "-", err: true},
+	}
+
+	for _, test := range tests {
+		options, err := ParseOutputOptions(test.list)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseOutputOptions(%q) = %v, want an error", test.list, options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseOutputOptions(%q): %v", test.list, err)
+			continue
+		}
+		if len(options) != len(test.options) {
+			t.Errorf("ParseOutputOptions(%q) = %v, want %v", test.list, options, test.options)
+			continue
+		}
+		for name, value := range test.options {
+			if v, ok := options[name]; !ok || v != value {
+				t.Errorf("ParseOutputOptions(%q) = %v, want %v", test.list, options, test.options)
+				break
+			}
+		}
+	}
+}
+
+func TestOutputProfileArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		options map[string]string
+		args    string
+	}{
+		{
+			name:    "h264",
+			profile: "h264",
+			args:    "-b:a 320k -c:a aac -c:v libx264 -crf 18 -movflags +faststart -pix_fmt yuv420p -preset medium",
+		},
+		{
+			name:    "replaced options",
+			profile: "h264",
+			options: map[string]string{"crf": "23", "preset": "slow", "an": ""},
+			args:    "-an -b:a 320k -c:a aac -c:v libx264 -crf 23 -movflags +faststart -pix_fmt yuv420p -preset slow",
+		},
+		{
+			name:    "copy",
+			profile: "avi",
+			args:    "",
+		},
+	}
+
+	for _, test := range tests {
+		profile, err := OutputProfileByName(test.profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if args := strings.Join(profile.WithOptions(test.options).args(), " "); args != test.args {
+			t.Errorf("%s: got arguments %s, want %s", test.name, args, test.args)
+		}
+	}
+}
+
+func TestOutputProfileSupports(t *testing.T) {
+	profile, err := OutputProfileByName("apng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		fileName string
+		supports bool
+	}{
+		{fileName: "output.apng", supports: true},
+		{fileName: "output.PNG", supports: true},
+		{fileName: "output.gif", supports: false},
+		{fileName: "output", supports: false},
+	}
+
+	for _, test := range tests {
+		if supports := profile.Supports(test.fileName); supports != test.supports {
+			t.Errorf("Supports(%s) = %v, want %v", test.fileName, supports, test.supports)
+		}
+	}
+}
+
+// recordingFFmpeg returns an ffmpeg script writing its arguments
+// to the returned file, along with an empty output file.
+func (p *pipelineTest) recordingFFmpeg(t *testing.T) (string, string) {
+	argsFile := filepath.Join(p.dir, "args")
+	return p.script(t, "printf '%s\\n' \"$@\" > '"+argsFile+"'\nfor last; do :; done\n: > \"$last\"\n"), argsFile
+}
+
+// recordedArgs returns the arguments written to the file by
+// the recordingFFmpeg script, or an empty string if it didn't run.
+// The file is removed afterwards.
+func recordedArgs(t *testing.T, argsFile string) string {
+	t.Helper()
+	args, err := ioutil.ReadFile(argsFile)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(argsFile)
+	return strings.Join(strings.Fields(string(args)), " ")
+}
+
+func TestBake(t *testing.T) {
+	pt := newPipelineTest(t)
+	defer pt.remove()
+	ffmpegPath, argsFile := pt.recordingFFmpeg(t)
+	progress := "-progress " + os.Stdout.Name()
+
+	tests := []struct {
+		name       string
+		profile    string
+		outputFile string
+		soundFile  string
+		segment    Segment
+		args       string
+		err        string
+	}{
+		{
+			name:       "audio",
+			profile:    "vp9",
+			outputFile: "output.webm",
+			soundFile:  "input.mp4",
+			args: "-i {avi} -map 0:v:0 -i input.mp4 -map 1:a:0? " +
+				"-b:a 192k -b:v 0 -c:a libopus -c:v libvpx-vp9 -crf 31 -row-mt 1 -y " + progress + " {out}",
+		},
+		{
+			name:       "audio segment",
+			profile:    "h264",
+			outputFile: "output.mp4",
+			soundFile:  "input.mp4",
+			segment:    Segment{Start: 1500 * time.Millisecond, End: 3 * time.Second},
+			args: "-i {avi} -map 0:v:0 -ss 1.5 -to 3 -i input.mp4 -map 1:a:0? " +
+				"-b:a 320k -c:a aac -c:v libx264 -crf 18 -movflags +faststart -pix_fmt yuv420p -preset medium -y " +
+				progress + " {out}",
+		},
+		{
+			name:       "profile without audio",
+			profile:    "gif",
+			outputFile: "output.gif",
+			soundFile:  "input.mp4",
+			args: "-i {avi} -map 0:v:0 " +
+				"-loop 0 -vf fps=15,split[a][b];[a]palettegen[p];[b][p]paletteuse -y " + progress + " {out}",
+		},
+		{
+			name:       "copy",
+			profile:    "avi",
+			outputFile: "output.avi",
+		},
+		{
+			name:       "unsupported output file",
+			profile:    "prores",
+			outputFile: "output.mp4",
+			err:        "output file of the prores profile must have the .mov extension",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile, err := OutputProfileByName(test.profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputFile := filepath.Join(pt.dir, test.outputFile)
+			err = BakeSync(context.Background(), ffmpegPath, pt.ffprobe(t), "",
+				pt.aviFile, 0, test.soundFile, test.segment, outputFile, profile, nil)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			args := recordedArgs(t, argsFile)
+			if profile.Copy {
+				// ffmpeg isn't run for copied files
+				output, err := ioutil.ReadFile(outputFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(output) != string(pt.aviData) || args != "" {
+					t.Fatal("the AVI file wasn't copied to the output file")
+				}
+				return
+			}
+			expected := strings.NewReplacer("{avi}", pt.aviFile, "{out}", outputFile).Replace(test.args)
+			if args != expected {
+				t.Fatalf("got arguments\n%s\nwant\n%s", args, expected)
+			}
+		})
+	}
+}
+
+func TestStitch(t *testing.T) {
+	pt := newPipelineTest(t)
+	defer pt.remove()
+	ffmpegPath, argsFile := pt.recordingFFmpeg(t)
+	progress := "-progress " + os.Stdout.Name()
+
+	tests := []struct {
+		name       string
+		profile    string
+		outputFile string
+		segment    Segment
+		format     AviFormat
+		args       string
+		err        string
+	}{
+		{
+			name:       "segment",
+			profile:    "h264",
+			outputFile: "output.mp4",
+			segment:    Segment{Start: 10 * time.Second, End: 20 * time.Second},
+			args: "-i input.mp4 -i {avi} -filter_complex " +
+				"[0:v:0]split=2[in0][in1];" +
+				"[in0]trim=end=10,setpts=PTS-STARTPTS[part0];" +
+				"[in1]trim=start=20,setpts=PTS-STARTPTS[part1];" +
+				"[1:v:0]setpts=PTS-STARTPTS[segment];" +
+				"[part0][segment][part1]concat=n=3:v=1:a=0[out] " +
+				"-map [out] -map 0:a:0? " +
+				"-b:a 320k -c:a aac -c:v libx264 -crf 18 -movflags +faststart -pix_fmt yuv420p -preset medium -y " +
+				progress + " {out}",
+		},
+		{
+			name:       "converted format",
+			profile:    "h264",
+			outputFile: "output.mp4",
+			segment:    Segment{Start: 10 * time.Second},
+			format:     AviFormat{FrameRate: Rational{25, 1}, Width: 640},
+			args: "-i input.mp4 -i {avi} -filter_complex " +
+				"[0:v:0]split=1[in0];" +
+				"[in0]trim=end=10,setpts=PTS-STARTPTS,fps=25/1,scale=640:-2,setsar=1[part0];" +
+				"[1:v:0]setpts=PTS-STARTPTS[segment];" +
+				"[part0][segment]concat=n=2:v=1:a=0[out] " +
+				"-map [out] -map 0:a:0? " +
+				"-b:a 320k -c:a aac -c:v libx264 -crf 18 -movflags +faststart -pix_fmt yuv420p -preset medium -y " +
+				progress + " {out}",
+		},
+		{
+			name:       "segment at the start",
+			profile:    "ffv1",
+			outputFile: "output.mkv",
+			segment:    Segment{End: 5 * time.Second},
+			args: "-i input.mp4 -i {avi} -filter_complex " +
+				"[0:v:0]split=1[in0];" +
+				"[in0]trim=start=5,setpts=PTS-STARTPTS[part0];" +
+				"[1:v:0]setpts=PTS-STARTPTS[segment];" +
+				"[segment][part0]concat=n=2:v=1:a=0[out] " +
+				"-map [out] -map 0:a:0? " +
+				"-c:a flac -c:v ffv1 -g 1 -level 3 -slicecrc 1 -y " + progress + " {out}",
+		},
+		{
+			name:       "profile filters",
+			profile:    "gif",
+			outputFile: "output.gif",
+			segment:    Segment{Start: 5 * time.Second},
+			args: "-i input.mp4 -i {avi} -filter_complex " +
+				"[0:v:0]split=1[in0];" +
+				"[in0]trim=end=5,setpts=PTS-STARTPTS[part0];" +
+				"[1:v:0]setpts=PTS-STARTPTS[segment];" +
+				"[part0][segment]concat=n=2:v=1:a=0" +
+				"[stitched];[stitched]fps=15,split[a][b];[a]palettegen[p];[b][p]paletteuse[out] " +
+				"-map [out] -loop 0 -y " + progress + " {out}",
+		},
+		{
+			name:       "whole video",
+			profile:    "h264",
+			outputFile: "output.mp4",
+			args: "-i {avi} -map 0:v:0 -i input.mp4 -map 1:a:0? " +
+				"-b:a 320k -c:a aac -c:v libx264 -crf 18 -movflags +faststart -pix_fmt yuv420p -preset medium -y " +
+				progress + " {out}",
+		},
+		{
+			name:       "copy",
+			profile:    "avi",
+			outputFile: "output.avi",
+			segment:    Segment{Start: 5 * time.Second},
+			err:        "the avi profile can't be used to stitch files",
+		},
+		{
+			name:       "invalid segment",
+			profile:    "h264",
+			outputFile: "output.mp4",
+			segment:    Segment{Start: 5 * time.Second, End: time.Second},
+			err:        "the end of the segment must be after its start",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile, err := OutputProfileByName(test.profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputFile := filepath.Join(pt.dir, test.outputFile)
+			err = StitchSync(context.Background(), ffmpegPath, pt.ffprobe(t), "",
+				"input.mp4", 0, test.segment, test.format, pt.aviFile, outputFile, profile, nil)
+			args := recordedArgs(t, argsFile)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := strings.NewReplacer("{avi}", pt.aviFile, "{out}", outputFile).Replace(test.args)
+			if args != expected {
+				t.Fatalf("got arguments\n%s\nwant\n%s", args, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package moshpit
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Segment is a part of the timeline of a video, selected like
+// by the -ss and -to options of ffmpeg, so only the segment
+// has to be processed. The zero Segment is the whole video.
+type Segment struct {
+	// Start is the time the segment starts at.
+	Start time.Duration `json:"start"`
+	// End is the time the segment ends at, or 0 for the end of the video.
+	End time.Duration `json:"end"`
+}
+
+// ParseSegment parses the start and end time of a segment
+// as accepted by ParseTime. Empty strings select the start
+// and the end of the video, respectively.
+func ParseSegment(start string, end string) (Segment, error) {
+	var s Segment
+	var err error
+	if start != "" {
+		if s.Start, err = ParseTime(start); err != nil {
+			return Segment{}, err
+		}
+	}
+	if end != "" {
+		if s.End, err = ParseTime(end); err != nil {
+			return Segment{}, err
+		}
+		if s.End == 0 {
+			return Segment{}, errors.New("the end of the segment must be after 0")
+		}
+	}
+	return s, s.validate()
+}
+
+// ParseTime parses a time in seconds like 72.2,
+// a time like 72.2s or 1m12.2s, or a time in the
+// format [HH:]MM:SS[.mmm] like 01:12.2, as accepted by ffmpeg.
+func ParseTime(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	invalid := fmt.Errorf(`"%s" is not a valid time`, s)
+
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		if seconds < 0 {
+			return 0, invalid
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	if !strings.Contains(s, ":") {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return 0, invalid
+		}
+		return d, nil
+	}
+
+	spl := strings.Split(s, ":")
+	if len(spl) > 3 {
+		return 0, invalid
+	}
+	seconds, err := strconv.ParseFloat(spl[len(spl)-1], 64)
+	if err != nil || seconds < 0 || seconds >= 60 {
+		return 0, invalid
+	}
+	t := time.Duration(seconds * float64(time.Second))
+	unit := time.Minute
+	for i := len(spl) - 2; i >= 0; i-- {
+		v, err := strconv.ParseUint(spl[i], 10, 32)
+		if err != nil || (unit == time.Minute && len(spl) == 3 && v >= 60) {
+			return 0, invalid
+		}
+		t += time.Duration(v) * unit
+		unit = time.Hour
+	}
+	return t, nil
+}
+
+// IsZero returns whether the segment is the whole video.
+func (s Segment) IsZero() bool {
+	return s.Start == 0 && s.End == 0
+}
+
+// String returns the segment in the format start-end,
+// like 00:01:12.200-00:01:17.200, with the end omitted
+// if the segment lasts until the end of the video.
+func (s Segment) String() string {
+	str := formatTime(s.Start) + "-"
+	if s.End > 0 {
+		str += formatTime(s.End)
+	}
+	return str
+}
+
+// FirstFrame returns the index of the first frame of the segment
+// in the timeline of the video with the given frame rate,
+// which is the frame shown at its start time.
+func (s Segment) FirstFrame(fps float64) (uint64, error) {
+	if s.Start == 0 {
+		return 0, nil
+	}
+	return timeFrame(s.Start, fps)
+}
+
+func (s Segment) validate() error {
+	if s.Start < 0 || s.End < 0 {
+		return errors.New("the times of the segment must not be negative")
+	}
+	if s.End > 0 && s.End <= s.Start {
+		return errors.New("the end of the segment must be after its start")
+	}
+	return nil
+}
+
+// inputArgs returns the ffmpeg input options
+// only reading the segment of the following input file.
+func (s Segment) inputArgs() []string {
+	var args []string
+	if s.Start > 0 {
+		args = append(args, "-ss", formatSeconds(s.Start))
+	}
+	if s.End > 0 {
+		args = append(args, "-to", formatSeconds(s.End))
+	}
+	return args
+}
+
+// duration returns the duration of the segment
+// of a video with the given duration.
+func (s Segment) duration(total time.Duration) time.Duration {
+	if s.End > 0 && s.End < total {
+		total = s.End
+	}
+	if total < s.Start {
+		return 0
+	}
+	return total - s.Start
+}
+
+// shiftFrames returns the frame indices relative to the first frame,
+// leaving out the frames before it.
+// nil is returned unchanged to keep its meaning.
+func shiftFrames(frames []uint64, firstFrame uint64) []uint64 {
+	if frames == nil || firstFrame == 0 {
+		return frames
+	}
+	shifted := []uint64{}
+	for _, frame := range frames {
+		if frame >= firstFrame {
+			shifted = append(shifted, frame-firstFrame)
+		}
+	}
+	return shifted
+}
+
+// shiftIFrames returns the I-Frame indices relative to the first frame.
+// The frames before it are moved to the first frame instead of
+// being left out, so the I-Frame at the start of the segment is kept.
+// nil is returned unchanged to keep its meaning.
+func shiftIFrames(frames []uint64, firstFrame uint64) []uint64 {
+	if frames == nil || firstFrame == 0 {
+		return frames
+	}
+	shifted := []uint64{}
+	var hasFirst bool
+	for _, frame := range frames {
+		if frame <= firstFrame {
+			// only place a single I-Frame at the first frame
+			if !hasFirst {
+				shifted = append(shifted, 0)
+				hasFirst = true
+			}
+			continue
+		}
+		shifted = append(shifted, frame-firstFrame)
+	}
+	return shifted
+}
+
+// formatSeconds formats the time in seconds as accepted by ffmpeg.
+func formatSeconds(t time.Duration) string {
+	return strconv.FormatFloat(t.Seconds(), 'f', -1, 64)
+}
+
+// formatTime formats the time in the format HH:MM:SS.mmm.
+func formatTime(t time.Duration) string {
+	ms := t.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
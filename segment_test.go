@@ -0,0 +1,206 @@
+package moshpit
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		s       string
+		t       time.Duration
+		invalid bool
+	}{
+		{s: "0", t: 0},
+		{s: "72.2", t: 72200 * time.Millisecond},
+		{s: " 72.2s ", t: 72200 * time.Millisecond},
+		{s: "1m12.2s", t: 72200 * time.Millisecond},
+		{s: "01:12.2", t: 72200 * time.Millisecond},
+		{s: "1:02:03.5", t: time.Hour + 2*time.Minute + 3500*time.Millisecond},
+		{s: "120:00", t: 2 * time.Hour},
+		{s: "-1", invalid: true},
+		{s: "-1s", invalid: true},
+		{s: "abc", invalid: true},
+		{s: "01:60", invalid: true},
+		{s: "1:60:00", invalid: true},
+		{s: "1:-1:00", invalid: true},
+		{s: "1:2:3:4", invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.s, func(t *testing.T) {
+			d, err := ParseTime(test.s)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("got %s, want an error", d)
+				}
+				return
+			}
+			if err != nil || d != test.t {
+				t.Fatalf("got %s and error %v, want %s", d, err, test.t)
+			}
+		})
+	}
+}
+
+func TestParseSegment(t *testing.T) {
+	tests := []struct {
+		start   string
+		end     string
+		segment Segment
+		invalid bool
+	}{
+		{start: "", end: "", segment: Segment{}},
+		{start: "10", end: "", segment: Segment{Start: 10 * time.Second}},
+		{start: "", end: "00:20", segment: Segment{End: 20 * time.Second}},
+		{start: "1.5", end: "2.5", segment: Segment{Start: 1500 * time.Millisecond, End: 2500 * time.Millisecond}},
+		{start: "", end: "0", invalid: true},
+		{start: "10", end: "10", invalid: true},
+		{start: "10", end: "5", invalid: true},
+		{start: "x", end: "", invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.start+"-"+test.end, func(t *testing.T) {
+			s, err := ParseSegment(test.start, test.end)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("got %s, want an error", s)
+				}
+				return
+			}
+			if err != nil || s != test.segment {
+				t.Fatalf("got %s and error %v, want %s", s, err, test.segment)
+			}
+		})
+	}
+}
+
+func TestShiftFrames(t *testing.T) {
+	tests := []struct {
+		name       string
+		frames     []uint64
+		firstFrame uint64
+		shifted    []uint64
+		iFrames    []uint64
+	}{
+		{
+			name:       "nil",
+			frames:     nil,
+			firstFrame: 10,
+			shifted:    nil,
+			iFrames:    nil,
+		},
+		{
+			name:       "empty",
+			frames:     []uint64{},
+			firstFrame: 10,
+			shifted:    []uint64{},
+			iFrames:    []uint64{},
+		},
+		{
+			name:       "start of video",
+			frames:     []uint64{0, 5, 20},
+			firstFrame: 0,
+			shifted:    []uint64{0, 5, 20},
+			iFrames:    []uint64{0, 5, 20},
+		},
+		{
+			name:       "frames after start",
+			frames:     []uint64{10, 15, 30},
+			firstFrame: 10,
+			shifted:    []uint64{0, 5, 20},
+			iFrames:    []uint64{0, 5, 20},
+		},
+		{
+			name:       "frames before start",
+			frames:     []uint64{0, 5, 12, 30},
+			firstFrame: 10,
+			shifted:    []uint64{2, 20},
+			iFrames:    []uint64{0, 2, 20},
+		},
+		{
+			name:       "frames before and at start",
+			frames:     []uint64{0, 10, 12},
+			firstFrame: 10,
+			shifted:    []uint64{0, 2},
+			iFrames:    []uint64{0, 2},
+		},
+		{
+			name:       "all frames before start",
+			frames:     []uint64{0, 5},
+			firstFrame: 10,
+			shifted:    []uint64{},
+			iFrames:    []uint64{0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shifted := shiftFrames(test.frames, test.firstFrame)
+			if (shifted == nil) != (test.shifted == nil) || !equalFrames(shifted, test.shifted) {
+				t.Fatalf("shiftFrames returned %#v, want %#v", shifted, test.shifted)
+			}
+			iFrames := shiftIFrames(test.frames, test.firstFrame)
+			if (iFrames == nil) != (test.iFrames == nil) || !equalFrames(iFrames, test.iFrames) {
+				t.Fatalf("shiftIFrames returned %#v, want %#v", iFrames, test.iFrames)
+			}
+		})
+	}
+}
+
+func TestSegment(t *testing.T) {
+	tests := []struct {
+		segment    Segment
+		str        string
+		args       []string
+		duration   time.Duration
+		firstFrame uint64
+	}{
+		{
+			segment:  Segment{},
+			str:      "00:00:00.000-",
+			duration: time.Minute,
+		},
+		{
+			segment:    Segment{Start: 72200 * time.Millisecond},
+			str:        "00:01:12.200-",
+			args:       []string{"-ss", "72.2"},
+			duration:   0,
+			firstFrame: 1805,
+		},
+		{
+			segment:    Segment{Start: 10 * time.Second, End: 20 * time.Second},
+			str:        "00:00:10.000-00:00:20.000",
+			args:       []string{"-ss", "10", "-to", "20"},
+			duration:   10 * time.Second,
+			firstFrame: 250,
+		},
+		{
+			segment:    Segment{Start: 30 * time.Second, End: 2 * time.Hour},
+			str:        "00:00:30.000-02:00:00.000",
+			args:       []string{"-ss", "30", "-to", "7200"},
+			duration:   30 * time.Second,
+			firstFrame: 750,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.str, func(t *testing.T) {
+			s := test.segment
+			if str := s.String(); str != test.str {
+				t.Fatalf("got string %s, want %s", str, test.str)
+			}
+			if args := s.inputArgs(); strings.Join(args, " ") != strings.Join(test.args, " ") {
+				t.Fatalf("got input args %v, want %v", args, test.args)
+			}
+			if d := s.duration(time.Minute); d != test.duration {
+				t.Fatalf("got duration %s of a one minute video, want %s", d, test.duration)
+			}
+			if frame, err := s.FirstFrame(25); err != nil || frame != test.firstFrame {
+				t.Fatalf("got first frame %d and error %v, want %d", frame, err, test.firstFrame)
+			}
+		})
+	}
+}